@@ -2,6 +2,7 @@ package cloudwatchmetrics
 
 import (
 	"context"
+	"sort"
 
 	"github.com/cep21/gometrics/cwmessagebatch"
 	"github.com/cep21/gometrics/metrics"
@@ -9,6 +10,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 )
 
+// maxDatumValues is the most Values (and Counts) CloudWatch accepts in a single MetricDatum.  A datum with more fails
+// the whole PutMetricData call.
+const maxDatumValues = 150
+
 type Config struct {
 	StorageResolution int64
 	Namespace         string
@@ -72,12 +77,12 @@ func intoMetricDatum(m metrics.TimeSeriesAggregation, storageResolution *int64)
 	}
 	baseDatum.StatisticValues = statisticsSet(m.Aggregation.Va)
 	countsAllOne := true
-	for _, b := range m.Aggregation.Va.Buckets {
-		if b.Count != 1 {
+	for _, b := range datumBuckets(m.Aggregation.Va.Distribution(), maxDatumValues) {
+		if b.count != 1 {
 			countsAllOne = false
 		}
-		baseDatum.Counts = append(baseDatum.Counts, aws.Float64(float64(b.Count)))
-		baseDatum.Values = append(baseDatum.Values, aws.Float64(b.Middle()))
+		baseDatum.Counts = append(baseDatum.Counts, aws.Float64(b.count))
+		baseDatum.Values = append(baseDatum.Values, aws.Float64(b.value))
 	}
 	if countsAllOne {
 		baseDatum.Counts = nil
@@ -85,6 +90,47 @@ func intoMetricDatum(m metrics.TimeSeriesAggregation, storageResolution *int64)
 	return baseDatum
 }
 
+// datumBucket is a value sent to CloudWatch and how many times it was seen
+type datumBucket struct {
+	value float64
+	count float64
+}
+
+// datumBuckets turns a distribution into at most maxValues buckets, merging runs of neighboring buckets if there are
+// too many.  A merged bucket's value is the mean of the middles of the buckets in it, weighted by their counts.
+func datumBuckets(distribution []metrics.Bucket, maxValues int) []datumBucket {
+	buckets := make([]metrics.Bucket, 0, len(distribution))
+	for _, b := range distribution {
+		if b.Count > 0 {
+			buckets = append(buckets, b)
+		}
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start < buckets[j].Start
+	})
+	perValue := (len(buckets) + maxValues - 1) / maxValues
+	ret := make([]datumBucket, 0, (len(buckets)+perValue-1)/perValue)
+	for start := 0; start < len(buckets); start += perValue {
+		end := start + perValue
+		if end > len(buckets) {
+			end = len(buckets)
+		}
+		var count, weighted float64
+		for i := start; i < end; i++ {
+			count += float64(buckets[i].Count)
+			weighted += float64(buckets[i].Count) * buckets[i].Middle()
+		}
+		ret = append(ret, datumBucket{
+			value: weighted / count,
+			count: count,
+		})
+	}
+	return ret
+}
+
 func statisticsSet(va metrics.ValueAggregation) *cloudwatch.StatisticSet {
 	return &cloudwatch.StatisticSet{
 		Maximum:     &va.Maximum,
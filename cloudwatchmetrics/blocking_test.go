@@ -0,0 +1,57 @@
+package cloudwatchmetrics
+
+import (
+	"testing"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntoMetricDatum_wideSketch(t *testing.T) {
+	sketch := &metrics.DDSketch{}
+	count := 0
+	for v := 1e-9; v < 1e12; v *= 1.01 {
+		sketch.Observe(v)
+		sketch.Observe(-v)
+		count += 2
+	}
+	require.True(t, len(sketch.Buckets()) > maxDatumValues)
+	datum := intoMetricDatum(metrics.TimeSeriesAggregation{
+		TS: &metrics.TimeSeries{Tsi: metrics.TimeSeriesIdentifier{MetricName: "latency"}},
+		Aggregation: metrics.TimeWindowAggregation{
+			Va: metrics.ValueAggregation{
+				SampleCount: int32(count),
+				Minimum:     -1e12,
+				Maximum:     1e12,
+				DDSketch:    sketch,
+			},
+		},
+	}, nil)
+	require.True(t, len(datum.Values) <= maxDatumValues, "%d values", len(datum.Values))
+	require.Len(t, datum.Counts, len(datum.Values))
+	total := 0.0
+	for i, c := range datum.Counts {
+		total += *c
+		if i > 0 {
+			require.True(t, *datum.Values[i-1] < *datum.Values[i])
+		}
+	}
+	require.Equal(t, float64(count), total)
+	require.True(t, *datum.Values[0] < 0)
+	require.True(t, *datum.Values[len(datum.Values)-1] > 1e11)
+}
+
+func TestDatumBuckets(t *testing.T) {
+	require.Empty(t, datumBuckets(nil, maxDatumValues))
+	buckets := []metrics.Bucket{
+		{Start: 2, End: 4, Count: 3},
+		{Start: 0, End: 2, Count: 1},
+		{Start: 4, End: 6, Count: 0},
+		{Start: 6, End: 8, Count: 2},
+	}
+	require.Equal(t, []datumBucket{{value: 1, count: 1}, {value: 3, count: 3}, {value: 7, count: 2}}, datumBuckets(buckets, 3))
+	merged := datumBuckets(buckets, 2)
+	require.Len(t, merged, 2)
+	require.Equal(t, datumBucket{value: 2.5, count: 4}, merged[0])
+	require.Equal(t, datumBucket{value: 7, count: 2}, merged[1])
+}
@@ -4,5 +4,8 @@ go 1.13
 
 require (
 	github.com/aws/aws-sdk-go v1.23.20
+	github.com/benbjohnson/clock v1.3.5
 	github.com/cactus/go-statsd-client/statsd v0.0.0-20190906215803-47b6058c80f5
+	github.com/codahale/hdrhistogram v0.0.0-20161010025455-3a0bb77429bd
+	github.com/stretchr/testify v1.8.4
 )
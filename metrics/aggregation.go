@@ -8,13 +8,31 @@ import (
 type TimeWindowAggregation struct {
 	Va ValueAggregation
 	Tw TimeWindow
+	// Exemplars are a bounded set of example observations from this window.  Optional
+	Exemplars []Exemplar
 }
 
-// Union Merges two aggregations inside a time period
+// Union Merges two aggregations inside a time period.  FirstValue comes from the aggregation whose window starts first
+// and LastValue from the one whose window ends last.  On ties, a is first and other is last.  Exemplars of the smallest
+// and largest values are kept, then the most recent, up to the size of the larger set of exemplars.
 func (a TimeWindowAggregation) Union(other TimeWindowAggregation) TimeWindowAggregation {
+	va := a.Va.Union(other.Va)
+	if a.Va.SampleCount > 0 && other.Va.SampleCount > 0 {
+		if other.Tw.Start.Before(a.Tw.Start) {
+			va.FirstValue = other.Va.FirstValue
+		} else {
+			va.FirstValue = a.Va.FirstValue
+		}
+		if a.Tw.End().After(other.Tw.End()) {
+			va.LastValue = a.Va.LastValue
+		} else {
+			va.LastValue = other.Va.LastValue
+		}
+	}
 	return TimeWindowAggregation{
-		Va: a.Va.Union(other.Va),
-		Tw: a.Tw.Union(other.Tw),
+		Va:        va,
+		Tw:        a.Tw.Union(other.Tw),
+		Exemplars: mergeExemplars(a.Exemplars, other.Exemplars),
 	}
 }
 
@@ -79,6 +97,12 @@ type ValueAggregator interface {
 	Aggregate() ValueAggregation
 }
 
+// Resetter is implemented by aggregators and bucketers that can be cleared back to their starting state, so they can
+// be reused instead of allocated again
+type Resetter interface {
+	Reset()
+}
+
 // AggregationSink can receive aggregations
 type AggregationSink interface {
 	Aggregate(context.Context, []TimeSeriesAggregation) error
@@ -94,6 +118,23 @@ type MetricCollector interface {
 	CollectMetrics() []TimeWindowAggregation
 }
 
+// DrainableCollector is a MetricCollector that can also report values it is still aggregating, like the current
+// window of a rolling aggregation.  Registry drains collectors before it evicts them.
+type DrainableCollector interface {
+	MetricCollector
+	// DrainMetrics returns aggregations of every value observed and not yet collected
+	DrainMetrics() []TimeWindowAggregation
+}
+
+// EvictableObserver is an Observer whose time series can be evicted from its registry for being idle (see
+// Registry.IdleTTL).  Caches of observers use it to let go of evicted ones.
+type EvictableObserver interface {
+	Observer
+	// Evicted returns true if the time series of the observer is no longer in its registry.  Observing a value puts it
+	// back.
+	Evicted() bool
+}
+
 // MetricCollectorConstructor can create unique metric collectors for a time series
 type MetricCollectorConstructor func(ts *TimeSeries) MetricCollector
 
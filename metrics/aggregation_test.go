@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowAggregation_Union(t *testing.T) {
+	start := time.Now()
+	early := TimeWindowAggregation{
+		Va: ValueAggregation{SampleCount: 2, Minimum: 1, Maximum: 2, Sum: 3, FirstValue: 1, LastValue: 2},
+		Tw: TimeWindow{Start: start, Duration: time.Minute},
+	}
+	late := TimeWindowAggregation{
+		Va: ValueAggregation{SampleCount: 2, Minimum: 3, Maximum: 4, Sum: 7, FirstValue: 3, LastValue: 4},
+		Tw: TimeWindow{Start: start.Add(time.Minute), Duration: time.Minute},
+	}
+	empty := TimeWindowAggregation{
+		Tw: TimeWindow{Start: start.Add(time.Minute * 2), Duration: time.Minute},
+	}
+	tests := []struct {
+		name      string
+		a         TimeWindowAggregation
+		other     TimeWindowAggregation
+		wantFirst float64
+		wantLast  float64
+		wantMin   float64
+		wantMax   float64
+	}{
+		{
+			name:      "in order",
+			a:         early,
+			other:     late,
+			wantFirst: 1,
+			wantLast:  4,
+			wantMin:   1,
+			wantMax:   4,
+		},
+		{
+			name:      "out of order",
+			a:         late,
+			other:     early,
+			wantFirst: 1,
+			wantLast:  4,
+			wantMin:   1,
+			wantMax:   4,
+		},
+		{
+			name:      "later empty window",
+			a:         late,
+			other:     empty,
+			wantFirst: 3,
+			wantLast:  4,
+			wantMin:   3,
+			wantMax:   4,
+		},
+		{
+			name:      "empty window first",
+			a:         empty,
+			other:     early,
+			wantFirst: 1,
+			wantLast:  2,
+			wantMin:   1,
+			wantMax:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.a.Union(tt.other)
+			if got.Va.FirstValue != tt.wantFirst || got.Va.LastValue != tt.wantLast {
+				t.Errorf("TimeWindowAggregation.Union() first/last = %v/%v, want %v/%v", got.Va.FirstValue, got.Va.LastValue, tt.wantFirst, tt.wantLast)
+			}
+			if got.Va.Minimum != tt.wantMin || got.Va.Maximum != tt.wantMax {
+				t.Errorf("TimeWindowAggregation.Union() min/max = %v/%v, want %v/%v", got.Va.Minimum, got.Va.Maximum, tt.wantMin, tt.wantMax)
+			}
+			if want := tt.a.Tw.Union(tt.other.Tw); got.Tw != want {
+				t.Errorf("TimeWindowAggregation.Union() window = %v, want %v", got.Tw, want)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package metrics
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
 // Bucket is an aggregated count of values inside a range
 type Bucket struct {
@@ -40,6 +43,12 @@ func bucketMerge(a []Bucket, b []Bucket) []Bucket {
 			End:   k.end,
 		})
 	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Start == ret[j].Start {
+			return ret[i].End < ret[j].End
+		}
+		return ret[i].Start < ret[j].Start
+	})
 	return ret
 }
 
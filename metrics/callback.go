@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// CallbackFunc is called by a Registry at the start of every FlushMetrics.  It reports the current value of each time
+// series it knows about by calling report, with the dimensions of that series.
+type CallbackFunc func(report func(dimensions map[string]string, value float64))
+
+// CallbackRegistry is a registry that runs callbacks when it is flushed, like *Registry
+type CallbackRegistry interface {
+	BaseRegistry
+	// RegisterCallback calls f at every flush and reports what it reports (see Registry.RegisterCallback)
+	RegisterCallback(metricName string, tsType TimeSeriesType, metadata MetadataConstructor, f CallbackFunc) (unregister func())
+}
+
+var _ CallbackRegistry = &Registry{}
+
+// registeredCallback is a callback and what kind of time series it reports
+type registeredCallback struct {
+	metricName string
+	metadata   MetadataConstructor
+	tsType     TimeSeriesType
+	f          CallbackFunc
+
+	// mu serializes runs of the callback and guards totals
+	mu     sync.Mutex
+	totals CounterTotals
+}
+
+// RegisterCallback calls f at the start of every FlushMetrics and flushes each value it reports for the time series of
+// metricName and the reported dimensions.  metadata, which may be nil, describes those time series, and tsType is
+// TSTypeGauge or TSTypeCounter.  Gauges are flushed as reported.  Counters report a running total, and the registry
+// flushes how much it grew since the last flush.  The first total reported for a set of dimensions is only a baseline,
+// so it is not flushed, and a total that goes down is flushed whole.  Dimensions that are not reported in a flush
+// lose their baseline.  Values reported to a time series that already has a collector that is not a callback are
+// ignored.  Call the returned function to unregister the callback.
+func (r *Registry) RegisterCallback(metricName string, tsType TimeSeriesType, metadata MetadataConstructor, f CallbackFunc) (unregister func()) {
+	cb := &registeredCallback{
+		metricName: metricName,
+		tsType:     tsType,
+		f:          f,
+		metadata: func(tsi TimeSeriesIdentifier, tsm TimeSeriesMetadata) TimeSeriesMetadata {
+			if metadata != nil {
+				tsm = metadata(tsi, tsm)
+			}
+			return tsm.WithValue(MetaDataTimeSeriesType, tsType)
+		},
+	}
+	r.callbacksMu.Lock()
+	if r.callbacks == nil {
+		r.callbacks = make(map[*registeredCallback]struct{})
+	}
+	r.callbacks[cb] = struct{}{}
+	r.callbacksMu.Unlock()
+	return func() {
+		r.callbacksMu.Lock()
+		delete(r.callbacks, cb)
+		r.callbacksMu.Unlock()
+	}
+}
+
+// RegisterGaugeFunc flushes f() as a gauge of metricName and dimensions at every FlushMetrics.  Call the returned
+// function to unregister it.
+func (r *Registry) RegisterGaugeFunc(metricName string, dimensions map[string]string, f func() float64) (unregister func()) {
+	return r.RegisterCallback(metricName, TSTypeGauge, nil, func(report func(map[string]string, float64)) {
+		report(dimensions, f())
+	})
+}
+
+// RegisterCounterFunc flushes how much the running total f() grew, as a counter of metricName and dimensions, at every
+// FlushMetrics after the first.  Call the returned function to unregister it.
+func (r *Registry) RegisterCounterFunc(metricName string, dimensions map[string]string, f func() float64) (unregister func()) {
+	return r.RegisterCallback(metricName, TSTypeCounter, nil, func(report func(map[string]string, float64)) {
+		report(dimensions, f())
+	})
+}
+
+// runCallbacks calls every registered callback, storing what they report in the collectors of their time series
+func (r *Registry) runCallbacks() {
+	r.callbacksMu.Lock()
+	callbacks := make([]*registeredCallback, 0, len(r.callbacks))
+	for cb := range r.callbacks {
+		callbacks = append(callbacks, cb)
+	}
+	r.callbacksMu.Unlock()
+	// Callbacks run without the lock, so they may unregister themselves
+	for _, cb := range callbacks {
+		r.runCallback(cb)
+	}
+}
+
+func (r *Registry) runCallback(cb *registeredCallback) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.f(func(dimensions map[string]string, value float64) {
+		tsi := TimeSeriesIdentifier{
+			MetricName: cb.metricName,
+			Dimensions: dimensions,
+		}
+		// Over the registry's limits, several dimension sets may share the overflow series and its collector.  Counter
+		// totals are tracked by the reported dimensions, so each is compared only with its own last total.
+		collector := r.GetOrSet(r.TimeSeries(tsi, cb.metadata), func(ts *TimeSeries) MetricCollector {
+			return &callbackCollector{
+				now:         r.now,
+				lastCollect: r.now(),
+			}
+		})
+		cc, ok := collector.(*callbackCollector)
+		if !ok {
+			return
+		}
+		if cb.tsType != TSTypeCounter {
+			cc.set(value)
+			return
+		}
+		if delta, ok := cb.totals.Delta(&tsi, value); ok {
+			cc.add(delta)
+		}
+	})
+	cb.totals.Prune()
+}
+
+// CounterTotals turns the running totals of counters into how much they grew.  It remembers the last total reported
+// for each TimeSeriesIdentifier.  The first total of an identifier is only a baseline, and a total that goes down is
+// counted whole, as if the counter restarted.  It is not thread safe.
+type CounterTotals struct {
+	entries map[uint64][]*counterTotal
+	// round counts calls to Prune, so totals that were not reported since the last one can be forgotten
+	round uint64
+}
+
+type counterTotal struct {
+	tsi       TimeSeriesIdentifier
+	total     float64
+	lastRound uint64
+}
+
+// Delta stores total as the last total of tsi and returns how much it grew since the last one.  Returns false the
+// first time tsi is reported, or the first time since it was pruned, when total is only a baseline.
+func (c *CounterTotals) Delta(tsi *TimeSeriesIdentifier, total float64) (float64, bool) {
+	hash := tsi.Hash()
+	for _, e := range c.entries[hash] {
+		if !e.tsi.Equal(tsi) {
+			continue
+		}
+		delta := total
+		if total >= e.total {
+			delta = total - e.total
+		}
+		e.total = total
+		e.lastRound = c.round
+		return delta, true
+	}
+	if c.entries == nil {
+		c.entries = make(map[uint64][]*counterTotal)
+	}
+	dimensions := make(map[string]string, len(tsi.Dimensions))
+	for k, v := range tsi.Dimensions {
+		dimensions[k] = v
+	}
+	c.entries[hash] = append(c.entries[hash], &counterTotal{
+		tsi: TimeSeriesIdentifier{
+			MetricName: tsi.MetricName,
+			Dimensions: dimensions,
+		},
+		total:     total,
+		lastRound: c.round,
+	})
+	return 0, false
+}
+
+// Prune forgets the totals that were not reported since the last Prune.  Call it after reporting every total of a
+// flush.
+func (c *CounterTotals) Prune() {
+	for hash, entries := range c.entries {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.lastRound == c.round {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.entries, hash)
+		} else {
+			c.entries[hash] = kept
+		}
+	}
+	c.round++
+}
+
+// callbackCollector flushes the value reported by callbacks since the last collection: the last gauge value, or the
+// sum of counter deltas
+type callbackCollector struct {
+	now func() time.Time
+
+	mu          sync.Mutex
+	pending     bool
+	value       float64
+	lastCollect time.Time
+}
+
+func (c *callbackCollector) set(value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = value
+	c.pending = true
+}
+
+func (c *callbackCollector) add(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending {
+		c.value += delta
+	} else {
+		c.value = delta
+	}
+	c.pending = true
+}
+
+// CollectMetrics returns the value reported since the last collection, if any
+func (c *callbackCollector) CollectMetrics() []TimeWindowAggregation {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pending {
+		return nil
+	}
+	start := c.lastCollect
+	c.lastCollect = now
+	c.pending = false
+	return []TimeWindowAggregation{
+		{
+			Va: singleValue(c.value),
+			Tw: TimeWindow{
+				Start:    start,
+				Duration: now.Sub(start),
+			},
+		},
+	}
+}
+
+// singleValue is the aggregation of a single observed value
+func singleValue(value float64) ValueAggregation {
+	return ValueAggregation{
+		SampleCount: 1,
+		Sum:         value,
+		SumSquare:   value * value,
+		Minimum:     value,
+		Maximum:     value,
+		FirstValue:  value,
+		LastValue:   value,
+	}
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func flushedSums(aggs []TimeSeriesAggregation) map[string]float64 {
+	ret := make(map[string]float64, len(aggs))
+	for _, agg := range aggs {
+		ret[agg.TS.Tsi.String()] += agg.Aggregation.Va.Sum
+	}
+	return ret
+}
+
+func TestRegistry_RegisterGaugeFunc(t *testing.T) {
+	now := time.Unix(100, 0)
+	r := &Registry{
+		Now: func() time.Time {
+			return now
+		},
+	}
+	queueLength := 3.0
+	unregister := r.RegisterGaugeFunc("queue", map[string]string{"name": "jobs"}, func() float64 {
+		return queueLength
+	})
+	now = now.Add(time.Minute)
+	flushed := r.FlushMetrics()
+	if len(flushed) != 1 {
+		t.Fatalf("Registry.FlushMetrics() = %v, want one gauge", flushed)
+	}
+	ts := flushed[0].TS
+	if ts.Tsi.MetricName != "queue" || ts.Tsi.Dimensions["name"] != "jobs" || ts.Tsm.Value(MetaDataTimeSeriesType) != TSTypeGauge {
+		t.Errorf("Registry.FlushMetrics() time series = %v", ts)
+	}
+	if va := flushed[0].Aggregation.Va; va.SampleCount != 1 || va.Sum != 3 || va.Maximum != 3 {
+		t.Errorf("Registry.FlushMetrics() gauge = %v, want 3", va)
+	}
+	queueLength = 5
+	now = now.Add(time.Minute)
+	flushed = r.FlushMetrics()
+	if len(flushed) != 1 || flushed[0].Aggregation.Va.Sum != 5 || flushed[0].Aggregation.Tw.Duration != time.Minute {
+		t.Errorf("Registry.FlushMetrics() = %v, want 5 over one minute", flushed)
+	}
+	unregister()
+	if flushed = r.FlushMetrics(); len(flushed) != 0 {
+		t.Errorf("Registry.FlushMetrics() after unregister = %v", flushed)
+	}
+}
+
+func TestRegistry_RegisterCallback(t *testing.T) {
+	r := &Registry{}
+	totals := map[string]float64{"a": 10, "b": 1}
+	r.RegisterCallback("bytes", TSTypeCounter, nil, func(report func(map[string]string, float64)) {
+		for name, total := range totals {
+			report(map[string]string{"disk": name}, total)
+		}
+	})
+	// Callbacks are never given a collector that is not theirs
+	r.Observer(r.TimeSeries(TimeSeriesIdentifier{MetricName: "bytes", Dimensions: map[string]string{"disk": "c"}}, nil))
+	totals["c"] = 100
+
+	tests := []struct {
+		name   string
+		totals map[string]float64
+		want   map[string]float64
+	}{
+		{name: "first flush is a baseline", want: map[string]float64{}},
+		{name: "growth", totals: map[string]float64{"a": 15, "b": 1}, want: map[string]float64{"bytes disk=a": 5, "bytes disk=b": 0}},
+		{name: "reset", totals: map[string]float64{"a": 2, "b": 4}, want: map[string]float64{"bytes disk=a": 2, "bytes disk=b": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.totals {
+				totals[k] = v
+			}
+			got := flushedSums(r.FlushMetrics())
+			if got["bytes disk=c"] != 0 {
+				t.Errorf("Registry.FlushMetrics() reported a series with another collector: %v", got)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("Registry.FlushMetrics() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("Registry.FlushMetrics() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistry_RegisterCallback_metadata(t *testing.T) {
+	r := &Registry{}
+	r.RegisterCallback("wait", TSTypeCounter, func(_ TimeSeriesIdentifier, tsm TimeSeriesMetadata) TimeSeriesMetadata {
+		return tsm.WithValue(MetaDataUnit, "Seconds")
+	}, func(report func(map[string]string, float64)) {
+		report(nil, 1)
+	})
+	r.FlushMetrics()
+	ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "wait"}, nil)
+	if ts.Tsm.Value(MetaDataUnit) != "Seconds" || ts.Tsm.Value(MetaDataTimeSeriesType) != TSTypeCounter {
+		t.Errorf("Registry.RegisterCallback() time series = %v, want a counter in seconds", ts)
+	}
+}
+
+func TestRegistry_RegisterCallback_overflow(t *testing.T) {
+	r := &Registry{
+		MaxSeriesPerMetric: 1,
+	}
+	totals := map[string]float64{"a": 10, "b": 100, "c": 1000}
+	r.RegisterCallback("bytes", TSTypeCounter, nil, func(report func(map[string]string, float64)) {
+		for name, total := range totals {
+			report(map[string]string{"disk": name}, total)
+		}
+	})
+	r.FlushMetrics()
+	totals = map[string]float64{"a": 11, "b": 102, "c": 1003}
+	got := flushedSums(r.FlushMetrics())
+	// One disk has its own series and the other two share the overflow series, which sums their growth
+	var total float64
+	for k, v := range got {
+		if k != OverflowedMetricName+" metric=bytes" {
+			total += v
+		}
+	}
+	if total != 6 || got["bytes overflow=true"] < 3 {
+		t.Errorf("Registry.FlushMetrics() = %v, want growth of 6 with at least 3 in the overflow series", got)
+	}
+}
+
+func TestRegistry_RegisterCallback_pruned(t *testing.T) {
+	r := &Registry{}
+	totals := map[string]float64{"a": 10}
+	r.RegisterCallback("bytes", TSTypeCounter, nil, func(report func(map[string]string, float64)) {
+		for name, total := range totals {
+			report(map[string]string{"disk": name}, total)
+		}
+	})
+	r.FlushMetrics()
+	totals = map[string]float64{}
+	r.FlushMetrics()
+	// The disk was not reported, so coming back it is a new baseline
+	totals = map[string]float64{"a": 15}
+	if got := flushedSums(r.FlushMetrics()); got["bytes disk=a"] != 0 {
+		t.Errorf("Registry.FlushMetrics() = %v, want a new baseline", got)
+	}
+	totals = map[string]float64{"a": 16}
+	if got := flushedSums(r.FlushMetrics()); got["bytes disk=a"] != 1 {
+		t.Errorf("Registry.FlushMetrics() = %v, want growth of 1", got)
+	}
+}
+
+func TestRegistry_RegisterCallback_unregisterInside(t *testing.T) {
+	r := &Registry{}
+	calls := 0
+	var unregister func()
+	unregister = r.RegisterCounterFunc("once", nil, func() float64 {
+		calls++
+		unregister()
+		return 1
+	})
+	r.FlushMetrics()
+	r.FlushMetrics()
+	if calls != 1 {
+		t.Errorf("callback called %d times, want 1", calls)
+	}
+}
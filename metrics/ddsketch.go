@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"math"
+)
+
+const (
+	defaultDDSketchRelativeAccuracy = 0.01
+	defaultDDSketchMaxBins          = 2048
+)
+
+// DDSketch is a relative error quantile sketch (https://arxiv.org/abs/1908.10693).  Values are counted in logarithmic
+// buckets, so every quantile estimate is within RelativeAccuracy of a real value.  Sketches can be merged with Union.
+type DDSketch struct {
+	// RelativeAccuracy of quantile estimates.  Default is 0.01 (1%)
+	RelativeAccuracy float64
+	// MaxBins is the most buckets kept for positive values (and, separately, negative values).  Past this the buckets of
+	// the smallest magnitudes are collapsed together, losing accuracy only for the lowest quantiles.  Default is 2048
+	MaxBins int32
+	// ZeroCount is how many values were zero
+	ZeroCount uint64
+	// Positive buckets hold values above zero.  Bucket i holds values in (gamma^(i-1), gamma^i] where
+	// gamma = (1 + RelativeAccuracy) / (1 - RelativeAccuracy)
+	Positive ExponentialBuckets
+	// Negative buckets hold values below zero, indexed by their absolute value
+	Negative ExponentialBuckets
+}
+
+// Observe adds value to the sketch.  NaN and infinite values are ignored.
+func (d *DDSketch) Observe(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if value == 0 {
+		d.ZeroCount++
+		return
+	}
+	d.increment(value < 0, d.index(math.Abs(value)), 1)
+}
+
+// Count is the number of values in the sketch
+func (d *DDSketch) Count() uint64 {
+	if d == nil {
+		return 0
+	}
+	ret := d.ZeroCount
+	for _, c := range d.Positive.Counts {
+		ret += c
+	}
+	for _, c := range d.Negative.Counts {
+		ret += c
+	}
+	return ret
+}
+
+// Quantile estimates the value at quantile q (0 <= q <= 1).  Returns NaN for an empty sketch.
+func (d *DDSketch) Quantile(q float64) float64 {
+	count := d.Count()
+	if count == 0 || math.IsNaN(q) || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(count-1))
+	seen := uint64(0)
+	for i := len(d.Negative.Counts) - 1; i >= 0; i-- {
+		seen += d.Negative.Counts[i]
+		if seen > rank {
+			return -d.value(d.Negative.Offset + int32(i))
+		}
+	}
+	seen += d.ZeroCount
+	if seen > rank {
+		return 0
+	}
+	for i, c := range d.Positive.Counts {
+		seen += c
+		if seen > rank {
+			return d.value(d.Positive.Offset + int32(i))
+		}
+	}
+	return d.value(d.Positive.Offset + int32(len(d.Positive.Counts)) - 1)
+}
+
+// Copy returns a deep copy of this sketch
+func (d *DDSketch) Copy() *DDSketch {
+	if d == nil {
+		return nil
+	}
+	ret := *d
+	ret.Positive = d.Positive.downscaled(0)
+	ret.Negative = d.Negative.downscaled(0)
+	return &ret
+}
+
+// Union returns a new sketch holding the values of both.  If the sketches have a different RelativeAccuracy, the result
+// has the coarser of the two.  Neither sketch is modified.  A nil sketch is the identity.
+func (d *DDSketch) Union(other *DDSketch) *DDSketch {
+	if d == nil {
+		return other
+	}
+	if other == nil {
+		return d
+	}
+	ret := &DDSketch{
+		RelativeAccuracy: math.Max(d.relativeAccuracy(), other.relativeAccuracy()),
+		MaxBins:          d.maxBins(),
+		ZeroCount:        d.ZeroCount + other.ZeroCount,
+	}
+	if other.maxBins() > ret.MaxBins {
+		ret.MaxBins = other.maxBins()
+	}
+	ret.incrementAll(d)
+	ret.incrementAll(other)
+	return ret
+}
+
+// Buckets renders the sketch as generic buckets, ordered by Start.  Negative buckets are mirrored below zero and zero
+// values have a bucket of their own.
+func (d *DDSketch) Buckets() []Bucket {
+	if d == nil {
+		return nil
+	}
+	gamma := d.gamma()
+	ret := make([]Bucket, 0, len(d.Positive.Counts)+len(d.Negative.Counts)+1)
+	for i := len(d.Negative.Counts) - 1; i >= 0; i-- {
+		if c := d.Negative.Counts[i]; c > 0 {
+			upper := math.Pow(gamma, float64(d.Negative.Offset+int32(i)))
+			ret = append(ret, Bucket{
+				Count: int32(c),
+				Start: -upper,
+				End:   -upper / gamma,
+			})
+		}
+	}
+	if d.ZeroCount > 0 {
+		ret = append(ret, Bucket{
+			Count: int32(d.ZeroCount),
+		})
+	}
+	for i, c := range d.Positive.Counts {
+		if c > 0 {
+			upper := math.Pow(gamma, float64(d.Positive.Offset+int32(i)))
+			ret = append(ret, Bucket{
+				Count: int32(c),
+				Start: upper / gamma,
+				End:   upper,
+			})
+		}
+	}
+	return ret
+}
+
+func (d *DDSketch) relativeAccuracy() float64 {
+	if d.RelativeAccuracy <= 0 || d.RelativeAccuracy >= 1 {
+		return defaultDDSketchRelativeAccuracy
+	}
+	return d.RelativeAccuracy
+}
+
+func (d *DDSketch) maxBins() int32 {
+	if d.MaxBins <= 0 {
+		return defaultDDSketchMaxBins
+	}
+	return d.MaxBins
+}
+
+func (d *DDSketch) gamma() float64 {
+	return (1 + d.relativeAccuracy()) / (1 - d.relativeAccuracy())
+}
+
+// index of the bucket holding a positive value
+func (d *DDSketch) index(value float64) int32 {
+	return int32(math.Ceil(math.Log(value) / math.Log(d.gamma())))
+}
+
+// value is the estimate, within RelativeAccuracy, of every value in the bucket at index
+func (d *DDSketch) value(index int32) float64 {
+	gamma := d.gamma()
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+func (d *DDSketch) incrementAll(from *DDSketch) {
+	sameIndexes := from.relativeAccuracy() == d.relativeAccuracy()
+	for _, sign := range []struct {
+		negative bool
+		buckets  ExponentialBuckets
+	}{{false, from.Positive}, {true, from.Negative}} {
+		for i, c := range sign.buckets.Counts {
+			if c == 0 {
+				continue
+			}
+			index := sign.buckets.Offset + int32(i)
+			if !sameIndexes {
+				index = d.index(from.value(index))
+			}
+			d.increment(sign.negative, index, c)
+		}
+	}
+}
+
+func (d *DDSketch) increment(negative bool, index int32, count uint64) {
+	buckets := &d.Positive
+	if negative {
+		buckets = &d.Negative
+	}
+	buckets.addCollapsing(index, count, d.maxBins())
+}
+
+// addCollapsing adds count to the bucket at index, merging the lowest buckets together so there are at most maxBins
+func (b *ExponentialBuckets) addCollapsing(index int32, count uint64, maxBins int32) {
+	if len(b.Counts) > 0 {
+		high := b.Offset + int32(len(b.Counts)) - 1
+		if index > high {
+			high = index
+		}
+		lowest := high - maxBins + 1
+		if index < lowest {
+			index = lowest
+		}
+		b.collapseBelow(lowest)
+	}
+	b.add(index, count)
+}
+
+// collapseBelow moves the counts of every bucket below lowest into the bucket at lowest
+func (b *ExponentialBuckets) collapseBelow(lowest int32) {
+	if len(b.Counts) == 0 || b.Offset >= lowest {
+		return
+	}
+	cut := int(lowest - b.Offset)
+	if cut >= len(b.Counts) {
+		cut = len(b.Counts)
+	}
+	collapsed := uint64(0)
+	for _, c := range b.Counts[:cut] {
+		collapsed += c
+	}
+	counts := append([]uint64(nil), b.Counts[cut:]...)
+	if len(counts) == 0 {
+		counts = []uint64{0}
+	}
+	counts[0] += collapsed
+	b.Counts = counts
+	b.Offset = lowest
+}
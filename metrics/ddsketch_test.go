@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDDSketch_Quantile(t *testing.T) {
+	values := sortedValues(1, 100000)
+	d := &DDSketch{RelativeAccuracy: 0.01}
+	for _, v := range values {
+		d.Observe(v)
+	}
+	d.Observe(math.NaN())
+	d.Observe(math.Inf(-1))
+	if d.Count() != uint64(len(values)) {
+		t.Errorf("DDSketch.Count() = %d, want %d", d.Count(), len(values))
+	}
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.99, 0.999, 1} {
+		got, want := d.Quantile(q), exactQuantile(values, q)
+		if math.Abs(got-want) > 0.01*want {
+			t.Errorf("DDSketch.Quantile(%v) = %v, want %v within 1%%", q, got, want)
+		}
+	}
+	var empty *DDSketch
+	if !math.IsNaN(empty.Quantile(0.5)) || !math.IsNaN(d.Quantile(-1)) {
+		t.Errorf("DDSketch.Quantile() should be NaN for empty sketches or bad quantiles")
+	}
+}
+
+func TestDDSketch_negativeAndZero(t *testing.T) {
+	d := &DDSketch{}
+	for _, v := range []float64{-100, -10, 0, 0, 10, 100} {
+		d.Observe(v)
+	}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{q: 0, want: -100},
+		{q: 0.2, want: -10},
+		{q: 0.5, want: 0},
+		{q: 1, want: 100},
+	}
+	for _, tt := range tests {
+		if got := d.Quantile(tt.q); math.Abs(got-tt.want) > 0.01*math.Abs(tt.want) {
+			t.Errorf("DDSketch.Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	buckets := d.Buckets()
+	if len(buckets) != 5 {
+		t.Fatalf("DDSketch.Buckets() = %v, want 5 buckets", buckets)
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i-1].End > buckets[i].Start {
+			t.Fatalf("DDSketch.Buckets() out of order: %v then %v", buckets[i-1], buckets[i])
+		}
+	}
+}
+
+func TestDDSketch_MaxBins(t *testing.T) {
+	d := &DDSketch{MaxBins: 10}
+	for i := -20; i <= 20; i++ {
+		d.Observe(math.Pow(10, float64(i)))
+	}
+	if len(d.Positive.Counts) > 10 {
+		t.Errorf("DDSketch has %d bins, want at most 10", len(d.Positive.Counts))
+	}
+	if d.Count() != 41 {
+		t.Errorf("DDSketch.Count() = %d, want 41", d.Count())
+	}
+	// The highest quantiles keep their accuracy
+	if got := d.Quantile(1); math.Abs(got-1e20) > 1e18 {
+		t.Errorf("DDSketch.Quantile(1) = %v, want 1e20", got)
+	}
+}
+
+func TestDDSketch_Union(t *testing.T) {
+	values := sortedValues(4, 10000)
+	fine, coarse, together := &DDSketch{RelativeAccuracy: 0.01}, &DDSketch{RelativeAccuracy: 0.02}, &DDSketch{RelativeAccuracy: 0.02}
+	for i, v := range values {
+		if i%2 == 0 {
+			fine.Observe(v)
+		} else {
+			coarse.Observe(-v)
+		}
+	}
+	fineCopy := fine.Copy()
+	merged := fine.Union(coarse)
+	if merged.RelativeAccuracy != 0.02 {
+		t.Errorf("DDSketch.Union() accuracy = %v, want the coarser 0.02", merged.RelativeAccuracy)
+	}
+	if merged.Count() != uint64(len(values)) {
+		t.Errorf("DDSketch.Union() count = %d, want %d", merged.Count(), len(values))
+	}
+	if !equalBuckets(fine.Buckets(), fineCopy.Buckets()) {
+		t.Errorf("DDSketch.Union() modified its receiver")
+	}
+	same := coarse.Union(together)
+	if !equalBuckets(same.Buckets(), coarse.Buckets()) {
+		t.Errorf("DDSketch.Union() with an empty sketch = %v, want %v", same.Buckets(), coarse.Buckets())
+	}
+	// Re-indexed values may lose up to both accuracies
+	for _, q := range []float64{0.75, 0.99} {
+		got, want := merged.Quantile(q), exactQuantile(values, (q-0.5)*2)
+		if math.Abs(got-want) > 0.03*want {
+			t.Errorf("DDSketch.Union().Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+	var empty *DDSketch
+	if empty.Union(fine) != fine || fine.Union(nil) != fine {
+		t.Errorf("DDSketch.Union() nil should be the identity")
+	}
+}
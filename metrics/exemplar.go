@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const defaultExemplarReservoirSize = 2
+
+// Exemplar is an example of an observed value, linked to the trace that observed it.  Exemplars let you jump from a
+// spike in an aggregation to requests that caused it.
+type Exemplar struct {
+	Value   float64
+	Time    time.Time
+	TraceID string
+	SpanID  string
+	// Attributes are any other key/values captured with the value
+	Attributes map[string]string
+}
+
+// ExemplarObserver can record a value together with an exemplar of it
+type ExemplarObserver interface {
+	Observer
+	ObserveExemplar(value float64, exemplar Exemplar)
+}
+
+type exemplarContextKey struct{}
+
+// exemplarContext is what observations made with a context attach to their exemplars
+type exemplarContext struct {
+	traceID    string
+	spanID     string
+	attributes map[string]string
+}
+
+func exemplarFields(ctx context.Context) (exemplarContext, bool) {
+	ret, ok := ctx.Value(exemplarContextKey{}).(exemplarContext)
+	return ret, ok
+}
+
+// WithExemplarTrace returns a context whose observations, through ObserveContext, attach exemplars with this trace and
+// span
+func WithExemplarTrace(ctx context.Context, traceID string, spanID string) context.Context {
+	fields, _ := exemplarFields(ctx)
+	fields.traceID = traceID
+	fields.spanID = spanID
+	return context.WithValue(ctx, exemplarContextKey{}, fields)
+}
+
+// WithExemplarAttributes returns a context whose observations, through ObserveContext, attach exemplars with these
+// attributes, on top of any attributes ctx already has
+func WithExemplarAttributes(ctx context.Context, attributes map[string]string) context.Context {
+	fields, _ := exemplarFields(ctx)
+	merged := make(map[string]string, len(fields.attributes)+len(attributes))
+	for k, v := range fields.attributes {
+		merged[k] = v
+	}
+	for k, v := range attributes {
+		merged[k] = v
+	}
+	fields.attributes = merged
+	return context.WithValue(ctx, exemplarContextKey{}, fields)
+}
+
+// ExemplarFromContext returns an exemplar of value with whatever trace and attributes ctx has.  Returns false if ctx
+// has none.
+func ExemplarFromContext(ctx context.Context, value float64, now time.Time) (Exemplar, bool) {
+	fields, ok := exemplarFields(ctx)
+	if !ok {
+		return Exemplar{}, false
+	}
+	return Exemplar{
+		Value:      value,
+		Time:       now,
+		TraceID:    fields.traceID,
+		SpanID:     fields.spanID,
+		Attributes: fields.attributes,
+	}, true
+}
+
+// ObserveContext observes value with o.  If o is an ExemplarObserver and ctx has exemplar fields, the value is observed
+// with an exemplar.
+func ObserveContext(ctx context.Context, o Observer, value float64) {
+	if eo, ok := o.(ExemplarObserver); ok {
+		if exemplar, ok := ExemplarFromContext(ctx, value, time.Now()); ok {
+			eo.ObserveExemplar(value, exemplar)
+			return
+		}
+	}
+	o.Observe(value)
+}
+
+// ExemplarSampler keeps a bounded set of exemplars: the exemplar of the smallest value, of the largest value, and a
+// uniform random sample of the rest.  It is not thread safe.
+type ExemplarSampler struct {
+	// ReservoirSize is how many random exemplars are kept on top of the smallest and largest.  Default is 2
+	ReservoirSize int
+
+	min       Exemplar
+	max       Exemplar
+	reservoir []Exemplar
+	seen      int64
+}
+
+func (e *ExemplarSampler) reservoirSize() int {
+	if e.ReservoirSize <= 0 {
+		return defaultExemplarReservoirSize
+	}
+	return e.ReservoirSize
+}
+
+// Offer considers exemplar for the sample
+func (e *ExemplarSampler) Offer(exemplar Exemplar) {
+	if e.seen == 0 || exemplar.Value < e.min.Value {
+		e.min = exemplar
+	}
+	if e.seen == 0 || exemplar.Value > e.max.Value {
+		e.max = exemplar
+	}
+	// Reservoir sampling (algorithm R): every exemplar has the same chance to be kept
+	e.seen++
+	if len(e.reservoir) < e.reservoirSize() {
+		e.reservoir = append(e.reservoir, exemplar)
+		return
+	}
+	if idx := rand.Int63n(e.seen); idx < int64(len(e.reservoir)) {
+		e.reservoir[idx] = exemplar
+	}
+}
+
+// Exemplars returns the kept exemplars, ordered by time
+func (e *ExemplarSampler) Exemplars() []Exemplar {
+	if e.seen == 0 {
+		return nil
+	}
+	ret := make([]Exemplar, 0, len(e.reservoir)+2)
+	ret = append(ret, e.min, e.max)
+	ret = append(ret, e.reservoir...)
+	return sortedUniqueExemplars(ret)
+}
+
+// Reset forgets every exemplar
+func (e *ExemplarSampler) Reset() {
+	e.min = Exemplar{}
+	e.max = Exemplar{}
+	e.reservoir = e.reservoir[:0]
+	e.seen = 0
+}
+
+// mergeExemplars keeps the exemplars of the smallest and largest values, then the most recent, up to the size of the
+// larger set
+func mergeExemplars(a []Exemplar, b []Exemplar) []Exemplar {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	limit := len(a)
+	if len(b) > limit {
+		limit = len(b)
+	}
+	all := make([]Exemplar, 0, len(a)+len(b))
+	all = append(all, a...)
+	all = append(all, b...)
+	minIdx, maxIdx := 0, 0
+	for i, e := range all {
+		if e.Value < all[minIdx].Value {
+			minIdx = i
+		}
+		if e.Value > all[maxIdx].Value {
+			maxIdx = i
+		}
+	}
+	ret := make([]Exemplar, 0, limit)
+	ret = append(ret, all[minIdx], all[maxIdx])
+	rest := make([]Exemplar, 0, len(all))
+	for i, e := range all {
+		if i != minIdx && i != maxIdx {
+			rest = append(rest, e)
+		}
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].Time.After(rest[j].Time)
+	})
+	ret = sortedUniqueExemplars(ret)
+	for _, e := range rest {
+		if len(ret) >= limit {
+			break
+		}
+		if !containsExemplar(ret, e) {
+			ret = append(ret, e)
+		}
+	}
+	return sortedUniqueExemplars(ret)
+}
+
+// sortedUniqueExemplars removes exact duplicates and orders exemplars by time.  It reuses exemplars.
+func sortedUniqueExemplars(exemplars []Exemplar) []Exemplar {
+	ret := exemplars[:0]
+	for _, e := range exemplars {
+		if !containsExemplar(ret, e) {
+			ret = append(ret, e)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+	return ret
+}
+
+func containsExemplar(exemplars []Exemplar, e Exemplar) bool {
+	for _, existing := range exemplars {
+		if sameExemplar(existing, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameExemplar(a Exemplar, b Exemplar) bool {
+	if a.Value != b.Value || !a.Time.Equal(b.Time) || a.TraceID != b.TraceID || a.SpanID != b.SpanID ||
+		len(a.Attributes) != len(b.Attributes) {
+		return false
+	}
+	for k, v := range a.Attributes {
+		if bv, ok := b.Attributes[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
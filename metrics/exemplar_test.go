@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type exemplarRecorder struct {
+	values    []float64
+	exemplars []Exemplar
+}
+
+func (e *exemplarRecorder) Observe(value float64) {
+	e.values = append(e.values, value)
+}
+
+func (e *exemplarRecorder) ObserveExemplar(value float64, exemplar Exemplar) {
+	e.values = append(e.values, value)
+	e.exemplars = append(e.exemplars, exemplar)
+}
+
+func TestObserveContext(t *testing.T) {
+	var rec exemplarRecorder
+	ObserveContext(context.Background(), &rec, 1)
+	if len(rec.values) != 1 || len(rec.exemplars) != 0 {
+		t.Fatalf("ObserveContext() without exemplar fields = %v %v", rec.values, rec.exemplars)
+	}
+	ctx := WithExemplarTrace(context.Background(), "trace", "span")
+	ctx = WithExemplarAttributes(ctx, map[string]string{"user": "a"})
+	ctx = WithExemplarAttributes(ctx, map[string]string{"route": "/"})
+	ObserveContext(ctx, &rec, 2)
+	if len(rec.exemplars) != 1 {
+		t.Fatalf("ObserveContext() exemplars = %v", rec.exemplars)
+	}
+	e := rec.exemplars[0]
+	if e.Value != 2 || e.TraceID != "trace" || e.SpanID != "span" || len(e.Attributes) != 2 || e.Attributes["user"] != "a" {
+		t.Errorf("ObserveContext() exemplar = %v", e)
+	}
+	// Plain observers still see the value
+	var sum nopAggregator
+	ObserveContext(ctx, &sum, 3)
+}
+
+func TestExemplarSampler(t *testing.T) {
+	var s ExemplarSampler
+	if s.Exemplars() != nil {
+		t.Errorf("ExemplarSampler.Exemplars() of nothing should be nil")
+	}
+	start := time.Unix(0, 0)
+	for i := 0; i < 1000; i++ {
+		v := float64(i % 100)
+		if i == 500 {
+			v = -1
+		}
+		if i == 700 {
+			v = 1000
+		}
+		s.Offer(Exemplar{Value: v, Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	exemplars := s.Exemplars()
+	if len(exemplars) > 4 || len(exemplars) < 2 {
+		t.Fatalf("ExemplarSampler.Exemplars() = %v, want between 2 and 4", exemplars)
+	}
+	foundMin, foundMax := false, false
+	for i, e := range exemplars {
+		foundMin = foundMin || e.Value == -1
+		foundMax = foundMax || e.Value == 1000
+		if i > 0 && exemplars[i-1].Time.After(e.Time) {
+			t.Errorf("ExemplarSampler.Exemplars() out of order: %v", exemplars)
+		}
+	}
+	if !foundMin || !foundMax {
+		t.Errorf("ExemplarSampler.Exemplars() = %v, want the smallest and largest values", exemplars)
+	}
+	s.Reset()
+	if s.Exemplars() != nil {
+		t.Errorf("ExemplarSampler.Reset() kept exemplars")
+	}
+}
+
+func TestTimeWindowAggregation_Union_exemplars(t *testing.T) {
+	at := func(sec int64, value float64) Exemplar {
+		return Exemplar{Value: value, Time: time.Unix(sec, 0), TraceID: "t"}
+	}
+	a := TimeWindowAggregation{Exemplars: []Exemplar{at(1, 5), at(2, 100), at(3, 6)}}
+	b := TimeWindowAggregation{Exemplars: []Exemplar{at(4, -3), at(5, 7)}}
+	merged := a.Union(b).Exemplars
+	want := []Exemplar{at(2, 100), at(4, -3), at(5, 7)}
+	if len(merged) != len(want) {
+		t.Fatalf("TimeWindowAggregation.Union() exemplars = %v, want %v", merged, want)
+	}
+	for i := range want {
+		if !sameExemplar(merged[i], want[i]) {
+			t.Errorf("TimeWindowAggregation.Union() exemplars = %v, want %v", merged, want)
+		}
+	}
+	if got := a.Union(TimeWindowAggregation{}).Exemplars; len(got) != 3 {
+		t.Errorf("TimeWindowAggregation.Union() with no exemplars = %v", got)
+	}
+}
+
+type exemplarAggregator struct {
+	exemplarRecorder
+}
+
+func (e *exemplarAggregator) CollectMetrics() []TimeWindowAggregation {
+	return []TimeWindowAggregation{{Exemplars: e.exemplars}}
+}
+
+func TestRegistry_Observer_exemplars(t *testing.T) {
+	r := &Registry{
+		IdleTTL: time.Minute,
+		AggregationConstructor: func(ts *TimeSeries) Aggregator {
+			return &exemplarAggregator{}
+		},
+	}
+	ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "latency"}, nil)
+	ObserveContext(WithExemplarTrace(context.Background(), "trace", "span"), r.Observer(ts), 4)
+	flushed := r.FlushMetrics()
+	if len(flushed) != 1 || len(flushed[0].Aggregation.Exemplars) != 1 || flushed[0].Aggregation.Exemplars[0].Value != 4 {
+		t.Errorf("Registry.FlushMetrics() = %v, want the exemplar", flushed)
+	}
+}
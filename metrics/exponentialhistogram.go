@@ -0,0 +1,264 @@
+package metrics
+
+import (
+	"math"
+)
+
+const (
+	// defaultExponentialHistogramMaxSize matches the OpenTelemetry SDK default.  It is more than some backends take in
+	// one value (CloudWatch takes 150), so their sinks merge buckets to fit.
+	defaultExponentialHistogramMaxSize = 160
+	// minExponentialHistogramScale is the lowest scale OpenTelemetry allows.  At this scale every float64 fits in a few
+	// buckets.
+	minExponentialHistogramScale = -10
+)
+
+// ExponentialHistogram is a base 2 exponential histogram, as described by OpenTelemetry.  At a given Scale, the bucket
+// with index i holds values in (base^i, base^(i+1)] where base = 2^(2^-Scale).  Larger scales have finer buckets.
+// Histograms of different scales can be merged with Union.
+type ExponentialHistogram struct {
+	Scale int32
+	// ZeroCount is how many values were zero
+	ZeroCount uint64
+	// Positive buckets hold values above zero
+	Positive ExponentialBuckets
+	// Negative buckets hold values below zero, indexed by their absolute value
+	Negative ExponentialBuckets
+	// MaxSize is the most buckets Positive or Negative can hold.  Scale is reduced, merging neighboring buckets, to
+	// stay inside this size.  Default is 160, so a histogram of both signs can have up to 321 buckets.  Sinks with a
+	// lower limit merge buckets before sending them: cloudwatchmetrics sends at most 150 per datum.
+	MaxSize int32
+}
+
+// ExponentialBuckets is a dense range of exponential histogram buckets
+type ExponentialBuckets struct {
+	// Offset is the bucket index of Counts[0]
+	Offset int32
+	Counts []uint64
+}
+
+// Observe adds value to the histogram.  NaN and infinite values are ignored.
+func (h *ExponentialHistogram) Observe(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if value == 0 {
+		h.ZeroCount++
+		return
+	}
+	h.increment(value < 0, exponentialIndex(math.Abs(value), h.Scale), h.Scale, 1)
+}
+
+// Count is the total number of values in the histogram
+func (h *ExponentialHistogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	ret := h.ZeroCount
+	for _, c := range h.Positive.Counts {
+		ret += c
+	}
+	for _, c := range h.Negative.Counts {
+		ret += c
+	}
+	return ret
+}
+
+// Copy returns a deep copy of this histogram
+func (h *ExponentialHistogram) Copy() *ExponentialHistogram {
+	if h == nil {
+		return nil
+	}
+	ret := *h
+	ret.Positive = h.Positive.downscaled(0)
+	ret.Negative = h.Negative.downscaled(0)
+	return &ret
+}
+
+// Union merges two histograms into a new one, at the highest scale that can hold both inside MaxSize.  Neither histogram
+// is modified.  A nil histogram is the identity.
+func (h *ExponentialHistogram) Union(other *ExponentialHistogram) *ExponentialHistogram {
+	if h == nil {
+		return other
+	}
+	if other == nil {
+		return h
+	}
+	scale := h.Scale
+	if other.Scale < scale {
+		scale = other.Scale
+	}
+	maxSize := h.maxSize()
+	if other.maxSize() > maxSize {
+		maxSize = other.maxSize()
+	}
+	ret := &ExponentialHistogram{
+		Scale:     scale,
+		ZeroCount: h.ZeroCount + other.ZeroCount,
+		Positive:  h.Positive.downscaled(h.Scale - scale),
+		Negative:  h.Negative.downscaled(h.Scale - scale),
+		MaxSize:   maxSize,
+	}
+	ret.incrementAll(false, other.Positive, other.Scale)
+	ret.incrementAll(true, other.Negative, other.Scale)
+	return ret
+}
+
+// Buckets returns the histogram as generic buckets, ordered by Start.  Negative buckets are mirrored below zero and
+// zero values have a bucket of their own.
+func (h *ExponentialHistogram) Buckets() []Bucket {
+	if h == nil {
+		return nil
+	}
+	ret := make([]Bucket, 0, len(h.Positive.Counts)+len(h.Negative.Counts)+1)
+	for i := len(h.Negative.Counts) - 1; i >= 0; i-- {
+		if c := h.Negative.Counts[i]; c > 0 {
+			idx := h.Negative.Offset + int32(i)
+			ret = append(ret, Bucket{
+				Count: int32(c),
+				Start: -h.LowerBoundary(idx + 1),
+				End:   -h.LowerBoundary(idx),
+			})
+		}
+	}
+	if h.ZeroCount > 0 {
+		ret = append(ret, Bucket{
+			Count: int32(h.ZeroCount),
+		})
+	}
+	for i, c := range h.Positive.Counts {
+		if c > 0 {
+			idx := h.Positive.Offset + int32(i)
+			ret = append(ret, Bucket{
+				Count: int32(c),
+				Start: h.LowerBoundary(idx),
+				End:   h.LowerBoundary(idx + 1),
+			})
+		}
+	}
+	return ret
+}
+
+// LowerBoundary is the exclusive lower boundary of the bucket at index
+func (h *ExponentialHistogram) LowerBoundary(index int32) float64 {
+	return math.Exp2(math.Ldexp(float64(index), -int(h.Scale)))
+}
+
+func (h *ExponentialHistogram) maxSize() int32 {
+	if h.MaxSize <= 0 {
+		return defaultExponentialHistogramMaxSize
+	}
+	return h.MaxSize
+}
+
+func (h *ExponentialHistogram) incrementAll(negative bool, from ExponentialBuckets, scale int32) {
+	for i, c := range from.Counts {
+		if c > 0 {
+			h.increment(negative, from.Offset+int32(i), scale, c)
+		}
+	}
+}
+
+// increment adds count to the bucket at index, where index is at scale (which must be >= h.Scale).  Reduces h.Scale if
+// the bucket does not fit inside MaxSize.
+func (h *ExponentialHistogram) increment(negative bool, index int32, scale int32, count uint64) {
+	index >>= uint(scale - h.Scale)
+	buckets := &h.Positive
+	if negative {
+		buckets = &h.Negative
+	}
+	change := buckets.scaleChange(index, h.maxSize())
+	if h.Scale-change < minExponentialHistogramScale {
+		change = h.Scale - minExponentialHistogramScale
+	}
+	if change > 0 {
+		// Both signs always share a scale
+		h.Scale -= change
+		h.Positive = h.Positive.downscaled(change)
+		h.Negative = h.Negative.downscaled(change)
+		index >>= uint(change)
+	}
+	buckets.add(index, count)
+}
+
+// scaleChange is how much the scale must be reduced so these buckets, plus index, fit inside maxSize
+func (b *ExponentialBuckets) scaleChange(index int32, maxSize int32) int32 {
+	if len(b.Counts) == 0 {
+		return 0
+	}
+	low, high := b.Offset, b.Offset+int32(len(b.Counts))-1
+	if index < low {
+		low = index
+	}
+	if index > high {
+		high = index
+	}
+	change := int32(0)
+	for high-low+1 > maxSize {
+		high >>= 1
+		low >>= 1
+		change++
+	}
+	return change
+}
+
+// downscaled returns a copy of these buckets, reduced by change scales.  Every reduction merges pairs of buckets.
+func (b *ExponentialBuckets) downscaled(change int32) ExponentialBuckets {
+	if len(b.Counts) == 0 {
+		return ExponentialBuckets{}
+	}
+	offset := b.Offset >> uint(change)
+	size := ((b.Offset + int32(len(b.Counts)) - 1) >> uint(change)) - offset + 1
+	counts := make([]uint64, size)
+	for i, c := range b.Counts {
+		counts[((b.Offset+int32(i))>>uint(change))-offset] += c
+	}
+	return ExponentialBuckets{
+		Offset: offset,
+		Counts: counts,
+	}
+}
+
+// add count to the bucket at index, growing Counts as needed
+func (b *ExponentialBuckets) add(index int32, count uint64) {
+	if len(b.Counts) == 0 {
+		b.Offset = index
+		b.Counts = []uint64{count}
+		return
+	}
+	if index < b.Offset {
+		grown := make([]uint64, int(b.Offset-index)+len(b.Counts))
+		copy(grown[b.Offset-index:], b.Counts)
+		b.Counts = grown
+		b.Offset = index
+	}
+	if end := b.Offset + int32(len(b.Counts)); index >= end {
+		b.Counts = append(b.Counts, make([]uint64, index-end+1)...)
+	}
+	b.Counts[index-b.Offset] += count
+}
+
+// exponentialIndex is the bucket index of a positive value at scale
+func exponentialIndex(value float64, scale int32) int32 {
+	// value == frac * 2^exp with frac in [0.5, 1)
+	frac, exp := math.Frexp(value)
+	if scale <= 0 {
+		// Exact powers of two are the upper (inclusive) boundary of the bucket below them
+		index := int32(exp - 1)
+		if frac == 0.5 {
+			index--
+		}
+		return index >> uint(-scale)
+	}
+	if frac == 0.5 {
+		return (int32(exp-1) << uint(scale)) - 1
+	}
+	index := int32(math.Ceil(math.Ldexp(math.Log2(value), int(scale)))) - 1
+	// Log2 can be off by a tiny bit near boundaries.  Check against the real boundaries.
+	if lower := math.Exp2(math.Ldexp(float64(index), -int(scale))); value <= lower {
+		index--
+	} else if upper := math.Exp2(math.Ldexp(float64(index+1), -int(scale))); value > upper {
+		index++
+	}
+	return index
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func Test_exponentialIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		scale int32
+		want  int32
+	}{
+		{name: "one is the top of bucket -1", value: 1, scale: 0, want: -1},
+		{name: "just above one", value: 1.0000001, scale: 0, want: 0},
+		{name: "two", value: 2, scale: 0, want: 0},
+		{name: "three", value: 3, scale: 0, want: 1},
+		{name: "four", value: 4, scale: 0, want: 1},
+		{name: "half", value: 0.5, scale: 0, want: -2},
+		{name: "negative scale", value: 1000, scale: -2, want: 2},
+		{name: "positive scale", value: 3, scale: 1, want: 3},
+		{name: "positive scale power of two", value: 4, scale: 3, want: 15},
+		{name: "positive scale boundary", value: math.Exp2(0.5), scale: 1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exponentialIndex(tt.value, tt.scale); got != tt.want {
+				t.Errorf("exponentialIndex() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExponentialHistogram_Observe(t *testing.T) {
+	h := &ExponentialHistogram{Scale: 20, MaxSize: 20}
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		v := math.Exp(r.Float64()*20 - 10)
+		if i%4 == 0 {
+			v = -v
+		}
+		if i%100 == 0 {
+			v = 0
+		}
+		values = append(values, v)
+		h.Observe(v)
+	}
+	h.Observe(math.NaN())
+	h.Observe(math.Inf(1))
+	if h.Count() != 1000 {
+		t.Errorf("ExponentialHistogram.Count() = %d, want 1000", h.Count())
+	}
+	if h.ZeroCount != 10 {
+		t.Errorf("ExponentialHistogram.ZeroCount = %d, want 10", h.ZeroCount)
+	}
+	if len(h.Positive.Counts) > 20 || len(h.Negative.Counts) > 20 {
+		t.Errorf("ExponentialHistogram buckets %d/%d larger than MaxSize", len(h.Positive.Counts), len(h.Negative.Counts))
+	}
+	if h.Scale >= 20 {
+		t.Errorf("ExponentialHistogram.Scale = %d, should have been reduced", h.Scale)
+	}
+	// Every value must land in a bucket that contains it
+	buckets := h.Buckets()
+	for _, v := range values {
+		found := false
+		for _, b := range buckets {
+			if (v == 0 && b.Start == 0 && b.End == 0) || (v > 0 && b.Start < v && v <= b.End) || (v < 0 && b.Start <= v && v < b.End) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("ExponentialHistogram.Buckets() has no bucket for %v", v)
+		}
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i-1].End > buckets[i].Start {
+			t.Fatalf("ExponentialHistogram.Buckets() out of order: %v then %v", buckets[i-1], buckets[i])
+		}
+	}
+}
+
+func TestExponentialHistogram_Union(t *testing.T) {
+	fine := &ExponentialHistogram{Scale: 10, MaxSize: 4}
+	coarse := &ExponentialHistogram{Scale: 10, MaxSize: 4}
+	together := &ExponentialHistogram{Scale: 10, MaxSize: 4}
+	for i := 1; i < 100; i++ {
+		fine.Observe(float64(i) / 10)
+		together.Observe(float64(i) / 10)
+	}
+	for i := 1; i < 100; i++ {
+		coarse.Observe(float64(i) * 100)
+		coarse.Observe(-float64(i))
+		together.Observe(float64(i) * 100)
+		together.Observe(-float64(i))
+	}
+	if fine.Scale <= coarse.Scale {
+		t.Fatalf("test setup should have different scales: %d %d", fine.Scale, coarse.Scale)
+	}
+	fineCopy := fine.Copy()
+	merged := fine.Union(coarse)
+	reversed := coarse.Union(fine)
+	if merged.Count() != fine.Count()+coarse.Count() {
+		t.Errorf("ExponentialHistogram.Union() count = %d, want %d", merged.Count(), fine.Count()+coarse.Count())
+	}
+	if merged.Scale != together.Scale || reversed.Scale != together.Scale {
+		t.Errorf("ExponentialHistogram.Union() scale = %d/%d, want %d", merged.Scale, reversed.Scale, together.Scale)
+	}
+	if !equalBuckets(merged.Buckets(), together.Buckets()) || !equalBuckets(reversed.Buckets(), together.Buckets()) {
+		t.Errorf("ExponentialHistogram.Union() = %v, want %v", merged.Buckets(), together.Buckets())
+	}
+	if !equalBuckets(fine.Buckets(), fineCopy.Buckets()) || fine.Scale != fineCopy.Scale {
+		t.Errorf("ExponentialHistogram.Union() modified its receiver")
+	}
+	var empty *ExponentialHistogram
+	if empty.Union(fine) != fine || fine.Union(nil) != fine {
+		t.Errorf("ExponentialHistogram.Union() nil should be the identity")
+	}
+}
+
+func TestValueAggregation_Union_exponentialHistogram(t *testing.T) {
+	a := ValueAggregation{SampleCount: 1, Sum: 1, Minimum: 1, Maximum: 1, ExponentialHistogram: &ExponentialHistogram{Scale: 3}}
+	a.ExponentialHistogram.Observe(1)
+	b := ValueAggregation{SampleCount: 1, Sum: 8, Minimum: 8, Maximum: 8, ExponentialHistogram: &ExponentialHistogram{Scale: 1}}
+	b.ExponentialHistogram.Observe(8)
+	merged := a.Union(b)
+	if merged.ExponentialHistogram.Count() != 2 || merged.ExponentialHistogram.Scale != 1 {
+		t.Errorf("ValueAggregation.Union() histogram = %v", merged.ExponentialHistogram)
+	}
+	if q := merged.Quantile(0.75); q <= 4 || q > 8 {
+		t.Errorf("ValueAggregation.Quantile() = %v, want inside the bucket of 8", q)
+	}
+}
+
+func equalBuckets(a, b []Bucket) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package metricsext
 
 import (
+	"context"
 	"time"
 
 	"github.com/cep21/gometrics/metrics"
@@ -8,6 +9,9 @@ import (
 
 // DurationObserver wraps an observer to allow reporting durations, rather than flat float64 objects
 type DurationObserver struct {
+	// Now is the clock used by Start and Time.  Default is time.Now
+	Now func() time.Time
+
 	observer metrics.Observer
 }
 
@@ -16,14 +20,18 @@ func (t *DurationObserver) Observe(d time.Duration) {
 	t.observer.Observe(d.Seconds())
 }
 
+// ObserveContext reports the duration as a Second time value, with an exemplar if ctx has one (see
+// metrics.ObserveContext)
+func (t *DurationObserver) ObserveContext(ctx context.Context, d time.Duration) {
+	metrics.ObserveContext(ctx, t.observer, d.Seconds())
+}
+
 // Duration is similar to Float, but attaches metadata of the unit "seconds" to time series
 func Duration(a metrics.BaseRegistry, metricName string, dimensions map[string]string) *DurationObserver {
 	ts := a.TimeSeries(metrics.TimeSeriesIdentifier{
 		MetricName: metricName,
 		Dimensions: dimensions,
-	}, func(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
-		return tsmd.WithValue(metrics.MetaDataUnit, "Seconds")
-	})
+	}, secondsMetadata)
 	obs := a.Observer(ts)
 	return &DurationObserver{
 		observer: obs,
@@ -35,9 +43,7 @@ func Counter(a metrics.BaseRegistry, metricName string, dimensions map[string]st
 	ts := a.TimeSeries(metrics.TimeSeriesIdentifier{
 		MetricName: metricName,
 		Dimensions: dimensions,
-	}, func(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
-		return tsmd.WithValue(metrics.MetaDataTimeSeriesType, metrics.TSTypeCounter)
-	})
+	}, counterMetadata)
 	return a.Observer(ts)
 }
 
@@ -46,9 +52,7 @@ func Gauge(a metrics.BaseRegistry, metricName string, dimensions map[string]stri
 	ts := a.TimeSeries(metrics.TimeSeriesIdentifier{
 		MetricName: metricName,
 		Dimensions: dimensions,
-	}, func(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
-		return tsmd.WithValue(metrics.MetaDataTimeSeriesType, metrics.TSTypeGauge)
-	})
+	}, gaugeMetadata)
 	return a.Observer(ts)
 }
 
@@ -61,28 +65,46 @@ func Float(a metrics.BaseRegistry, metricName string, dimensions map[string]stri
 	return a.Observer(ts)
 }
 
-// WithDimensions wraps a registry with a registry that adds default dimensions to created time series
+func secondsMetadata(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+	return tsmd.WithValue(metrics.MetaDataUnit, "Seconds")
+}
+
+func bytesMetadata(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+	return tsmd.WithValue(metrics.MetaDataUnit, "Bytes")
+}
+
+func counterMetadata(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+	return tsmd.WithValue(metrics.MetaDataTimeSeriesType, metrics.TSTypeCounter)
+}
+
+func gaugeMetadata(_ metrics.TimeSeriesIdentifier, tsmd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+	return tsmd.WithValue(metrics.MetaDataTimeSeriesType, metrics.TSTypeGauge)
+}
+
+// WithDimensions wraps a registry with a registry that adds default dimensions to created time series.  If a is a
+// metrics.CallbackRegistry, so is the returned registry.
 func WithDimensions(a metrics.BaseRegistry, dimensions map[string]string) metrics.BaseRegistry {
-	if asW, ok := a.(*wrappedRegistry); ok {
-		return &wrappedRegistry{
+	if asW, ok := unwrapRegistry(a); ok {
+		return (&wrappedRegistry{
 			BaseRegistry: asW.BaseRegistry,
 			dimensions:   mergeMapsFast(dimensions, asW.dimensions),
 			metadata:     asW.metadata,
-		}
+		}).withCallbacks()
 	}
-	return &wrappedRegistry{
+	return (&wrappedRegistry{
 		BaseRegistry: a,
 		dimensions:   dimensions,
-	}
+	}).withCallbacks()
 }
 
-// WithMetadata wraps a registry with a metadata constructor for all time series
+// WithMetadata wraps a registry with a metadata constructor for all time series.  If a is a metrics.CallbackRegistry,
+// so is the returned registry.
 func WithMetadata(a metrics.BaseRegistry, metadata metrics.MetadataConstructor) metrics.BaseRegistry {
 	if metadata == nil {
 		return a
 	}
-	if asW, ok := a.(*wrappedRegistry); ok {
-		return &wrappedRegistry{
+	if asW, ok := unwrapRegistry(a); ok {
+		return (&wrappedRegistry{
 			BaseRegistry: asW.BaseRegistry,
 			dimensions:   asW.dimensions,
 			metadata: func(tsi metrics.TimeSeriesIdentifier, mtd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
@@ -91,12 +113,23 @@ func WithMetadata(a metrics.BaseRegistry, metadata metrics.MetadataConstructor)
 				}
 				return asW.metadata(tsi, metadata(tsi, mtd))
 			},
-		}
+		}).withCallbacks()
 	}
-	return &wrappedRegistry{
+	return (&wrappedRegistry{
 		BaseRegistry: a,
 		metadata:     metadata,
+	}).withCallbacks()
+}
+
+// unwrapRegistry returns the wrappedRegistry of a registry made by WithDimensions or WithMetadata
+func unwrapRegistry(a metrics.BaseRegistry) (*wrappedRegistry, bool) {
+	switch w := a.(type) {
+	case *wrappedRegistry:
+		return w, true
+	case *wrappedCallbackRegistry:
+		return w.wrappedRegistry, true
 	}
+	return nil, false
 }
 
 type wrappedRegistry struct {
@@ -122,6 +155,39 @@ func (u *wrappedRegistry) TimeSeries(tsi metrics.TimeSeriesIdentifier, metadata
 	})
 }
 
+// withCallbacks returns u as a metrics.CallbackRegistry if the registry it wraps is one
+func (u *wrappedRegistry) withCallbacks() metrics.BaseRegistry {
+	if _, ok := u.BaseRegistry.(metrics.CallbackRegistry); ok {
+		return &wrappedCallbackRegistry{wrappedRegistry: u}
+	}
+	return u
+}
+
+// wrappedCallbackRegistry is a wrappedRegistry around a metrics.CallbackRegistry
+type wrappedCallbackRegistry struct {
+	*wrappedRegistry
+}
+
+var _ metrics.CallbackRegistry = &wrappedCallbackRegistry{}
+
+// RegisterCallback registers f with the wrapped registry, adding this registry's dimensions and metadata to what f
+// reports
+func (u *wrappedCallbackRegistry) RegisterCallback(metricName string, tsType metrics.TimeSeriesType, metadata metrics.MetadataConstructor, f metrics.CallbackFunc) (unregister func()) {
+	return u.BaseRegistry.(metrics.CallbackRegistry).RegisterCallback(metricName, tsType, func(tsi metrics.TimeSeriesIdentifier, mtd metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+		if metadata != nil {
+			mtd = metadata(tsi, mtd)
+		}
+		if u.metadata != nil {
+			mtd = u.metadata(tsi, mtd)
+		}
+		return mtd
+	}, func(report func(map[string]string, float64)) {
+		f(func(dimensions map[string]string, value float64) {
+			report(mergeMapsFast(u.dimensions, dimensions), value)
+		})
+	})
+}
+
 // SingleValue helps create a TimeWindowAggregation of a single value at the current timestamp
 func SingleValue(value float64) metrics.TimeWindowAggregation {
 	va := LocklessValueAggregator{}
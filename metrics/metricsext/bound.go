@@ -0,0 +1,304 @@
+package metricsext
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// Bound instruments resolve their time series and observer once, when they are created, then observe directly.  Use
+// them on hot code paths instead of calling Counter, Gauge, Float or Duration for every value.
+//
+// Note: If the registry evicts idle time series (see metrics.Registry.IdleTTL), the next value a bound instrument
+// observes puts its time series back.  Vectors resolve instruments of evicted time series again, and drop them from
+// their cache, so the cache does not outgrow the registry.
+
+// bound is a time series and the observer for it
+type bound struct {
+	ts       *metrics.TimeSeries
+	observer metrics.Observer
+}
+
+func newBound(a metrics.BaseRegistry, metricName string, dimensions map[string]string, metadata metrics.MetadataConstructor) bound {
+	ts := a.TimeSeries(metrics.TimeSeriesIdentifier{
+		MetricName: metricName,
+		Dimensions: dimensions,
+	}, metadata)
+	return bound{
+		ts:       ts,
+		observer: a.Observer(ts),
+	}
+}
+
+// TimeSeries returns the time series this instrument reports to
+func (b *bound) TimeSeries() *metrics.TimeSeries {
+	return b.ts
+}
+
+// BoundCounter is a counter bound to a single time series
+type BoundCounter struct {
+	bound
+}
+
+// NewBoundCounter creates a counter with the same metadata as Counter
+func NewBoundCounter(a metrics.BaseRegistry, metricName string, dimensions map[string]string) *BoundCounter {
+	return &BoundCounter{bound: newBound(a, metricName, dimensions, counterMetadata)}
+}
+
+// Inc adds one to the counter
+func (c *BoundCounter) Inc() {
+	c.observer.Observe(1)
+}
+
+// Add adds delta to the counter
+func (c *BoundCounter) Add(delta float64) {
+	c.observer.Observe(delta)
+}
+
+// BoundGauge is a gauge bound to a single time series
+type BoundGauge struct {
+	bound
+}
+
+// NewBoundGauge creates a gauge with the same metadata as Gauge
+func NewBoundGauge(a metrics.BaseRegistry, metricName string, dimensions map[string]string) *BoundGauge {
+	return &BoundGauge{bound: newBound(a, metricName, dimensions, gaugeMetadata)}
+}
+
+// Set reports the current value of the gauge
+func (g *BoundGauge) Set(value float64) {
+	g.observer.Observe(value)
+}
+
+// BoundHistogram records a distribution of values for a single time series
+type BoundHistogram struct {
+	bound
+}
+
+// NewBoundHistogram creates a histogram with the same metadata as Float
+func NewBoundHistogram(a metrics.BaseRegistry, metricName string, dimensions map[string]string) *BoundHistogram {
+	return &BoundHistogram{bound: newBound(a, metricName, dimensions, nil)}
+}
+
+// Observe records a value
+func (h *BoundHistogram) Observe(value float64) {
+	h.observer.Observe(value)
+}
+
+// ObserveContext records a value, with an exemplar if ctx has one (see metrics.ObserveContext)
+func (h *BoundHistogram) ObserveContext(ctx context.Context, value float64) {
+	metrics.ObserveContext(ctx, h.observer, value)
+}
+
+// BoundDuration records a distribution of durations, in seconds, for a single time series
+type BoundDuration struct {
+	bound
+}
+
+// NewBoundDuration creates a duration with the same metadata as Duration
+func NewBoundDuration(a metrics.BaseRegistry, metricName string, dimensions map[string]string) *BoundDuration {
+	return &BoundDuration{bound: newBound(a, metricName, dimensions, secondsMetadata)}
+}
+
+// Observe records a duration as seconds
+func (d *BoundDuration) Observe(duration time.Duration) {
+	d.observer.Observe(duration.Seconds())
+}
+
+// ObserveContext records a duration as seconds, with an exemplar if ctx has one (see metrics.ObserveContext)
+func (d *BoundDuration) ObserveContext(ctx context.Context, duration time.Duration) {
+	metrics.ObserveContext(ctx, d.observer, duration.Seconds())
+}
+
+// vec caches bound instruments of a single metric by their dimension values
+type vec struct {
+	registry       metrics.BaseRegistry
+	metricName     string
+	dimensionNames []string
+	metadata       metrics.MetadataConstructor
+	// create turns a bound time series into the vector's instrument type
+	create func(b bound) interface{}
+
+	mu    sync.RWMutex
+	cache map[string]vecEntry
+	// sweepAt is the size of cache at which instruments of evicted time series are dropped from it
+	sweepAt int
+}
+
+// vecEntry is a cached instrument and the observer it was bound to
+type vecEntry struct {
+	instrument interface{}
+	observer   metrics.Observer
+}
+
+// busyInstrument is implemented by instruments with state that would be lost if they were resolved again, like in
+// flight gauges that are still counting
+type busyInstrument interface {
+	busy() bool
+}
+
+// evicted returns true if the time series of an entry was evicted from the registry, so it should be resolved again.
+// Busy instruments are kept: the next value they observe puts their time series back.
+func (e vecEntry) evicted() bool {
+	eo, ok := e.observer.(metrics.EvictableObserver)
+	if !ok || !eo.Evicted() {
+		return false
+	}
+	if b, ok := e.instrument.(busyInstrument); ok && b.busy() {
+		return false
+	}
+	return true
+}
+
+func newVec(a metrics.BaseRegistry, metricName string, dimensionNames []string, metadata metrics.MetadataConstructor, create func(b bound) interface{}) vec {
+	return vec{
+		registry:       a,
+		metricName:     metricName,
+		dimensionNames: append([]string(nil), dimensionNames...),
+		metadata:       metadata,
+		create:         create,
+	}
+}
+
+// with returns the instrument for values, which must line up with dimensionNames
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.dimensionNames) {
+		panic(fmt.Sprintf("metric %s expects %d dimension values, got %d", v.metricName, len(v.dimensionNames), len(values)))
+	}
+	// Building the key on the stack and converting it inside the map index does not allocate
+	var buf [128]byte
+	key := buf[:0]
+	for _, val := range values {
+		key = appendVecKey(key, val)
+	}
+	v.mu.RLock()
+	entry, exists := v.cache[string(key)]
+	v.mu.RUnlock()
+	if exists && !entry.evicted() {
+		return entry.instrument
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if entry, exists := v.cache[string(key)]; exists && !entry.evicted() {
+		return entry.instrument
+	}
+	if len(v.cache) >= v.sweepAt {
+		v.sweep()
+	}
+	dimensions := make(map[string]string, len(values))
+	for i, name := range v.dimensionNames {
+		dimensions[name] = values[i]
+	}
+	b := newBound(v.registry, v.metricName, dimensions, v.metadata)
+	entry = vecEntry{
+		instrument: v.create(b),
+		observer:   b.observer,
+	}
+	if v.cache == nil {
+		v.cache = make(map[string]vecEntry)
+	}
+	v.cache[string(key)] = entry
+	return entry.instrument
+}
+
+// appendVecKey appends value to a vector's cache key.  Each value is prefixed with its length (as a uvarint), so values
+// holding any byte cannot run into each other.
+func appendVecKey(key []byte, value string) []byte {
+	n := uint64(len(value))
+	for n >= 0x80 {
+		key = append(key, byte(n)|0x80)
+		n >>= 7
+	}
+	key = append(key, byte(n))
+	return append(key, value...)
+}
+
+// sweep drops instruments of evicted time series from the cache.  It runs when the cache doubles in size, so adding to
+// the cache stays cheap.  Must be called while holding the write lock.
+func (v *vec) sweep() {
+	for key, entry := range v.cache {
+		if entry.evicted() {
+			delete(v.cache, key)
+		}
+	}
+	v.sweepAt = len(v.cache) * 2
+	if v.sweepAt < 64 {
+		v.sweepAt = 64
+	}
+}
+
+// CounterVec creates counters of a single metric that differ only by the values of a fixed list of dimensions
+type CounterVec struct {
+	vec vec
+}
+
+// NewCounterVec creates a CounterVec.  Values passed to WithValues are matched, in order, to dimensionNames.
+func NewCounterVec(a metrics.BaseRegistry, metricName string, dimensionNames []string) *CounterVec {
+	return &CounterVec{vec: newVec(a, metricName, dimensionNames, counterMetadata, func(b bound) interface{} {
+		return &BoundCounter{bound: b}
+	})}
+}
+
+// WithValues returns the counter for these dimension values.  Panics if the number of values does not match the number
+// of dimension names.
+func (c *CounterVec) WithValues(values ...string) *BoundCounter {
+	return c.vec.with(values).(*BoundCounter)
+}
+
+// GaugeVec creates gauges of a single metric that differ only by the values of a fixed list of dimensions
+type GaugeVec struct {
+	vec vec
+}
+
+// NewGaugeVec creates a GaugeVec.  Values passed to WithValues are matched, in order, to dimensionNames.
+func NewGaugeVec(a metrics.BaseRegistry, metricName string, dimensionNames []string) *GaugeVec {
+	return &GaugeVec{vec: newVec(a, metricName, dimensionNames, gaugeMetadata, func(b bound) interface{} {
+		return &BoundGauge{bound: b}
+	})}
+}
+
+// WithValues returns the gauge for these dimension values.  Panics if the number of values does not match the number
+// of dimension names.
+func (g *GaugeVec) WithValues(values ...string) *BoundGauge {
+	return g.vec.with(values).(*BoundGauge)
+}
+
+// HistogramVec creates histograms of a single metric that differ only by the values of a fixed list of dimensions
+type HistogramVec struct {
+	vec vec
+}
+
+// NewHistogramVec creates a HistogramVec.  Values passed to WithValues are matched, in order, to dimensionNames.
+func NewHistogramVec(a metrics.BaseRegistry, metricName string, dimensionNames []string) *HistogramVec {
+	return &HistogramVec{vec: newVec(a, metricName, dimensionNames, nil, func(b bound) interface{} {
+		return &BoundHistogram{bound: b}
+	})}
+}
+
+// WithValues returns the histogram for these dimension values.  Panics if the number of values does not match the
+// number of dimension names.
+func (h *HistogramVec) WithValues(values ...string) *BoundHistogram {
+	return h.vec.with(values).(*BoundHistogram)
+}
+
+// DurationVec creates durations of a single metric that differ only by the values of a fixed list of dimensions
+type DurationVec struct {
+	vec vec
+}
+
+// NewDurationVec creates a DurationVec.  Values passed to WithValues are matched, in order, to dimensionNames.
+func NewDurationVec(a metrics.BaseRegistry, metricName string, dimensionNames []string) *DurationVec {
+	return &DurationVec{vec: newVec(a, metricName, dimensionNames, secondsMetadata, func(b bound) interface{} {
+		return &BoundDuration{bound: b}
+	})}
+}
+
+// WithValues returns the duration for these dimension values.  Panics if the number of values does not match the
+// number of dimension names.
+func (d *DurationVec) WithValues(values ...string) *BoundDuration {
+	return d.vec.with(values).(*BoundDuration)
+}
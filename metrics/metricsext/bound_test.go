@@ -0,0 +1,239 @@
+package metricsext
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func drainingRegistry() *metrics.Registry {
+	now := time.Now()
+	return &metrics.Registry{
+		AggregationConstructor: func(ts *metrics.TimeSeries) metrics.Aggregator {
+			return &RollingAggregation{
+				Now: func() time.Time {
+					return now
+				},
+			}
+		},
+	}
+}
+
+func drain(t *testing.T, reg *metrics.Registry, ts *metrics.TimeSeries) metrics.ValueAggregation {
+	aggs := reg.GetOrSet(ts, nil).(*RollingAggregation).DrainMetrics()
+	require.Len(t, aggs, 1)
+	return aggs[0].Va
+}
+
+func TestBoundInstruments(t *testing.T) {
+	reg := drainingRegistry()
+	c := NewBoundCounter(reg, "count", map[string]string{"a": "b"})
+	c.Inc()
+	c.Add(2)
+	require.Equal(t, metrics.TSTypeCounter, c.TimeSeries().Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.EqualValues(t, 3, drain(t, reg, c.TimeSeries()).Sum)
+
+	g := NewBoundGauge(reg, "gauge", nil)
+	g.Set(5)
+	require.Equal(t, metrics.TSTypeGauge, g.TimeSeries().Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.EqualValues(t, 5, drain(t, reg, g.TimeSeries()).LastValue)
+
+	h := NewBoundHistogram(reg, "histogram", nil)
+	h.Observe(1)
+	h.Observe(3)
+	require.EqualValues(t, 2, drain(t, reg, h.TimeSeries()).SampleCount)
+
+	d := NewBoundDuration(reg, "duration", nil)
+	d.Observe(time.Millisecond * 1500)
+	require.Equal(t, "Seconds", d.TimeSeries().Tsm.Value(metrics.MetaDataUnit))
+	require.EqualValues(t, 1.5, drain(t, reg, d.TimeSeries()).Sum)
+
+	// Bound instruments share time series with the unbound helpers
+	require.Equal(t, c.TimeSeries(), reg.TimeSeries(metrics.TimeSeriesIdentifier{
+		MetricName: "count",
+		Dimensions: map[string]string{"a": "b"},
+	}, nil))
+}
+
+func TestCounterVec(t *testing.T) {
+	reg := drainingRegistry()
+	v := NewCounterVec(reg, "requests", []string{"method", "status"})
+	getOK := v.WithValues("GET", "200")
+	require.True(t, getOK == v.WithValues("GET", "200"))
+	require.False(t, getOK == v.WithValues("GET", "500"))
+	require.False(t, getOK == v.WithValues("GET2", "00"))
+	require.Equal(t, map[string]string{"method": "GET", "status": "200"}, getOK.TimeSeries().Tsi.Dimensions)
+	getOK.Inc()
+	v.WithValues("GET", "200").Inc()
+	require.EqualValues(t, 2, drain(t, reg, getOK.TimeSeries()).Sum)
+	require.Panics(t, func() {
+		v.WithValues("GET")
+	})
+}
+
+func TestVecs(t *testing.T) {
+	reg := drainingRegistry()
+	require.Equal(t, metrics.TSTypeGauge, NewGaugeVec(reg, "g", []string{"a"}).WithValues("b").TimeSeries().Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.Nil(t, NewHistogramVec(reg, "h", []string{"a"}).WithValues("b").TimeSeries().Tsm)
+	require.Equal(t, "Seconds", NewDurationVec(reg, "d", []string{"a"}).WithValues("b").TimeSeries().Tsm.Value(metrics.MetaDataUnit))
+}
+
+func TestCounterVec_allocs(t *testing.T) {
+	v := NewCounterVec(&metrics.Registry{}, "requests", []string{"method", "status"})
+	v.WithValues("GET", "200")
+	require.Zero(t, testing.AllocsPerRun(100, func() {
+		v.WithValues("GET", "200").Inc()
+	}))
+}
+
+func BenchmarkCounter(b *testing.B) {
+	reg := &metrics.Registry{}
+	dims := map[string]string{"method": "GET", "status": "200"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Counter(reg, "requests", dims).Observe(1)
+	}
+}
+
+func BenchmarkBoundCounter(b *testing.B) {
+	c := NewBoundCounter(&metrics.Registry{}, "requests", map[string]string{"method": "GET", "status": "200"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Inc()
+	}
+}
+
+func BenchmarkCounterVec(b *testing.B) {
+	v := NewCounterVec(&metrics.Registry{}, "requests", []string{"method", "status"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		v.WithValues("GET", "200").Inc()
+	}
+}
+
+func TestBoundHistogram_ObserveContext(t *testing.T) {
+	reg := drainingRegistry()
+	h := NewBoundHistogram(reg, "latency", nil)
+	h.Observe(1)
+	ctx := metrics.WithExemplarTrace(context.Background(), "abc", "def")
+	h.ObserveContext(ctx, 9)
+	h.ObserveContext(context.Background(), 2)
+	aggs := reg.GetOrSet(h.TimeSeries(), nil).(*RollingAggregation).DrainMetrics()
+	require.Len(t, aggs, 1)
+	require.EqualValues(t, 3, aggs[0].Va.SampleCount)
+	require.Len(t, aggs[0].Exemplars, 1)
+	require.Equal(t, "abc", aggs[0].Exemplars[0].TraceID)
+	require.Equal(t, 9.0, aggs[0].Exemplars[0].Value)
+}
+
+// evictingRegistry evicts time series idle for a minute.  Move now forward to make them idle.
+func evictingRegistry(now *time.Time) *metrics.Registry {
+	clock := func() time.Time {
+		return *now
+	}
+	return &metrics.Registry{
+		IdleTTL: time.Minute,
+		Now:     clock,
+		AggregationConstructor: func(ts *metrics.TimeSeries) metrics.Aggregator {
+			return &RollingAggregation{Now: clock}
+		},
+	}
+}
+
+func flushedSum(reg *metrics.Registry, metricName string) float64 {
+	ret := 0.0
+	for _, agg := range reg.FlushMetrics() {
+		if agg.TS.Tsi.MetricName == metricName {
+			ret += agg.Aggregation.Va.Sum
+		}
+	}
+	return ret
+}
+
+func TestBoundCounter_evicted(t *testing.T) {
+	now := time.Now()
+	reg := evictingRegistry(&now)
+	c := NewBoundCounter(reg, "requests", nil)
+	now = now.Add(time.Hour)
+	reg.FlushMetrics()
+	require.True(t, c.observer.(metrics.EvictableObserver).Evicted())
+
+	c.Inc()
+	c.Inc()
+	now = now.Add(time.Hour)
+	require.EqualValues(t, 2, flushedSum(reg, "requests"))
+}
+
+func TestCounterVec_evicted(t *testing.T) {
+	now := time.Now()
+	reg := evictingRegistry(&now)
+	v := NewCounterVec(reg, "requests", []string{"user"})
+	first := v.WithValues("a")
+	for i := 0; i < 100; i++ {
+		v.WithValues(strconv.Itoa(i))
+	}
+	now = now.Add(time.Hour)
+	reg.FlushMetrics()
+
+	again := v.WithValues("a")
+	require.False(t, first == again)
+	require.True(t, again.TimeSeries() == reg.TimeSeries(metrics.TimeSeriesIdentifier{
+		MetricName: "requests",
+		Dimensions: map[string]string{"user": "a"},
+	}, nil))
+	again.Inc()
+	now = now.Add(time.Minute)
+	require.EqualValues(t, 1, flushedSum(reg, "requests"))
+
+	// Growing the cache drops every instrument of an evicted time series
+	for i := 0; i < 200; i++ {
+		v.WithValues("new" + strconv.Itoa(i))
+	}
+	v.vec.mu.RLock()
+	defer v.vec.mu.RUnlock()
+	require.NotContains(t, v.vec.cache, string(appendVecKey(nil, "0")))
+	require.Contains(t, v.vec.cache, string(appendVecKey(nil, "a")))
+}
+
+// busyGauge is a gauge that a test can mark busy
+type busyGauge struct {
+	BoundGauge
+	inUse bool
+}
+
+func (g *busyGauge) busy() bool {
+	return g.inUse
+}
+
+func TestVec_evictedBusy(t *testing.T) {
+	now := time.Now()
+	reg := evictingRegistry(&now)
+	v := newVec(reg, "in_use", []string{"method"}, gaugeMetadata, func(b bound) interface{} {
+		return &busyGauge{BoundGauge: BoundGauge{bound: b}}
+	})
+	g := v.with([]string{"GET"}).(*busyGauge)
+	g.inUse = true
+	g.Set(1)
+	now = now.Add(time.Hour)
+	reg.FlushMetrics()
+	now = now.Add(time.Hour)
+	reg.FlushMetrics()
+	// Still busy, so it is not resolved again
+	require.True(t, g == v.with([]string{"GET"}))
+	g.inUse = false
+	require.False(t, g == v.with([]string{"GET"}))
+}
+
+func TestVec_keys(t *testing.T) {
+	reg := drainingRegistry()
+	v := newVec(reg, "pairs", []string{"a", "b"}, counterMetadata, newBoundCounter)
+	// Values holding the byte a simpler key would separate them with must not collide
+	first := v.with([]string{"a\x00b", "c"}).(*BoundCounter)
+	second := v.with([]string{"a", "b\x00c"}).(*BoundCounter)
+	require.False(t, first == second)
+	require.Equal(t, "b\x00c", second.TimeSeries().Tsi.Dimensions["b"])
+}
@@ -0,0 +1,258 @@
+package metricsext
+
+import (
+	"math"
+	"sort"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// Bucketers below are not thread safe: give each LocklessValueAggregator its own.  Bucket boundaries are computed from
+// an integer index, never accumulated, so two bucketers with the same config always produce identical ranges and
+// merge cleanly with ValueAggregation.Union.
+
+// LinearBucketer places values into buckets of a fixed width: [Offset + i*Width, Offset + (i+1)*Width)
+type LinearBucketer struct {
+	// Width of each bucket.  Default is 1
+	Width float64
+	// Offset is the start of bucket zero.  Default is 0
+	Offset float64
+
+	counts indexCounts
+}
+
+var _ metrics.Bucketer = &LinearBucketer{}
+var _ metrics.Resetter = &LinearBucketer{}
+
+func (l *LinearBucketer) width() float64 {
+	if l.Width <= 0 {
+		return 1
+	}
+	return l.Width
+}
+
+// Observe counts value in its bucket
+func (l *LinearBucketer) Observe(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	l.counts.add(false, int64(math.Floor((value-l.Offset)/l.width())))
+}
+
+// Buckets returns every non empty bucket, ordered by Start
+func (l *LinearBucketer) Buckets() []metrics.Bucket {
+	return l.counts.buckets(func(idx int64) (float64, float64) {
+		start := l.Offset + float64(idx)*l.width()
+		return start, l.Offset + float64(idx+1)*l.width()
+	})
+}
+
+// Reset forgets every observed value
+func (l *LinearBucketer) Reset() {
+	l.counts.reset()
+}
+
+// ExponentialBucketer places positive values into buckets that grow by Factor: [Start*Factor^i, Start*Factor^(i+1)).
+// Negative values use the mirror image of those buckets and zero has a bucket of its own.
+type ExponentialBucketer struct {
+	// Start is the boundary of bucket zero.  Default is 1
+	Start float64
+	// Factor each bucket is larger than the previous one.  Must be more than 1.  Default is 2
+	Factor float64
+
+	counts indexCounts
+}
+
+var _ metrics.Bucketer = &ExponentialBucketer{}
+var _ metrics.Resetter = &ExponentialBucketer{}
+
+func (e *ExponentialBucketer) start() float64 {
+	if e.Start <= 0 {
+		return 1
+	}
+	return e.Start
+}
+
+func (e *ExponentialBucketer) factor() float64 {
+	if e.Factor <= 1 {
+		return 2
+	}
+	return e.Factor
+}
+
+func (e *ExponentialBucketer) lowerBound(idx int64) float64 {
+	return e.start() * math.Pow(e.factor(), float64(idx))
+}
+
+// Observe counts value in its bucket
+func (e *ExponentialBucketer) Observe(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if value == 0 {
+		e.counts.zero++
+		return
+	}
+	abs := math.Abs(value)
+	idx := int64(math.Floor(math.Log(abs/e.start()) / math.Log(e.factor())))
+	// Floating point error in Log can put values on a boundary in the wrong bucket.  Check against the real boundaries.
+	if abs < e.lowerBound(idx) {
+		idx--
+	} else if abs >= e.lowerBound(idx+1) {
+		idx++
+	}
+	e.counts.add(value < 0, idx)
+}
+
+// Buckets returns every non empty bucket, ordered by Start
+func (e *ExponentialBucketer) Buckets() []metrics.Bucket {
+	return e.counts.buckets(func(idx int64) (float64, float64) {
+		return e.lowerBound(idx), e.lowerBound(idx + 1)
+	})
+}
+
+// Reset forgets every observed value
+func (e *ExponentialBucketer) Reset() {
+	e.counts.reset()
+}
+
+// LogLinearBucketer is an HDR histogram style bucketer.  Every power of two range is split into equal width linear
+// buckets, enough of them that the Middle of a value's bucket is within RelativeError of the value.  Negative values use
+// the mirror image of those buckets and zero has a bucket of its own.
+type LogLinearBucketer struct {
+	// RelativeError is the largest error, relative to a value, of using the middle of its bucket instead.  Default
+	// is 0.01 (1%)
+	RelativeError float64
+
+	counts indexCounts
+}
+
+var _ metrics.Bucketer = &LogLinearBucketer{}
+var _ metrics.Resetter = &LogLinearBucketer{}
+
+// subBuckets is how many buckets each power of two is split into.  A bucket of width 2^e/n starting at 2^e or more
+// has a middle within 1/(2n) of any of its values.
+func (l *LogLinearBucketer) subBuckets() int64 {
+	relativeError := l.RelativeError
+	if relativeError <= 0 || relativeError >= 1 {
+		relativeError = 0.01
+	}
+	return int64(math.Ceil(1 / (2 * relativeError)))
+}
+
+// lowerBound of a bucket index, where idx = exponent*subBuckets + subBucket
+func (l *LogLinearBucketer) lowerBound(idx int64) float64 {
+	n := l.subBuckets()
+	exp := floorDiv(idx, n)
+	sub := idx - exp*n
+	return math.Ldexp(0.5+float64(sub)/float64(2*n), int(exp))
+}
+
+// Observe counts value in its bucket
+func (l *LogLinearBucketer) Observe(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if value == 0 {
+		l.counts.zero++
+		return
+	}
+	n := l.subBuckets()
+	// abs == frac * 2^exp with frac in [0.5, 1)
+	frac, exp := math.Frexp(math.Abs(value))
+	sub := int64((frac - 0.5) * float64(2*n))
+	if sub >= n {
+		sub = n - 1
+	}
+	l.counts.add(value < 0, int64(exp)*n+sub)
+}
+
+// Buckets returns every non empty bucket, ordered by Start
+func (l *LogLinearBucketer) Buckets() []metrics.Bucket {
+	return l.counts.buckets(func(idx int64) (float64, float64) {
+		return l.lowerBound(idx), l.lowerBound(idx + 1)
+	})
+}
+
+// Reset forgets every observed value
+func (l *LogLinearBucketer) Reset() {
+	l.counts.reset()
+}
+
+// indexCounts counts values by bucket index, with a separate set of indexes for negative values
+type indexCounts struct {
+	positive map[int64]int32
+	negative map[int64]int32
+	zero     int32
+}
+
+func (c *indexCounts) add(negative bool, idx int64) {
+	if negative {
+		if c.negative == nil {
+			c.negative = make(map[int64]int32)
+		}
+		c.negative[idx]++
+		return
+	}
+	if c.positive == nil {
+		c.positive = make(map[int64]int32)
+	}
+	c.positive[idx]++
+}
+
+// reset clears the counts, keeping the maps for reuse
+func (c *indexCounts) reset() {
+	for idx := range c.positive {
+		delete(c.positive, idx)
+	}
+	for idx := range c.negative {
+		delete(c.negative, idx)
+	}
+	c.zero = 0
+}
+
+// buckets turns counts into Buckets, ordered by Start.  bounds returns the range of a positive index.
+func (c *indexCounts) buckets(bounds func(idx int64) (float64, float64)) []metrics.Bucket {
+	size := len(c.positive) + len(c.negative)
+	if c.zero > 0 {
+		size++
+	}
+	if size == 0 {
+		return nil
+	}
+	ret := make([]metrics.Bucket, 0, size)
+	for idx, count := range c.negative {
+		start, end := bounds(idx)
+		ret = append(ret, metrics.Bucket{
+			Count: count,
+			Start: -end,
+			End:   -start,
+		})
+	}
+	if c.zero > 0 {
+		ret = append(ret, metrics.Bucket{
+			Count: c.zero,
+		})
+	}
+	for idx, count := range c.positive {
+		start, end := bounds(idx)
+		ret = append(ret, metrics.Bucket{
+			Count: count,
+			Start: start,
+			End:   end,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Start < ret[j].Start
+	})
+	return ret
+}
+
+// floorDiv is integer division rounding towards negative infinity
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
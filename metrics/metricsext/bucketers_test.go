@@ -0,0 +1,113 @@
+package metricsext
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinearBucketer(t *testing.T) {
+	b := &LinearBucketer{Width: 10}
+	require.Nil(t, b.Buckets())
+	for _, v := range []float64{0, 5, 9.99, 10, 25, -1, math.NaN()} {
+		b.Observe(v)
+	}
+	require.Equal(t, []metrics.Bucket{
+		{Count: 1, Start: -10, End: 0},
+		{Count: 3, Start: 0, End: 10},
+		{Count: 1, Start: 10, End: 20},
+		{Count: 1, Start: 20, End: 30},
+	}, b.Buckets())
+}
+
+func TestExponentialBucketer(t *testing.T) {
+	b := &ExponentialBucketer{}
+	for _, v := range []float64{1, 1.5, 2, 4, 7.9, 8, 0.5, 0, -3} {
+		b.Observe(v)
+	}
+	require.Equal(t, []metrics.Bucket{
+		{Count: 1, Start: -4, End: -2},
+		{Count: 1, Start: 0, End: 0},
+		{Count: 1, Start: 0.5, End: 1},
+		{Count: 2, Start: 1, End: 2},
+		{Count: 1, Start: 2, End: 4},
+		{Count: 2, Start: 4, End: 8},
+		{Count: 1, Start: 8, End: 16},
+	}, b.Buckets())
+
+	b = &ExponentialBucketer{Start: 0.001, Factor: 10}
+	// Values exactly on a boundary belong to the bucket they start
+	for _, v := range []float64{0.001, 0.01, 0.1, 1, 10, 100, 1000} {
+		b.Observe(v)
+	}
+	for _, bucket := range b.Buckets() {
+		require.EqualValues(t, 1, bucket.Count)
+	}
+}
+
+func TestLogLinearBucketer(t *testing.T) {
+	for _, relativeError := range []float64{0, 0.1, 0.01, 0.001} {
+		b := &LogLinearBucketer{RelativeError: relativeError}
+		if relativeError == 0 {
+			relativeError = 0.01
+		}
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 10000; i++ {
+			v := math.Exp(r.Float64()*40 - 20)
+			if i%2 == 0 {
+				v = -v
+			}
+			bb := &LogLinearBucketer{RelativeError: b.RelativeError}
+			bb.Observe(v)
+			buckets := bb.Buckets()
+			require.Len(t, buckets, 1)
+			require.True(t, buckets[0].Start <= v && v < buckets[0].End || buckets[0].Start < v && v <= buckets[0].End, "%v not inside %v", v, buckets[0])
+			require.InDelta(t, 0, math.Abs(buckets[0].Middle()-v)/math.Abs(v), relativeError, "value %v", v)
+			b.Observe(v)
+		}
+		total := int32(0)
+		buckets := b.Buckets()
+		for i, bucket := range buckets {
+			total += bucket.Count
+			if i > 0 {
+				require.True(t, buckets[i-1].End <= bucket.Start)
+			}
+		}
+		require.EqualValues(t, 10000, total)
+	}
+}
+
+func TestBucketers_union(t *testing.T) {
+	factories := map[string]func() metrics.Bucketer{
+		"linear": func() metrics.Bucketer {
+			return &LinearBucketer{Width: 0.5}
+		},
+		"exponential": func() metrics.Bucketer {
+			return &ExponentialBucketer{Factor: 1.1}
+		},
+		"loglinear": func() metrics.Bucketer {
+			return &LogLinearBucketer{}
+		},
+	}
+	for name, factory := range factories {
+		t.Run(name, func(t *testing.T) {
+			a := &LocklessValueAggregator{Bucketer: factory()}
+			b := &LocklessValueAggregator{Bucketer: factory()}
+			together := &LocklessValueAggregator{Bucketer: factory()}
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 1000; i++ {
+				v := r.Float64() * 100
+				together.Observe(v)
+				if i%3 == 0 {
+					a.Observe(v)
+				} else {
+					b.Observe(v)
+				}
+			}
+			require.ElementsMatch(t, together.Aggregate().Buckets, a.Aggregate().Union(b.Aggregate()).Buckets)
+		})
+	}
+}
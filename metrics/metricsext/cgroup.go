@@ -0,0 +1,280 @@
+package metricsext
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// CgroupCollector is an AggregationSource that reports the resources of a container, read from its cgroup: CPU usage
+// and throttling, memory usage against its limit, OOM kills and process count.  It understands both cgroup v1 and v2.
+// Inside a container, these are the numbers the container is limited by, where /proc shows the whole host.  It is
+// thread safe.
+//
+// The cgroup reported is the one this process is in, read from /proc/self/cgroup.  Controllers that are not mounted are
+// left out.  Other errors reading files are logged.
+type CgroupCollector struct {
+	// TSSource creates the time series reported.  Usually a *metrics.Registry
+	TSSource metrics.TimeSeriesSource
+
+	// Optional
+	// Root is where the cgroup filesystem is mounted.  For cgroup v1, each controller is a directory inside it.  The
+	// CPU controllers may be mounted together, as "cpu,cpuacct" or "cpuacct,cpu", or apart, as "cpu" and "cpuacct".
+	// The cgroup of the process is found under it by its path in /proc/self/cgroup.  If that path does not exist, as
+	// when a container mounts only its own cgroup, the cgroup at Root (or at the v1 controller) is reported.
+	// Default is /sys/fs/cgroup
+	Root string
+	// ProcRoot is where the proc filesystem is mounted.  Default is /proc
+	ProcRoot string
+	// Prefix is put in front of every metric name.  Default is "cgroup."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	Logger     Logger
+	// Default is time.Now
+	Now func() time.Time
+
+	source sampledSource
+}
+
+var _ metrics.AggregationSource = &CgroupCollector{}
+
+// Metric names reported by CgroupCollector, after Prefix
+const (
+	CgroupCPUUsage         = "cpu.usage"
+	CgroupCPUPeriods       = "cpu.periods"
+	CgroupCPUThrottled     = "cpu.throttled_periods"
+	CgroupCPUThrottledTime = "cpu.throttled_time"
+	CgroupMemoryUsage      = "memory.usage"
+	CgroupMemoryLimit      = "memory.limit"
+	CgroupMemoryOOMKills   = "memory.oom_kills"
+	CgroupPids             = "pids.current"
+	CgroupPidsLimit        = "pids.limit"
+)
+
+const (
+	cgroupDefaultPrefix      = "cgroup."
+	cgroupDefaultRoot        = "/sys/fs/cgroup"
+	cgroupV1UnlimitedMemory  = 1 << 62
+	cgroupV1MemoryController = "memory"
+	cgroupV1PidsController   = "pids"
+)
+
+func (c *CgroupCollector) prefix() string {
+	if c.Prefix == "" {
+		return cgroupDefaultPrefix
+	}
+	return c.Prefix
+}
+
+func (c *CgroupCollector) root() string {
+	return procRoot(c.Root, cgroupDefaultRoot)
+}
+
+// logErr logs err, unless it is only that a file does not exist
+func (c *CgroupCollector) logErr(err error) {
+	if err != nil && !os.IsNotExist(err) && c.Logger != nil {
+		c.Logger.Log("err", err)
+	}
+}
+
+// selfCgroups reads the path of this process's cgroup in each hierarchy from /proc/self/cgroup, by controller.  Lines
+// look like "4:cpu,cpuacct:/docker/abc" for v1.  The v2 unified hierarchy has no controllers, as in "0::/docker/abc",
+// and is returned under "".
+func (c *CgroupCollector) selfCgroups() map[string]string {
+	lines, err := readLines(filepath.Join(procRoot(c.ProcRoot, processDefaultProcRoot), "self", "cgroup"))
+	if err != nil {
+		c.logErr(err)
+		return nil
+	}
+	ret := make(map[string]string, len(lines))
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			ret[""] = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			ret[controller] = parts[2]
+		}
+	}
+	return ret
+}
+
+// cgroupDir is the directory of the cgroup at path in the hierarchy mounted at mount.  Inside a container, mount is
+// often the container's own cgroup, so path does not exist under it and mount itself is used.
+func cgroupDir(mount string, path string) string {
+	if path != "" && path != "/" {
+		dir := filepath.Join(mount, path)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return mount
+}
+
+// IsV2 is true if Root is a unified (v2) cgroup hierarchy
+func (c *CgroupCollector) IsV2() bool {
+	_, err := os.Stat(filepath.Join(c.root(), "cgroup.controllers"))
+	return err == nil
+}
+
+// FlushMetrics reads the cgroup and reports its current state.  Usage and limits are gauges.  CPU time, periods and
+// OOM kills are counters.  Limits are left out when there is no limit.
+func (c *CgroupCollector) FlushMetrics() []metrics.TimeSeriesAggregation {
+	s := c.source.start(c.TSSource, c.prefix(), c.Dimensions, nowOrDefault(c.Now))
+	paths := c.selfCgroups()
+	if c.IsV2() {
+		c.flushV2(s, cgroupDir(c.root(), paths[""]))
+	} else {
+		c.flushV1(s, paths)
+	}
+	return s.finish()
+}
+
+// flushV2 reports the v2 cgroup in dir
+func (c *CgroupCollector) flushV2(s *sample, dir string) {
+	if stat, err := readFlatKeyed(filepath.Join(dir, "cpu.stat")); err != nil {
+		c.logErr(err)
+	} else {
+		reportIfExists(stat, "usage_usec", func(v float64) {
+			s.counter(CgroupCPUUsage, nil, unitSeconds, v/1e6)
+		})
+		reportIfExists(stat, "nr_periods", func(v float64) {
+			s.counter(CgroupCPUPeriods, nil, unitCount, v)
+		})
+		reportIfExists(stat, "nr_throttled", func(v float64) {
+			s.counter(CgroupCPUThrottled, nil, unitCount, v)
+		})
+		reportIfExists(stat, "throttled_usec", func(v float64) {
+			s.counter(CgroupCPUThrottledTime, nil, unitSeconds, v/1e6)
+		})
+	}
+	c.gaugeFromFile(s, filepath.Join(dir, "memory.current"), CgroupMemoryUsage, unitBytes)
+	c.limitFromFile(s, filepath.Join(dir, "memory.max"), CgroupMemoryLimit, unitBytes, math.Inf(1))
+	if events, err := readFlatKeyed(filepath.Join(dir, "memory.events")); err != nil {
+		c.logErr(err)
+	} else {
+		reportIfExists(events, "oom_kill", func(v float64) {
+			s.counter(CgroupMemoryOOMKills, nil, unitCount, v)
+		})
+	}
+	c.gaugeFromFile(s, filepath.Join(dir, "pids.current"), CgroupPids, unitCount)
+	c.limitFromFile(s, filepath.Join(dir, "pids.max"), CgroupPidsLimit, unitCount, math.Inf(1))
+}
+
+// cgroupV1CPUControllers are the directories the cpu and cpuacct controllers may be in, with the directory of the
+// controller itself first.  Most systems mount both together and link the other names to that directory.
+var (
+	cgroupV1CPUControllers     = []string{"cpu", "cpu,cpuacct", "cpuacct,cpu"}
+	cgroupV1CPUAcctControllers = []string{"cpuacct", "cpu,cpuacct", "cpuacct,cpu"}
+)
+
+// v1Dir is the directory of this process's cgroup in the v1 controller directory named controller, given its paths
+// by controller
+func (c *CgroupCollector) v1Dir(paths map[string]string, controller string) string {
+	// Controllers mounted together share a path, so any of them finds it
+	return cgroupDir(filepath.Join(c.root(), controller), paths[strings.Split(controller, ",")[0]])
+}
+
+// v1Path returns the path of file in the first of controllers that has it.  If none do, it returns the path in the
+// first controller, so reading it fails with a not exist error.
+func (c *CgroupCollector) v1Path(paths map[string]string, controllers []string, file string) string {
+	for _, controller := range controllers {
+		path := filepath.Join(c.v1Dir(paths, controller), file)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(c.v1Dir(paths, controllers[0]), file)
+}
+
+// flushV1 reports the v1 cgroups at paths, by controller
+func (c *CgroupCollector) flushV1(s *sample, paths map[string]string) {
+	if usage, err := readCgroupValue(c.v1Path(paths, cgroupV1CPUAcctControllers, "cpuacct.usage")); err != nil {
+		c.logErr(err)
+	} else {
+		s.counter(CgroupCPUUsage, nil, unitSeconds, usage/1e9)
+	}
+	if stat, err := readFlatKeyed(c.v1Path(paths, cgroupV1CPUControllers, "cpu.stat")); err != nil {
+		c.logErr(err)
+	} else {
+		reportIfExists(stat, "nr_periods", func(v float64) {
+			s.counter(CgroupCPUPeriods, nil, unitCount, v)
+		})
+		reportIfExists(stat, "nr_throttled", func(v float64) {
+			s.counter(CgroupCPUThrottled, nil, unitCount, v)
+		})
+		reportIfExists(stat, "throttled_time", func(v float64) {
+			s.counter(CgroupCPUThrottledTime, nil, unitSeconds, v/1e9)
+		})
+	}
+	memory := c.v1Dir(paths, cgroupV1MemoryController)
+	c.gaugeFromFile(s, filepath.Join(memory, "memory.usage_in_bytes"), CgroupMemoryUsage, unitBytes)
+	// v1 has no word for unlimited memory: it reports a huge number instead
+	c.limitFromFile(s, filepath.Join(memory, "memory.limit_in_bytes"), CgroupMemoryLimit, unitBytes, cgroupV1UnlimitedMemory)
+	if oom, err := readFlatKeyed(filepath.Join(memory, "memory.oom_control")); err != nil {
+		c.logErr(err)
+	} else {
+		reportIfExists(oom, "oom_kill", func(v float64) {
+			s.counter(CgroupMemoryOOMKills, nil, unitCount, v)
+		})
+	}
+	pids := c.v1Dir(paths, cgroupV1PidsController)
+	c.gaugeFromFile(s, filepath.Join(pids, "pids.current"), CgroupPids, unitCount)
+	c.limitFromFile(s, filepath.Join(pids, "pids.max"), CgroupPidsLimit, unitCount, math.Inf(1))
+}
+
+func (c *CgroupCollector) gaugeFromFile(s *sample, path string, name string, unit string) {
+	value, err := readCgroupValue(path)
+	if err != nil {
+		c.logErr(err)
+		return
+	}
+	s.gauge(name, nil, unit, value)
+}
+
+// limitFromFile reports the limit in path, unless it is at least unlimited
+func (c *CgroupCollector) limitFromFile(s *sample, path string, name string, unit string, unlimited float64) {
+	value, err := readCgroupValue(path)
+	if err != nil {
+		c.logErr(err)
+		return
+	}
+	if value < unlimited {
+		s.gauge(name, nil, unit, value)
+	}
+}
+
+func reportIfExists(values map[string]float64, key string, report func(float64)) {
+	if v, exists := values[key]; exists {
+		report(v)
+	}
+}
+
+// readCgroupValue reads a file holding a single number.  "max" means there is no limit and is returned as +Inf.
+func readCgroupValue(path string) (float64, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return 0, err
+	}
+	content := strings.TrimSpace(string(b))
+	if content == "max" {
+		return math.Inf(1), nil
+	}
+	ret, err := strconv.ParseFloat(content, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return ret, nil
+}
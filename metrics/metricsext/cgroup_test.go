@@ -0,0 +1,170 @@
+package metricsext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+type expectedSample struct {
+	name   string
+	value  float64
+	unit   string
+	tsType metrics.TimeSeriesType
+}
+
+func requireSamples(t *testing.T, flushed map[string]metrics.TimeSeriesAggregation, prefix string, expected []expectedSample) {
+	require.Len(t, flushed, len(expected))
+	for _, e := range expected {
+		agg, exists := flushed[prefix+e.name]
+		require.True(t, exists, e.name)
+		require.Equal(t, e.value, agg.Aggregation.Va.Sum, e.name)
+		require.Equal(t, e.unit, agg.TS.Tsm.Value(metrics.MetaDataUnit), e.name)
+		require.Equal(t, e.tsType, agg.TS.Tsm.Value(metrics.MetaDataTimeSeriesType), e.name)
+	}
+}
+
+var fixtureToken = regexp.MustCompile(`[^\s]+`)
+
+// baselineAtZero flushes once from a copy of the fixtures in dir with every number replaced by zero.  setRoot points
+// the collector at a directory of fixtures.  It is left pointing at dir, so the next flush reports the whole totals of
+// the fixtures' counters instead of taking them as a baseline.
+func baselineAtZero(t *testing.T, dir string, setRoot func(string), flush func() []metrics.TimeSeriesAggregation) {
+	zeroed, err := ioutil.TempDir("", "metricsext")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(zeroed))
+	}()
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(zeroed, rel), 0755)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		b = fixtureToken.ReplaceAllFunc(b, func(token []byte) []byte {
+			if _, err := strconv.ParseFloat(string(token), 64); err == nil {
+				return []byte("0")
+			}
+			return token
+		})
+		return ioutil.WriteFile(filepath.Join(zeroed, rel), b, 0644)
+	}))
+	setRoot(zeroed)
+	flush()
+	setRoot(dir)
+}
+
+func TestCgroupCollector_v2(t *testing.T) {
+	c := &CgroupCollector{
+		TSSource: &metrics.Registry{},
+		Root:     "testdata/cgroup/v2",
+	}
+	require.True(t, c.IsV2())
+	baselineAtZero(t, c.Root, func(root string) { c.Root = root }, c.FlushMetrics)
+	requireSamples(t, flushedByName(c.FlushMetrics()), "cgroup.", []expectedSample{
+		{name: CgroupCPUUsage, value: 2.5, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: CgroupCPUPeriods, value: 100, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: CgroupCPUThrottled, value: 7, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: CgroupCPUThrottledTime, value: 0.35, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: CgroupMemoryUsage, value: 256 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: CgroupMemoryLimit, value: 512 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: CgroupMemoryOOMKills, value: 1, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: CgroupPids, value: 12, unit: "Count", tsType: metrics.TSTypeGauge},
+	})
+	// Counters report nothing new on the next flush, while gauges report their value again
+	flushed := flushedByName(c.FlushMetrics())
+	require.Equal(t, 0.0, flushed["cgroup."+CgroupCPUThrottled].Aggregation.Va.Sum)
+	require.Equal(t, 12.0, flushed["cgroup."+CgroupPids].Aggregation.Va.Sum)
+}
+
+func TestCgroupCollector_v1(t *testing.T) {
+	c := &CgroupCollector{
+		TSSource:   &metrics.Registry{},
+		Root:       "testdata/cgroup/v1",
+		Prefix:     "container.",
+		Dimensions: map[string]string{"task": "abc"},
+	}
+	require.False(t, c.IsV2())
+	baselineAtZero(t, c.Root, func(root string) { c.Root = root }, c.FlushMetrics)
+	flushed := flushedByName(c.FlushMetrics())
+	requireSamples(t, flushed, "container.", []expectedSample{
+		{name: CgroupCPUUsage, value: 4, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: CgroupCPUPeriods, value: 50, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: CgroupCPUThrottled, value: 5, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: CgroupCPUThrottledTime, value: 1.5, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: CgroupMemoryUsage, value: 100 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: CgroupMemoryOOMKills, value: 3, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: CgroupPids, value: 30, unit: "Count", tsType: metrics.TSTypeGauge},
+		{name: CgroupPidsLimit, value: 100, unit: "Count", tsType: metrics.TSTypeGauge},
+	})
+	require.Equal(t, map[string]string{"task": "abc"}, flushed["container."+CgroupPids].TS.Tsi.Dimensions)
+}
+
+func TestCgroupCollector_v1CPUControllers(t *testing.T) {
+	for _, root := range []string{"testdata/cgroup/v1split", "testdata/cgroup/v1reversed"} {
+		c := &CgroupCollector{
+			TSSource: &metrics.Registry{},
+			Root:     root,
+		}
+		baselineAtZero(t, c.Root, func(root string) { c.Root = root }, c.FlushMetrics)
+		requireSamples(t, flushedByName(c.FlushMetrics()), "cgroup.", []expectedSample{
+			{name: CgroupCPUUsage, value: 4, unit: "Seconds", tsType: metrics.TSTypeCounter},
+			{name: CgroupCPUPeriods, value: 50, unit: "Count", tsType: metrics.TSTypeCounter},
+			{name: CgroupCPUThrottled, value: 5, unit: "Count", tsType: metrics.TSTypeCounter},
+			{name: CgroupCPUThrottledTime, value: 1.5, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		})
+	}
+}
+
+func TestCgroupCollector_selfCgroup(t *testing.T) {
+	c := &CgroupCollector{
+		TSSource: &metrics.Registry{},
+		Root:     "testdata/cgroup/v2nested",
+		ProcRoot: "testdata/cgroupproc/v2",
+	}
+	// The process is in app.slice/web.service, not in the root cgroup
+	requireSamples(t, flushedByName(c.FlushMetrics()), "cgroup.", []expectedSample{
+		{name: CgroupMemoryUsage, value: 256 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: CgroupPids, value: 5, unit: "Count", tsType: metrics.TSTypeGauge},
+	})
+
+	c = &CgroupCollector{
+		TSSource: &metrics.Registry{},
+		Root:     "testdata/cgroup/v1nested",
+		ProcRoot: "testdata/cgroupproc/v1",
+	}
+	baselineAtZero(t, c.Root, func(root string) { c.Root = root }, c.FlushMetrics)
+	// CPU and memory are in docker/abc.  The pids controller has no docker/abc, as if it were mounted inside the
+	// container, so its own directory is read.
+	requireSamples(t, flushedByName(c.FlushMetrics()), "cgroup.", []expectedSample{
+		{name: CgroupCPUUsage, value: 4, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: CgroupMemoryUsage, value: 50 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: CgroupPids, value: 7, unit: "Count", tsType: metrics.TSTypeGauge},
+	})
+}
+
+func TestCgroupCollector_missing(t *testing.T) {
+	var logger recordingLogger
+	c := &CgroupCollector{
+		TSSource: &metrics.Registry{},
+		Root:     "testdata/cgroup/none",
+		Logger:   &logger,
+	}
+	require.Empty(t, c.FlushMetrics())
+	require.Empty(t, logger.logs)
+}
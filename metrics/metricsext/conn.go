@@ -0,0 +1,226 @@
+package metricsext
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// ConnListenerDimension is the dimension holding ConnMetrics.Name
+const ConnListenerDimension = "listener"
+
+// Metric names reported by ConnMetrics, after Prefix
+const (
+	ConnAccepted     = "accepted"
+	ConnAcceptErrors = "accept_errors"
+	ConnActive       = "active"
+	ConnLifetime     = "lifetime"
+	ConnBytesRead    = "bytes_read"
+	ConnBytesWritten = "bytes_written"
+	ConnReadErrors   = "read_errors"
+	ConnWriteErrors  = "write_errors"
+)
+
+// ConnMetrics wraps network listeners and connections to report connections accepted, connections open, how long each
+// connection lived, bytes read and written and read and write errors (other than io.EOF).  Every time series has a
+// listener dimension of Name.  Time series are resolved on first use.  If Registry is a metrics.CallbackRegistry, the
+// active gauge is reported at every flush by a callback registered on first use, so connections that stay open count in
+// every flush.  It is thread safe.
+//
+//	listener = (&metricsext.ConnMetrics{Registry: registry, Name: "redis"}).WrapListener(listener)
+type ConnMetrics struct {
+	Registry metrics.BaseRegistry
+	// Name tells listeners apart, in the listener dimension
+	Name string
+
+	// Optional
+	// Prefix is put in front of every metric name.  Default is "net."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// Default is time.Now
+	Now func() time.Time
+
+	once         sync.Once
+	accepted     *BoundCounter
+	acceptErrors *BoundCounter
+	active       *inFlightCounts
+	lifetime     *BoundDuration
+	bytesRead    *BoundCounter
+	bytesWritten *BoundCounter
+	readErrors   *BoundCounter
+	writeErrors  *BoundCounter
+}
+
+func (c *ConnMetrics) setup() {
+	c.once.Do(func() {
+		prefix := c.Prefix
+		if prefix == "" {
+			prefix = "net."
+		}
+		a := c.Registry
+		dimensions := mergeMapsCopy(c.Dimensions, map[string]string{ConnListenerDimension: c.Name})
+		byteCounter := func(tsi metrics.TimeSeriesIdentifier, tsm metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+			return counterMetadata(tsi, bytesMetadata(tsi, tsm))
+		}
+		c.accepted = NewBoundCounter(a, prefix+ConnAccepted, dimensions)
+		c.acceptErrors = NewBoundCounter(a, prefix+ConnAcceptErrors, dimensions)
+		c.active = newInFlightCounts(WithDimensions(a, dimensions), prefix+ConnActive, nil)
+		c.lifetime = NewBoundDuration(a, prefix+ConnLifetime, dimensions)
+		c.bytesRead = &BoundCounter{bound: newBound(a, prefix+ConnBytesRead, dimensions, byteCounter)}
+		c.bytesWritten = &BoundCounter{bound: newBound(a, prefix+ConnBytesWritten, dimensions, byteCounter)}
+		c.readErrors = NewBoundCounter(a, prefix+ConnReadErrors, dimensions)
+		c.writeErrors = NewBoundCounter(a, prefix+ConnWriteErrors, dimensions)
+	})
+}
+
+func (c *ConnMetrics) now() time.Time {
+	return nowOrDefault(c.Now)
+}
+
+// WrapListener returns a listener that reports every connection accepted from l
+func (c *ConnMetrics) WrapListener(l net.Listener) net.Listener {
+	c.setup()
+	return &instrumentedListener{Listener: l, metrics: c}
+}
+
+// WrapConn returns a connection that reports what is done with conn.  Use it for connections that were not accepted
+// from a wrapped listener, like dialed ones.  It counts as an active connection until it is closed.  It implements
+// io.ReaderFrom and io.WriterTo, using conn's own if it has them, and CloseWrite if conn does (like *net.TCPConn).
+func (c *ConnMetrics) WrapConn(conn net.Conn) net.Conn {
+	c.setup()
+	c.active.add(nil, 1)
+	ic := &instrumentedConn{Conn: conn, metrics: c, start: c.now()}
+	if _, ok := conn.(closeWriter); ok {
+		return closeWriteConn{ic}
+	}
+	return ic
+}
+
+type instrumentedListener struct {
+	net.Listener
+	metrics *ConnMetrics
+	closed  int32
+}
+
+func (l *instrumentedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		// Accept fails once the listener is closed.  That is how servers stop, not an error worth counting.
+		if atomic.LoadInt32(&l.closed) == 0 {
+			l.metrics.acceptErrors.Inc()
+		}
+		return nil, err
+	}
+	l.metrics.accepted.Inc()
+	return l.metrics.WrapConn(conn), nil
+}
+
+func (l *instrumentedListener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return l.Listener.Close()
+}
+
+// instrumentedConn reports reads, writes and, when closed, how long it was open
+type instrumentedConn struct {
+	net.Conn
+	metrics   *ConnMetrics
+	start     time.Time
+	closeOnce sync.Once
+}
+
+func (c *instrumentedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.bytesRead.Add(float64(n))
+	}
+	if err != nil && err != io.EOF {
+		c.metrics.readErrors.Inc()
+	}
+	return n, err
+}
+
+func (c *instrumentedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.bytesWritten.Add(float64(n))
+	}
+	if err != nil {
+		c.metrics.writeErrors.Inc()
+	}
+	return n, err
+}
+
+// ReadFrom writes everything read from r to the connection, with the connection's ReadFrom if it has one.  That lets
+// *net.TCPConn use sendfile and splice.
+func (c *instrumentedConn) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if !ok {
+		// Hide ReadFrom from io.Copy, which would call it again.  Write counts what is written.
+		return io.Copy(writerOnly{c}, r)
+	}
+	n, err := rf.ReadFrom(r)
+	if n > 0 {
+		c.metrics.bytesWritten.Add(float64(n))
+	}
+	if err != nil {
+		c.metrics.writeErrors.Inc()
+	}
+	return n, err
+}
+
+// WriteTo writes everything read from the connection to w, with the connection's WriteTo if it has one
+func (c *instrumentedConn) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := c.Conn.(io.WriterTo)
+	if !ok {
+		// Hide WriteTo from io.Copy, which would call it again.  Read counts what is read.
+		return io.Copy(w, readerOnly{c})
+	}
+	n, err := wt.WriteTo(w)
+	if n > 0 {
+		c.metrics.bytesRead.Add(float64(n))
+	}
+	if err != nil {
+		c.metrics.readErrors.Inc()
+	}
+	return n, err
+}
+
+func (c *instrumentedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.metrics.active.add(nil, -1)
+		c.metrics.lifetime.Observe(c.metrics.now().Sub(c.start))
+	})
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection, for its methods that are not part of net.Conn (like SetKeepAlive)
+func (c *instrumentedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// closeWriter is implemented by connections that can shut down writing and keep reading, like *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWriteConn is an instrumentedConn of a connection with CloseWrite
+type closeWriteConn struct {
+	*instrumentedConn
+}
+
+func (c closeWriteConn) CloseWrite() error {
+	return c.Conn.(closeWriter).CloseWrite()
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,200 @@
+package metricsext
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnMetrics(t *testing.T) {
+	reg := drainingRegistry()
+	var mu sync.Mutex
+	now := time.Unix(1000, 0)
+	m := &ConnMetrics{
+		Registry:   reg,
+		Name:       "echo",
+		Dimensions: map[string]string{"service": "cache"},
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	}
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := m.WrapListener(raw)
+
+	// The server runs on another goroutine, which must not fail the test itself
+	served := make(chan error, 1)
+	go func() {
+		served <- func() error {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			if _, err := conn.Write([]byte("pong!")); err != nil {
+				return err
+			}
+			// The client closes first, so this read sees io.EOF, which is not an error
+			if _, err := conn.Read(buf); err != io.EOF {
+				return fmt.Errorf("read after the client closed = %v, want io.EOF", err)
+			}
+			mu.Lock()
+			now = now.Add(3 * time.Second)
+			mu.Unlock()
+			if err := conn.Close(); err != nil {
+				return err
+			}
+			// Closing again fails, and is not counted again
+			if err := conn.Close(); err == nil {
+				return errors.New("closing twice should fail")
+			}
+			return nil
+		}()
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong!", string(buf))
+	require.NoError(t, client.Close())
+	require.NoError(t, <-served)
+
+	// Accept failing because the listener closed is not an error
+	require.NoError(t, listener.Close())
+	_, err = listener.Accept()
+	require.Error(t, err)
+
+	series := func(name string) *metrics.TimeSeries {
+		return requestSeries(reg, "net."+name, map[string]string{"listener": "echo", "service": "cache"})
+	}
+	require.Equal(t, 1.0, drain(t, reg, series(ConnAccepted)).Sum)
+	bytesRead := series(ConnBytesRead)
+	require.Equal(t, "Bytes", bytesRead.Tsm.Value(metrics.MetaDataUnit))
+	require.Equal(t, metrics.TSTypeCounter, bytesRead.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.Equal(t, 4.0, drain(t, reg, bytesRead).Sum)
+	require.Equal(t, 5.0, drain(t, reg, series(ConnBytesWritten)).Sum)
+	lifetime := drain(t, reg, series(ConnLifetime))
+	require.EqualValues(t, 1, lifetime.SampleCount)
+	require.Equal(t, 3.0, lifetime.Sum)
+	for _, name := range []string{ConnAcceptErrors, ConnReadErrors, ConnWriteErrors} {
+		aggs := reg.GetOrSet(series(name), nil).(*RollingAggregation).DrainMetrics()
+		require.Empty(t, aggs, name)
+	}
+	require.Equal(t, 0.0, flushedSum(reg, "net."+ConnActive))
+	require.Equal(t, metrics.TSTypeGauge, series(ConnActive).Tsm.Value(metrics.MetaDataTimeSeriesType))
+}
+
+func TestConnMetrics_activeEveryFlush(t *testing.T) {
+	reg := &metrics.Registry{}
+	m := &ConnMetrics{
+		Registry: reg,
+		Name:     "pipe",
+	}
+	server, client := net.Pipe()
+	conn := m.WrapConn(server)
+	// A connection that stays open is reported by every flush, not only the one after it opened
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 1.0, flushedSum(reg, "net."+ConnActive))
+	}
+	require.NoError(t, conn.Close())
+	require.NoError(t, client.Close())
+	require.Equal(t, 0.0, flushedSum(reg, "net."+ConnActive))
+}
+
+func TestConnMetrics_errors(t *testing.T) {
+	reg := drainingRegistry()
+	m := &ConnMetrics{
+		Registry: reg,
+		Name:     "pipe",
+	}
+	server, client := net.Pipe()
+	conn := m.WrapConn(server)
+	require.NoError(t, client.Close())
+	_, err := conn.Write([]byte("lost"))
+	require.Error(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NoError(t, conn.Close())
+	require.Equal(t, server, conn.(interface{ NetConn() net.Conn }).NetConn())
+	_, isCloseWriter := conn.(closeWriter)
+	require.False(t, isCloseWriter, "pipes cannot close only writing")
+
+	require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "net."+ConnWriteErrors, map[string]string{"listener": "pipe"})).Sum)
+	// A closed pipe reads io.EOF
+	require.Empty(t, reg.GetOrSet(requestSeries(reg, "net."+ConnReadErrors, map[string]string{"listener": "pipe"}), nil).(*RollingAggregation).DrainMetrics())
+	require.Equal(t, 0.0, flushedSum(reg, "net."+ConnActive))
+}
+
+func TestConnMetrics_forwarding(t *testing.T) {
+	reg := drainingRegistry()
+	m := &ConnMetrics{
+		Registry: reg,
+		Name:     "dialed",
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, listener.Close())
+	}()
+	served := make(chan error, 1)
+	go func() {
+		served <- func() error {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+			// Reading to the end only finishes once the client closes writing
+			b, err := ioutil.ReadAll(conn)
+			if err != nil {
+				return err
+			}
+			_, err = conn.Write(append(b, "!"...))
+			return err
+		}()
+	}()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	conn := m.WrapConn(raw)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+	n, err := conn.(io.ReaderFrom).ReadFrom(strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, n)
+	require.NoError(t, conn.(closeWriter).CloseWrite())
+	var buf bytes.Buffer
+	n, err = conn.(io.WriterTo).WriteTo(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, 6, n)
+	require.Equal(t, "hello!", buf.String())
+	require.NoError(t, <-served)
+
+	series := func(name string) *metrics.TimeSeries {
+		return requestSeries(reg, "net."+name, map[string]string{"listener": "dialed"})
+	}
+	require.Equal(t, 5.0, drain(t, reg, series(ConnBytesWritten)).Sum)
+	require.Equal(t, 6.0, drain(t, reg, series(ConnBytesRead)).Sum)
+}
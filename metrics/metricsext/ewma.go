@@ -0,0 +1,150 @@
+package metricsext
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// EWMAMeter measures the rate of events as exponentially weighted moving averages, like the 1, 5 and 15 minute load
+// averages of unix.  Call Observe(1) for each event (or Observe(n) for n events) and read a smoothed per second rate
+// with Rate.  It is thread safe.
+//
+// As an Aggregator, each CollectMetrics reports the ExportWindow rate as a single value for the time since the last
+// collection.
+type EWMAMeter struct {
+	// Windows are the periods that rates are averaged over.  Default is 1, 5 and 15 minutes
+	Windows []time.Duration
+	// ExportWindow is the rate CollectMetrics reports.  Default is the first of Windows
+	ExportWindow time.Duration
+	// TickInterval is how often rates are updated.  Default is 5 seconds
+	TickInterval time.Duration
+	// Default is time.Now
+	Now func() time.Time
+
+	mu          sync.Mutex
+	rates       []float64
+	initialized bool
+	uncounted   float64
+	lastTick    time.Time
+	lastCollect time.Time
+}
+
+var _ metrics.Aggregator = &EWMAMeter{}
+
+var defaultEWMAWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+func (e *EWMAMeter) windows() []time.Duration {
+	if len(e.Windows) == 0 {
+		return defaultEWMAWindows
+	}
+	return e.Windows
+}
+
+func (e *EWMAMeter) exportWindow() time.Duration {
+	if e.ExportWindow == 0 {
+		return e.windows()[0]
+	}
+	return e.ExportWindow
+}
+
+func (e *EWMAMeter) tickInterval() time.Duration {
+	if e.TickInterval <= 0 {
+		return 5 * time.Second
+	}
+	return e.TickInterval
+}
+
+func (e *EWMAMeter) now() time.Time {
+	if e.Now == nil {
+		return time.Now()
+	}
+	return e.Now()
+}
+
+// Observe adds value events to the meter
+func (e *EWMAMeter) Observe(value float64) {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tick(now)
+	e.uncounted += value
+}
+
+// Rate is the smoothed events per second over window, which must be one of Windows.  Returns NaN for other windows.
+func (e *EWMAMeter) Rate(window time.Duration) float64 {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tick(now)
+	return e.rate(window)
+}
+
+// CollectMetrics reports the ExportWindow rate
+func (e *EWMAMeter) CollectMetrics() []metrics.TimeWindowAggregation {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tick(now)
+	start := e.lastCollect
+	if start.IsZero() {
+		start = e.lastTick
+	}
+	e.lastCollect = now
+	return []metrics.TimeWindowAggregation{
+		{
+			Va: SingleValue(e.rate(e.exportWindow())).Va,
+			Tw: metrics.TimeWindow{
+				Start:    start,
+				Duration: now.Sub(start),
+			},
+		},
+	}
+}
+
+// rate must be called while holding the lock
+func (e *EWMAMeter) rate(window time.Duration) float64 {
+	for i, w := range e.windows() {
+		if w == window {
+			if e.rates == nil {
+				return 0
+			}
+			return e.rates[i]
+		}
+	}
+	return math.NaN()
+}
+
+// tick moves the averages forward for every TickInterval passed since the last tick.  Must be called while holding
+// the lock.
+func (e *EWMAMeter) tick(now time.Time) {
+	if e.lastTick.IsZero() {
+		e.lastTick = now
+		return
+	}
+	interval := e.tickInterval()
+	ticks := int64(now.Sub(e.lastTick) / interval)
+	if ticks <= 0 {
+		return
+	}
+	e.lastTick = e.lastTick.Add(time.Duration(ticks) * interval)
+	windows := e.windows()
+	if e.rates == nil {
+		e.rates = make([]float64, len(windows))
+	}
+	// The first tick counts the events since the last tick.  Any later ticks saw no events, so they only decay.
+	instant := e.uncounted / interval.Seconds()
+	e.uncounted = 0
+	for i, w := range windows {
+		decay := math.Exp(-interval.Seconds() / w.Seconds())
+		if e.initialized {
+			e.rates[i] = instant + decay*(e.rates[i]-instant)
+		} else {
+			e.rates[i] = instant
+		}
+		e.rates[i] *= math.Pow(decay, float64(ticks-1))
+	}
+	e.initialized = true
+}
@@ -0,0 +1,61 @@
+package metricsext
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEWMAMeter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := EWMAMeter{
+		Now: func() time.Time {
+			return now
+		},
+	}
+	require.Equal(t, 0.0, e.Rate(time.Minute))
+	require.True(t, math.IsNaN(e.Rate(time.Hour)))
+
+	// 10 events a second for 15 minutes
+	for i := 0; i < 15*60; i++ {
+		e.Observe(10)
+		now = now.Add(time.Second)
+	}
+	require.InDelta(t, 10, e.Rate(time.Minute), 0.01)
+	require.InDelta(t, 10, e.Rate(5*time.Minute), 0.01)
+	require.InDelta(t, 10, e.Rate(15*time.Minute), 0.01)
+
+	// After a quiet minute, the 1 minute rate falls by about 1/e and longer windows fall less
+	now = now.Add(time.Minute)
+	require.InDelta(t, 10/math.E, e.Rate(time.Minute), 0.5)
+	require.InDelta(t, 10*math.Exp(-1.0/5), e.Rate(5*time.Minute), 0.5)
+	require.True(t, e.Rate(15*time.Minute) > e.Rate(5*time.Minute))
+
+	// A quiet day decays to nothing without looping over every tick
+	now = now.Add(24 * time.Hour)
+	require.InDelta(t, 0, e.Rate(15*time.Minute), 0.0001)
+}
+
+func TestEWMAMeter_CollectMetrics(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := EWMAMeter{
+		Windows:      []time.Duration{time.Second * 10},
+		TickInterval: time.Second,
+		Now: func() time.Time {
+			return now
+		},
+	}
+	e.CollectMetrics()
+	for i := 0; i < 100; i++ {
+		e.Observe(2)
+		now = now.Add(time.Second)
+	}
+	collected := e.CollectMetrics()
+	require.Len(t, collected, 1)
+	require.Equal(t, time.Unix(1000, 0), collected[0].Tw.Start)
+	require.Equal(t, 100*time.Second, collected[0].Tw.Duration)
+	require.EqualValues(t, 1, collected[0].Va.SampleCount)
+	require.InDelta(t, 2, collected[0].Va.Sum, 0.01)
+}
@@ -0,0 +1,43 @@
+package metricsext
+
+import "github.com/cep21/gometrics/metrics"
+
+// ExponentialHistogramAggregator observes values like LocklessValueAggregator and also records them into a base 2
+// exponential histogram (see metrics.ExponentialHistogram).  It is not thread safe.
+type ExponentialHistogramAggregator struct {
+	// MaxSize is the most buckets kept for positive values (and, separately, negative values).  Default is 160
+	MaxSize int32
+	// MaxScale is the starting, and finest, scale of the histogram.  It is reduced as values spread out.  Default is 20
+	MaxScale int32
+
+	values    LocklessValueAggregator
+	histogram *metrics.ExponentialHistogram
+}
+
+var _ metrics.ValueAggregator = &ExponentialHistogramAggregator{}
+
+func (e *ExponentialHistogramAggregator) maxScale() int32 {
+	if e.MaxScale == 0 {
+		return 20
+	}
+	return e.MaxScale
+}
+
+// Observe adds a value to this aggregator
+func (e *ExponentialHistogramAggregator) Observe(value float64) {
+	if e.histogram == nil {
+		e.histogram = &metrics.ExponentialHistogram{
+			Scale:   e.maxScale(),
+			MaxSize: e.MaxSize,
+		}
+	}
+	e.values.Observe(value)
+	e.histogram.Observe(value)
+}
+
+// Aggregate returns an aggregation of all observed values, including a copy of the histogram
+func (e *ExponentialHistogramAggregator) Aggregate() metrics.ValueAggregation {
+	ret := e.values.Aggregate()
+	ret.ExponentialHistogram = e.histogram.Copy()
+	return ret
+}
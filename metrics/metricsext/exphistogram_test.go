@@ -0,0 +1,26 @@
+package metricsext
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExponentialHistogramAggregator(t *testing.T) {
+	var empty ExponentialHistogramAggregator
+	require.Nil(t, empty.Aggregate().ExponentialHistogram)
+
+	e := ExponentialHistogramAggregator{MaxSize: 8}
+	for i := 1; i <= 100; i++ {
+		e.Observe(float64(i))
+	}
+	agg := e.Aggregate()
+	require.EqualValues(t, 100, agg.SampleCount)
+	require.EqualValues(t, 100, agg.ExponentialHistogram.Count())
+	require.True(t, len(agg.ExponentialHistogram.Positive.Counts) <= 8)
+	require.InDelta(t, 50, agg.Quantile(0.5), 10)
+
+	// The aggregation is a copy: more observations do not change it
+	e.Observe(1000)
+	require.EqualValues(t, 100, agg.ExponentialHistogram.Count())
+}
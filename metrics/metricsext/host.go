@@ -0,0 +1,299 @@
+package metricsext
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// HostCollector is an AggregationSource that reports the health of a Linux host, read from the proc filesystem:
+// network traffic of each interface, I/O of each disk, load averages and memory.  Together with a PeriodicFlusher it
+// makes a small host agent.  It is thread safe.
+//
+// Traffic and I/O are counters with an interface or device dimension.  Load and memory are gauges.  Files it cannot
+// read, and lines of them it cannot parse, are logged and left out.
+type HostCollector struct {
+	// TSSource creates the time series reported.  Usually a *metrics.Registry
+	TSSource metrics.TimeSeriesSource
+
+	// Optional
+	// ProcRoot is where the proc filesystem is mounted.  Default is /proc
+	ProcRoot string
+	// Prefix is put in front of every metric name.  Default is "host."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// IncludeInterface picks the network interfaces to report.  Default is every interface except loopback (lo)
+	IncludeInterface func(name string) bool
+	// IncludeDevice picks the disks to report.  Default is every whole disk except loop and ram devices.  Partitions
+	// (like sda1 or nvme0n1p1) are left out, because their I/O is also counted by their disk.
+	IncludeDevice func(name string) bool
+	Logger        Logger
+	// Default is time.Now
+	Now func() time.Time
+
+	source sampledSource
+}
+
+var _ metrics.AggregationSource = &HostCollector{}
+
+// Dimensions and metric names reported by HostCollector, after Prefix
+const (
+	HostInterfaceDimension = "interface"
+	HostDeviceDimension    = "device"
+
+	HostNetReceiveBytes    = "net.rx_bytes"
+	HostNetReceivePackets  = "net.rx_packets"
+	HostNetReceiveErrors   = "net.rx_errors"
+	HostNetReceiveDropped  = "net.rx_dropped"
+	HostNetTransmitBytes   = "net.tx_bytes"
+	HostNetTransmitPackets = "net.tx_packets"
+	HostNetTransmitErrors  = "net.tx_errors"
+	HostNetTransmitDropped = "net.tx_dropped"
+
+	HostDiskReads        = "disk.reads"
+	HostDiskReadBytes    = "disk.read_bytes"
+	HostDiskReadTime     = "disk.read_time"
+	HostDiskWrites       = "disk.writes"
+	HostDiskWriteBytes   = "disk.write_bytes"
+	HostDiskWriteTime    = "disk.write_time"
+	HostDiskIOInProgress = "disk.io_in_progress"
+	HostDiskIOTime       = "disk.io_time"
+
+	HostLoad1  = "load.1m"
+	HostLoad5  = "load.5m"
+	HostLoad15 = "load.15m"
+
+	HostMemoryTotal     = "memory.total"
+	HostMemoryFree      = "memory.free"
+	HostMemoryAvailable = "memory.available"
+	HostMemoryBuffers   = "memory.buffers"
+	HostMemoryCached    = "memory.cached"
+	HostSwapTotal       = "swap.total"
+	HostSwapFree        = "swap.free"
+)
+
+const (
+	hostDefaultPrefix = "host."
+	// diskstats counts sectors of 512 bytes, whatever the real sector size of the disk
+	diskSectorBytes = 512
+)
+
+// hostField is a column of a proc file and the metric it is reported as
+type hostField struct {
+	column  int
+	name    string
+	unit    string
+	counter bool
+	// scale converts the column to unit.  Zero means 1
+	scale float64
+}
+
+// Columns of /proc/net/dev, after the interface name
+var netDevFields = []hostField{
+	{column: 0, name: HostNetReceiveBytes, unit: unitBytes, counter: true},
+	{column: 1, name: HostNetReceivePackets, unit: unitCount, counter: true},
+	{column: 2, name: HostNetReceiveErrors, unit: unitCount, counter: true},
+	{column: 3, name: HostNetReceiveDropped, unit: unitCount, counter: true},
+	{column: 8, name: HostNetTransmitBytes, unit: unitBytes, counter: true},
+	{column: 9, name: HostNetTransmitPackets, unit: unitCount, counter: true},
+	{column: 10, name: HostNetTransmitErrors, unit: unitCount, counter: true},
+	{column: 11, name: HostNetTransmitDropped, unit: unitCount, counter: true},
+}
+
+// Columns of /proc/diskstats, after the major and minor numbers and device name
+var diskStatsFields = []hostField{
+	{column: 0, name: HostDiskReads, unit: unitCount, counter: true},
+	{column: 2, name: HostDiskReadBytes, unit: unitBytes, counter: true, scale: diskSectorBytes},
+	{column: 3, name: HostDiskReadTime, unit: unitSeconds, counter: true, scale: 1.0 / 1000},
+	{column: 4, name: HostDiskWrites, unit: unitCount, counter: true},
+	{column: 6, name: HostDiskWriteBytes, unit: unitBytes, counter: true, scale: diskSectorBytes},
+	{column: 7, name: HostDiskWriteTime, unit: unitSeconds, counter: true, scale: 1.0 / 1000},
+	{column: 8, name: HostDiskIOInProgress, unit: unitCount},
+	{column: 9, name: HostDiskIOTime, unit: unitSeconds, counter: true, scale: 1.0 / 1000},
+}
+
+// Keys of /proc/meminfo
+var memInfoNames = []struct {
+	key  string
+	name string
+}{
+	{key: "MemTotal", name: HostMemoryTotal},
+	{key: "MemFree", name: HostMemoryFree},
+	{key: "MemAvailable", name: HostMemoryAvailable},
+	{key: "Buffers", name: HostMemoryBuffers},
+	{key: "Cached", name: HostMemoryCached},
+	{key: "SwapTotal", name: HostSwapTotal},
+	{key: "SwapFree", name: HostSwapFree},
+}
+
+func (h *HostCollector) prefix() string {
+	if h.Prefix == "" {
+		return hostDefaultPrefix
+	}
+	return h.Prefix
+}
+
+func (h *HostCollector) path(parts ...string) string {
+	return filepath.Join(append([]string{procRoot(h.ProcRoot, processDefaultProcRoot)}, parts...)...)
+}
+
+func (h *HostCollector) includeInterface(name string) bool {
+	if h.IncludeInterface != nil {
+		return h.IncludeInterface(name)
+	}
+	return name != "lo"
+}
+
+// includeDevice picks the devices to report.  devices holds the name of every device in diskstats.
+func (h *HostCollector) includeDevice(name string, devices map[string]bool) bool {
+	if h.IncludeDevice != nil {
+		return h.IncludeDevice(name)
+	}
+	return !strings.HasPrefix(name, "loop") && !strings.HasPrefix(name, "ram") && !isPartition(name, devices)
+}
+
+// isPartition is true if name is a partition of one of devices: the device name followed by a number, with a "p" in
+// between if the device name ends in a digit (like nvme0n1p1 or mmcblk0p2)
+func isPartition(name string, devices map[string]bool) bool {
+	disk := strings.TrimRightFunc(name, unicode.IsDigit)
+	if disk == name {
+		return false
+	}
+	if devices[disk] {
+		return true
+	}
+	disk = strings.TrimSuffix(disk, "p")
+	return disk != "" && unicode.IsDigit(rune(disk[len(disk)-1])) && devices[disk]
+}
+
+func (h *HostCollector) log(kvs ...interface{}) {
+	if h.Logger != nil {
+		h.Logger.Log(kvs...)
+	}
+}
+
+// FlushMetrics reads the host and reports its current state
+func (h *HostCollector) FlushMetrics() []metrics.TimeSeriesAggregation {
+	s := h.source.start(h.TSSource, h.prefix(), h.Dimensions, nowOrDefault(h.Now))
+	for _, f := range []func(s *sample) error{h.flushNetDev, h.flushDiskStats, h.flushLoadAvg, h.flushMemInfo} {
+		if err := f(s); err != nil {
+			h.log("err", err)
+		}
+	}
+	return s.finish()
+}
+
+func (h *HostCollector) flushNetDev(s *sample) error {
+	lines, err := readLines(h.path("net", "dev"))
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		// The first two lines are headers, without a colon after the interface name
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+		name := strings.TrimSpace(line[:idx])
+		if !h.includeInterface(name) {
+			continue
+		}
+		if err := reportHostFields(s, HostInterfaceDimension, name, strings.Fields(line[idx+1:]), netDevFields); err != nil {
+			h.log("err", err, "line", line)
+		}
+	}
+	return nil
+}
+
+func (h *HostCollector) flushDiskStats(s *sample) error {
+	lines, err := readLines(h.path("diskstats"))
+	if err != nil {
+		return err
+	}
+	devices := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 3 {
+			devices[fields[2]] = true
+		}
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !h.includeDevice(fields[2], devices) {
+			continue
+		}
+		if err := reportHostFields(s, HostDeviceDimension, fields[2], fields[3:], diskStatsFields); err != nil {
+			h.log("err", err, "line", line)
+		}
+	}
+	return nil
+}
+
+func (h *HostCollector) flushLoadAvg(s *sample) error {
+	path := h.path("loadavg")
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("empty file %s", path)
+	}
+	fields := strings.Fields(lines[0])
+	for i, name := range []string{HostLoad1, HostLoad5, HostLoad15} {
+		if i >= len(fields) {
+			return fmt.Errorf("missing load average %s in %s", name, path)
+		}
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return err
+		}
+		s.gauge(name, nil, unitNone, value)
+	}
+	return nil
+}
+
+func (h *HostCollector) flushMemInfo(s *sample) error {
+	values, err := readKeyValues(h.path("meminfo"))
+	if err != nil {
+		return err
+	}
+	for _, m := range memInfoNames {
+		if value, exists := values[m.key]; exists {
+			s.gauge(m.name, nil, unitBytes, value)
+		}
+	}
+	return nil
+}
+
+// reportHostFields reports each field of columns, with the dimension key=value.  If any field cannot be parsed, none
+// are reported.
+func reportHostFields(s *sample, key string, value string, columns []string, fields []hostField) error {
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		if f.column >= len(columns) {
+			return fmt.Errorf("missing column %d for %s %s", f.column, key, value)
+		}
+		v, err := strconv.ParseFloat(columns[f.column], 64)
+		if err != nil {
+			return err
+		}
+		if f.scale != 0 {
+			v *= f.scale
+		}
+		values[i] = v
+	}
+	dimensions := map[string]string{key: value}
+	for i, f := range fields {
+		if f.counter {
+			s.counter(f.name, dimensions, f.unit, values[i])
+		} else {
+			s.gauge(f.name, dimensions, f.unit, values[i])
+		}
+	}
+	return nil
+}
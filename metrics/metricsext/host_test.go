@@ -0,0 +1,106 @@
+package metricsext
+
+import (
+	"testing"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostCollector(t *testing.T) {
+	var logger recordingLogger
+	h := &HostCollector{
+		TSSource: &metrics.Registry{},
+		ProcRoot: "testdata/proc",
+		Logger:   &logger,
+	}
+	baselineAtZero(t, h.ProcRoot, func(root string) { h.ProcRoot = root }, h.FlushMetrics)
+	logger.logs = nil
+	flushed := make(map[string]metrics.TimeSeriesAggregation)
+	for _, agg := range h.FlushMetrics() {
+		flushed[agg.TS.Tsi.String()] = agg
+	}
+	// Loopback, loop devices and the partition nvme0n1p1 are left out.  The malformed bad0 line is logged and skipped.
+	requireSamples(t, flushed, "host.", []expectedSample{
+		{name: "net.rx_bytes interface=eth0", value: 1000000, unit: "Bytes", tsType: metrics.TSTypeCounter},
+		{name: "net.rx_packets interface=eth0", value: 2000, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "net.rx_errors interface=eth0", value: 1, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "net.rx_dropped interface=eth0", value: 2, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "net.tx_bytes interface=eth0", value: 500000, unit: "Bytes", tsType: metrics.TSTypeCounter},
+		{name: "net.tx_packets interface=eth0", value: 1500, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "net.tx_errors interface=eth0", value: 3, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "net.tx_dropped interface=eth0", value: 4, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "disk.reads device=nvme0n1", value: 1000, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "disk.read_bytes device=nvme0n1", value: 20000 * 512, unit: "Bytes", tsType: metrics.TSTypeCounter},
+		{name: "disk.read_time device=nvme0n1", value: 1.5, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: "disk.writes device=nvme0n1", value: 400, unit: "Count", tsType: metrics.TSTypeCounter},
+		{name: "disk.write_bytes device=nvme0n1", value: 8000 * 512, unit: "Bytes", tsType: metrics.TSTypeCounter},
+		{name: "disk.write_time device=nvme0n1", value: 2.5, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: "disk.io_in_progress device=nvme0n1", value: 2, unit: "Count", tsType: metrics.TSTypeGauge},
+		{name: "disk.io_time device=nvme0n1", value: 3, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: "load.1m", value: 0.5, unit: "None", tsType: metrics.TSTypeGauge},
+		{name: "load.5m", value: 0.4, unit: "None", tsType: metrics.TSTypeGauge},
+		{name: "load.15m", value: 0.3, unit: "None", tsType: metrics.TSTypeGauge},
+		{name: "memory.total", value: 4 << 30, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: "memory.free", value: 1 << 30, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: "memory.available", value: 2 << 30, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: "memory.buffers", value: 64 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: "memory.cached", value: 512 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: "swap.total", value: 0, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: "swap.free", value: 0, unit: "Bytes", tsType: metrics.TSTypeGauge},
+	})
+	require.Len(t, logger.logs, 1)
+
+	// Counters only report growth after the first flush
+	for _, agg := range h.FlushMetrics() {
+		if agg.TS.Tsi.String() == "host.disk.reads device=nvme0n1" {
+			require.Equal(t, 0.0, agg.Aggregation.Va.Sum)
+		}
+	}
+}
+
+func TestIsPartition(t *testing.T) {
+	devices := map[string]bool{"sda": true, "sda1": true, "nvme0n1": true, "nvme0n1p2": true, "mmcblk0": true,
+		"mmcblk0p1": true, "md0": true, "dm-1": true, "xvdb": true}
+	for name := range devices {
+		want := name == "sda1" || name == "nvme0n1p2" || name == "mmcblk0p1"
+		require.Equal(t, want, isPartition(name, devices), name)
+	}
+}
+
+func TestHostCollector_filters(t *testing.T) {
+	h := &HostCollector{
+		TSSource:   &metrics.Registry{},
+		ProcRoot:   "testdata/proc",
+		Prefix:     "node.",
+		Dimensions: map[string]string{"host": "i-123"},
+		IncludeInterface: func(name string) bool {
+			return name == "lo"
+		},
+		IncludeDevice: func(name string) bool {
+			return false
+		},
+	}
+	// The first flush is only a baseline for the interface counters
+	h.FlushMetrics()
+	var interfaces []string
+	for _, agg := range h.FlushMetrics() {
+		require.Equal(t, "i-123", agg.TS.Tsi.Dimensions["host"])
+		require.Empty(t, agg.TS.Tsi.Dimensions[HostDeviceDimension])
+		if agg.TS.Tsi.MetricName == "node."+HostNetReceiveBytes {
+			interfaces = append(interfaces, agg.TS.Tsi.Dimensions[HostInterfaceDimension])
+		}
+	}
+	require.Equal(t, []string{"lo"}, interfaces)
+}
+
+func TestHostCollector_missing(t *testing.T) {
+	var logger recordingLogger
+	h := &HostCollector{
+		TSSource: &metrics.Registry{},
+		ProcRoot: "testdata/none",
+		Logger:   &logger,
+	}
+	require.Empty(t, h.FlushMetrics())
+	require.Len(t, logger.logs, 4)
+}
@@ -0,0 +1,303 @@
+package metricsext
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// Dimensions reported by HTTPTransport
+const (
+	HTTPHostDimension  = "host"
+	HTTPErrorDimension = "error"
+)
+
+// Metric names reported by HTTPTransport, after Prefix
+const (
+	HTTPClientRequests        = "requests"
+	HTTPClientDuration        = "duration"
+	HTTPClientErrors          = "errors"
+	HTTPClientDNS             = "dns"
+	HTTPClientConnect         = "connect"
+	HTTPClientTLSHandshake    = "tls_handshake"
+	HTTPClientTimeToFirstByte = "time_to_first_byte"
+)
+
+// Values of the error dimension reported by HTTPTransport
+const (
+	HTTPErrorTimeout           = "timeout"
+	HTTPErrorCanceled          = "canceled"
+	HTTPErrorDNS               = "dns"
+	HTTPErrorConnectionRefused = "connection_refused"
+	HTTPErrorTLS               = "tls"
+	HTTPErrorOther             = "other"
+)
+
+// HTTPStatusError is the status class of requests that got no response
+const HTTPStatusError = "error"
+
+// HTTPTransport is an http.RoundTripper that reports the requests made through Transport: a count and duration by
+// method and status class, errors by category, and how long DNS lookups, connecting, TLS handshakes and the first
+// response byte took.  Durations end when response headers arrive, not when the body is read.  Requests that fail have
+// a status class of HTTPStatusError, and are counted in errors with an error dimension of HTTPErrorTimeout,
+// HTTPErrorCanceled, HTTPErrorDNS, HTTPErrorConnectionRefused, HTTPErrorTLS or HTTPErrorOther.  Time series are
+// resolved once for each combination of dimension values, and cached.  It is thread safe.
+//
+//	client := &http.Client{Transport: &metricsext.HTTPTransport{Registry: registry}}
+type HTTPTransport struct {
+	Registry metrics.BaseRegistry
+
+	// Optional
+	// Transport makes the requests.  Default is http.DefaultTransport
+	Transport http.RoundTripper
+	// Prefix is put in front of every metric name.  Default is "http.client."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// RequestDimensions returns the dimensions of a request, added to every time series it reports.  Default is the
+	// host (and port, if any) of the URL as HTTPHostDimension.
+	RequestDimensions func(r *http.Request) map[string]string
+	// Default is time.Now
+	Now func() time.Time
+
+	once     sync.Once
+	registry metrics.BaseRegistry
+	// hostVecs are the vectors for the default request dimensions
+	hostVecs *httpClientVecs
+	mu       sync.RWMutex
+	// vecs are the vectors for each set of dimension names RequestDimensions returned, keyed by the sorted names
+	vecs map[string]*httpClientVecs
+}
+
+// httpClientVecs are the vectors of an HTTPTransport for one set of request dimension names.  Request dimension
+// values come first, followed by the method and the status class or error category.
+type httpClientVecs struct {
+	requests        vec
+	durations       vec
+	errors          vec
+	dns             vec
+	connect         vec
+	tlsHandshake    vec
+	timeToFirstByte vec
+}
+
+var _ http.RoundTripper = &HTTPTransport{}
+
+func (t *HTTPTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *HTTPTransport) setup() {
+	t.once.Do(func() {
+		t.registry = t.Registry
+		if len(t.Dimensions) != 0 {
+			t.registry = WithDimensions(t.registry, t.Dimensions)
+		}
+		t.hostVecs = t.newVecs([]string{HTTPHostDimension})
+	})
+}
+
+func (t *HTTPTransport) newVecs(names []string) *httpClientVecs {
+	prefix := t.Prefix
+	if prefix == "" {
+		prefix = "http.client."
+	}
+	n := len(names)
+	requestNames := append(names[:n:n], HTTPMethodDimension, HTTPStatusClassDimension)
+	errorNames := append(names[:n:n], HTTPMethodDimension, HTTPErrorDimension)
+	a := t.registry
+	return &httpClientVecs{
+		requests:        newVec(a, prefix+HTTPClientRequests, requestNames, counterMetadata, newBoundCounter),
+		durations:       newVec(a, prefix+HTTPClientDuration, requestNames, secondsMetadata, newDurationObserver),
+		errors:          newVec(a, prefix+HTTPClientErrors, errorNames, counterMetadata, newBoundCounter),
+		dns:             newVec(a, prefix+HTTPClientDNS, names, secondsMetadata, newDurationObserver),
+		connect:         newVec(a, prefix+HTTPClientConnect, names, secondsMetadata, newDurationObserver),
+		tlsHandshake:    newVec(a, prefix+HTTPClientTLSHandshake, names, secondsMetadata, newDurationObserver),
+		timeToFirstByte: newVec(a, prefix+HTTPClientTimeToFirstByte, names, secondsMetadata, newDurationObserver),
+	}
+}
+
+func (t *HTTPTransport) now() time.Time {
+	return nowOrDefault(t.Now)
+}
+
+// requestVecs returns the vectors for the dimensions of a request and the request's values for them
+func (t *HTTPTransport) requestVecs(r *http.Request) (*httpClientVecs, []string) {
+	if t.RequestDimensions == nil {
+		return t.hostVecs, []string{r.URL.Host}
+	}
+	dimensions := t.RequestDimensions(r)
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = dimensions[name]
+	}
+	var buf [128]byte
+	key := buf[:0]
+	for _, name := range names {
+		key = appendVecKey(key, name)
+	}
+	t.mu.RLock()
+	vecs, exists := t.vecs[string(key)]
+	t.mu.RUnlock()
+	if exists {
+		return vecs, values
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if vecs, exists := t.vecs[string(key)]; exists {
+		return vecs, values
+	}
+	vecs = t.newVecs(names)
+	if t.vecs == nil {
+		t.vecs = make(map[string]*httpClientVecs)
+	}
+	t.vecs[string(key)] = vecs
+	return vecs, values
+}
+
+// RoundTrip makes the request with Transport and reports it
+func (t *HTTPTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.setup()
+	vecs, values := t.requestVecs(r)
+	start := t.now()
+	trace := &requestTrace{
+		transport: t,
+		vecs:      vecs,
+		values:    values,
+		start:     start,
+	}
+	resp, err := t.transport().RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace.clientTrace())))
+	took := t.now().Sub(start)
+
+	n := len(values)
+	method := httpMethod(r.Method)
+	statusClass := HTTPStatusError
+	if err == nil {
+		statusClass = httpStatusClass(resp.StatusCode)
+	} else {
+		vecs.errors.with(append(values[:n:n], method, httpErrorCategory(err, trace.failedTLS()))).(*BoundCounter).Inc()
+	}
+	requestValues := append(values[:n:n], method, statusClass)
+	vecs.requests.with(requestValues).(*BoundCounter).Inc()
+	vecs.durations.with(requestValues).(*DurationObserver).Observe(took)
+	return resp, err
+}
+
+// requestTrace times the phases of a single request.  Its hooks may be called concurrently, for example when dialing
+// both IPv4 and IPv6, and even after RoundTrip returns.
+type requestTrace struct {
+	transport *HTTPTransport
+	vecs      *httpClientVecs
+	// values are the request's dimension values, which must not be modified
+	values []string
+	start  time.Time
+
+	mu           sync.Mutex
+	dnsStart     time.Time
+	connectStart map[string]time.Time
+	tlsStart     time.Time
+	tlsFailed    bool
+}
+
+func (r *requestTrace) observe(v *vec, since time.Time) {
+	v.with(r.values).(*DurationObserver).Observe(r.transport.now().Sub(since))
+}
+
+func (r *requestTrace) failedTLS() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tlsFailed
+}
+
+func (r *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.mu.Lock()
+			r.dnsStart = r.transport.now()
+			r.mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			r.mu.Lock()
+			start := r.dnsStart
+			r.mu.Unlock()
+			if info.Err == nil && !start.IsZero() {
+				r.observe(&r.vecs.dns, start)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			r.mu.Lock()
+			if r.connectStart == nil {
+				r.connectStart = make(map[string]time.Time)
+			}
+			r.connectStart[network+" "+addr] = r.transport.now()
+			r.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			r.mu.Lock()
+			start, exists := r.connectStart[network+" "+addr]
+			r.mu.Unlock()
+			if err == nil && exists {
+				r.observe(&r.vecs.connect, start)
+			}
+		},
+		TLSHandshakeStart: func() {
+			r.mu.Lock()
+			r.tlsStart = r.transport.now()
+			r.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			r.mu.Lock()
+			start := r.tlsStart
+			r.tlsFailed = r.tlsFailed || err != nil
+			r.mu.Unlock()
+			if err == nil && !start.IsZero() {
+				r.observe(&r.vecs.tlsHandshake, start)
+			}
+		},
+		GotFirstResponseByte: func() {
+			r.observe(&r.vecs.timeToFirstByte, r.start)
+		},
+	}
+}
+
+// httpErrorCategory sorts the error of a request into a few categories that are safe to use as a dimension
+func httpErrorCategory(err error, failedTLS bool) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalidCertificate x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	switch {
+	case errors.As(err, &dnsErr):
+		return HTTPErrorDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return HTTPErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return HTTPErrorCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return HTTPErrorConnectionRefused
+	case failedTLS, errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalidCertificate),
+		errors.As(err, &recordHeader):
+		return HTTPErrorTLS
+	}
+	return HTTPErrorOther
+}
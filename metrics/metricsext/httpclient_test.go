@@ -0,0 +1,159 @@
+package metricsext
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, "missing")
+	}))
+	defer server.Close()
+	reg := drainingRegistry()
+	client := &http.Client{
+		Transport: &HTTPTransport{
+			Registry:  reg,
+			Transport: &http.Transport{},
+		},
+	}
+	resp, err := client.Get(server.URL + "/users/123")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "missing", string(b))
+
+	host := server.Listener.Addr().String()
+	dimensions := map[string]string{"host": host, "method": "GET", "status_class": "4xx"}
+	require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "http.client.requests", dimensions)).Sum)
+	duration := requestSeries(reg, "http.client.duration", dimensions)
+	require.Equal(t, "Seconds", duration.Tsm.Value(metrics.MetaDataUnit))
+	require.EqualValues(t, 1, drain(t, reg, duration).SampleCount)
+	// The server is an IP address, so there is no DNS lookup
+	require.EqualValues(t, 1, drain(t, reg, requestSeries(reg, "http.client.connect", map[string]string{"host": host})).SampleCount)
+	require.EqualValues(t, 1, drain(t, reg, requestSeries(reg, "http.client.time_to_first_byte", map[string]string{"host": host})).SampleCount)
+}
+
+func TestHTTPTransport_cached(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	reg := drainingRegistry()
+	transport := &HTTPTransport{
+		Registry:   reg,
+		Transport:  &http.Transport{},
+		Dimensions: map[string]string{"app": "web"},
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+	require.Len(t, transport.hostVecs.requests.cache, 1)
+	require.Equal(t, 2.0, drain(t, reg, requestSeries(reg, "http.client.requests", map[string]string{
+		"app":          "web",
+		"host":         server.Listener.Addr().String(),
+		"method":       "GET",
+		"status_class": "2xx",
+	})).Sum)
+}
+
+func TestHTTPTransport_errors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// The client does not trust the server's certificate, which the server would log
+	tlsServer.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	// A port that was just closed refuses connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timedOut, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+
+	testCases := []struct {
+		ctx      context.Context
+		url      string
+		category string
+	}{
+		{ctx: context.Background(), url: "http://" + closedAddr, category: HTTPErrorConnectionRefused},
+		{ctx: context.Background(), url: tlsServer.URL, category: HTTPErrorTLS},
+		{ctx: canceled, url: slow.URL, category: HTTPErrorCanceled},
+		{ctx: timedOut, url: slow.URL, category: HTTPErrorTimeout},
+	}
+	for _, tc := range testCases {
+		reg := drainingRegistry()
+		transport := &HTTPTransport{
+			Registry:  reg,
+			Transport: &http.Transport{},
+			RequestDimensions: func(r *http.Request) map[string]string {
+				return map[string]string{"service": "downstream"}
+			},
+		}
+		req, err := http.NewRequest("POST", tc.url, nil)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(req.WithContext(tc.ctx))
+		require.Error(t, err, tc.url)
+		require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "http.client.errors", map[string]string{
+			"service": "downstream",
+			"method":  "POST",
+			"error":   tc.category,
+		})).Sum, tc.category)
+		require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "http.client.requests", map[string]string{
+			"service":      "downstream",
+			"method":       "POST",
+			"status_class": HTTPStatusError,
+		})).Sum, tc.category)
+	}
+}
+
+func TestHTTPErrorCategory(t *testing.T) {
+	dnsErr := &url.Error{Op: "Get", URL: "http://nowhere.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nowhere.invalid"}}}
+	require.Equal(t, HTTPErrorDNS, httpErrorCategory(dnsErr, false))
+	refused := &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}
+	require.Equal(t, HTTPErrorConnectionRefused, httpErrorCategory(refused, false))
+	require.Equal(t, HTTPErrorTLS, httpErrorCategory(errors.New("remote error: tls: bad certificate"), true))
+	require.Equal(t, HTTPErrorOther, httpErrorCategory(errors.New("EOF"), false))
+}
+
+func TestHTTPTransport_requestVecsKeys(t *testing.T) {
+	var dimensions map[string]string
+	transport := &HTTPTransport{
+		Registry: drainingRegistry(),
+		RequestDimensions: func(r *http.Request) map[string]string {
+			return dimensions
+		},
+	}
+	transport.setup()
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	// Names holding a NUL byte do not run into each other
+	dimensions = map[string]string{"a\x00b": "1"}
+	joined, _ := transport.requestVecs(req)
+	dimensions = map[string]string{"a": "1", "b": "2"}
+	split, _ := transport.requestVecs(req)
+	require.True(t, joined != split)
+	require.Len(t, transport.vecs, 2)
+}
@@ -0,0 +1,420 @@
+package metricsext
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// Dimensions reported by HTTPHandler and HTTPTransport
+const (
+	HTTPMethodDimension      = "method"
+	HTTPStatusClassDimension = "status_class"
+	HTTPRouteDimension       = "route"
+)
+
+// Metric names reported by HTTPHandler, after Prefix
+const (
+	HTTPServerRequests     = "requests"
+	HTTPServerDuration     = "duration"
+	HTTPServerRequestSize  = "request_size"
+	HTTPServerResponseSize = "response_size"
+	HTTPServerInFlight     = "in_flight"
+)
+
+// HTTPStatusHijacked is the status class of requests whose connection was hijacked before a status was written
+const HTTPStatusHijacked = "hijacked"
+
+// HTTPHandler is middleware that reports the requests served by Handler: a count, their duration, the size of each
+// request and response body, and how many are in flight.  Time series have method and status class ("2xx", "4xx" ...)
+// dimensions, and a route dimension if Route is set.  The in flight gauge has no status class.  If Registry is a
+// metrics.CallbackRegistry, it reports the in flight gauge at every flush with a callback registered on first use, so
+// long requests count in every flush they are in flight for.  It is thread safe.
+//
+// Response writers given to Handler implement http.Flusher and http.Hijacker if the original does.
+type HTTPHandler struct {
+	Registry metrics.BaseRegistry
+	Handler  http.Handler
+
+	// Optional
+	// Prefix is put in front of every metric name.  Default is "http.server."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// Route returns the route template a request matched, like "/users/{id}".  Use templates rather than paths so
+	// every ID does not create new time series.  Default is no route dimension.
+	Route func(r *http.Request) string
+	// Default is time.Now
+	Now func() time.Time
+
+	once         sync.Once
+	requests     vec
+	durations    vec
+	requestSize  vec
+	responseSize vec
+	inFlight     *inFlightCounts
+}
+
+var _ http.Handler = &HTTPHandler{}
+
+// InstrumentHandler wraps h with an HTTPHandler that reports every request with the same route template.  Wrap each
+// route registered with a mux to get a route dimension:
+//
+//	mux.Handle("/users/", metricsext.InstrumentHandler(registry, "/users/{id}", usersHandler))
+func InstrumentHandler(a metrics.BaseRegistry, route string, h http.Handler) *HTTPHandler {
+	return &HTTPHandler{
+		Registry: a,
+		Handler:  h,
+		Route: func(*http.Request) string {
+			return route
+		},
+	}
+}
+
+func (h *HTTPHandler) setup() {
+	h.once.Do(func() {
+		prefix := h.Prefix
+		if prefix == "" {
+			prefix = "http.server."
+		}
+		a := h.Registry
+		if len(h.Dimensions) != 0 {
+			a = WithDimensions(a, h.Dimensions)
+		}
+		dimensions := []string{HTTPMethodDimension, HTTPStatusClassDimension}
+		inFlightDimensions := []string{HTTPMethodDimension}
+		if h.Route != nil {
+			dimensions = append(dimensions, HTTPRouteDimension)
+			inFlightDimensions = append(inFlightDimensions, HTTPRouteDimension)
+		}
+		h.requests = newVec(a, prefix+HTTPServerRequests, dimensions, counterMetadata, newBoundCounter)
+		h.durations = newVec(a, prefix+HTTPServerDuration, dimensions, secondsMetadata, newDurationObserver)
+		h.requestSize = newVec(a, prefix+HTTPServerRequestSize, dimensions, bytesMetadata, newBoundHistogram)
+		h.responseSize = newVec(a, prefix+HTTPServerResponseSize, dimensions, bytesMetadata, newBoundHistogram)
+		h.inFlight = newInFlightCounts(a, prefix+HTTPServerInFlight, inFlightDimensions)
+	})
+}
+
+func (h *HTTPHandler) now() time.Time {
+	return nowOrDefault(h.Now)
+}
+
+// ServeHTTP serves the request with Handler and reports it
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.setup()
+	method := httpMethod(r.Method)
+	var route string
+	if h.Route != nil {
+		route = h.Route(r)
+	}
+	inFlightValues := httpDimensionValues(method, "", route, h.Route != nil)
+	h.inFlight.add(inFlightValues, 1)
+	defer h.inFlight.add(inFlightValues, -1)
+
+	var body *countingReadCloser
+	if r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+		// The size is not known up front, so count what the handler reads.  Handlers should not modify the request
+		// they are given, so Handler gets a copy.
+		body = &countingReadCloser{ReadCloser: r.Body}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = body
+		r = r2
+	}
+	rec := &responseRecorder{ResponseWriter: w}
+	start := h.now()
+	finished := false
+	defer func() {
+		if !finished && !rec.wroteHeader {
+			// The handler panicked.  net/http answers with a 500 (or aborts the connection).
+			rec.status = http.StatusInternalServerError
+			rec.wroteHeader = true
+		}
+		values := httpDimensionValues(method, rec.statusClass(), route, h.Route != nil)
+		h.durations.with(values).(*DurationObserver).Observe(h.now().Sub(start))
+		h.requests.with(values).(*BoundCounter).Inc()
+		requestSize := r.ContentLength
+		if body != nil {
+			requestSize = atomic.LoadInt64(&body.count)
+		}
+		if requestSize >= 0 {
+			h.requestSize.with(values).(*BoundHistogram).Observe(float64(requestSize))
+		}
+		if !rec.hijacked {
+			h.responseSize.with(values).(*BoundHistogram).Observe(float64(rec.written))
+		}
+	}()
+	h.Handler.ServeHTTP(rec.wrap(), r)
+	finished = true
+}
+
+// httpDimensionValues lines up dimension values with the dimensions of HTTPHandler's vectors.  An empty status class is
+// for the in flight vector, which has none.
+func httpDimensionValues(method string, statusClass string, route string, hasRoute bool) []string {
+	ret := make([]string, 0, 3)
+	ret = append(ret, method)
+	if statusClass != "" {
+		ret = append(ret, statusClass)
+	}
+	if hasRoute {
+		ret = append(ret, route)
+	}
+	return ret
+}
+
+// httpMethod returns method if it is a standard HTTP method, and "OTHER" otherwise, so clients cannot create unlimited
+// time series with made up methods
+func httpMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	case "":
+		return http.MethodGet
+	}
+	return "OTHER"
+}
+
+// httpStatusClass turns a status code into its class, like "2xx"
+func httpStatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func newBoundCounter(b bound) interface{} {
+	return &BoundCounter{bound: b}
+}
+
+func newDurationObserver(b bound) interface{} {
+	return &DurationObserver{observer: b.observer}
+}
+
+func newBoundHistogram(b bound) interface{} {
+	return &BoundHistogram{bound: b}
+}
+
+// inFlightCounts counts operations in progress by the values of their dimensions.  With a metrics.CallbackRegistry, a
+// callback reports every count at each flush, so operations that stay in progress are reported in every flush.  Other
+// registries get each count observed when it changes, by a vector of inFlightGauge.
+type inFlightCounts struct {
+	dimensionNames []string
+	// gauges is set if the registry cannot run callbacks
+	gauges *vec
+
+	// mu is held for reading to change a count and for writing to report or remove them
+	mu     sync.RWMutex
+	counts map[string]*inFlightCount
+}
+
+type inFlightCount struct {
+	dimensions map[string]string
+	count      int64
+}
+
+func newInFlightCounts(a metrics.BaseRegistry, metricName string, dimensionNames []string) *inFlightCounts {
+	c := &inFlightCounts{
+		dimensionNames: append([]string(nil), dimensionNames...),
+	}
+	if cr, ok := a.(metrics.CallbackRegistry); ok {
+		cr.RegisterCallback(metricName, metrics.TSTypeGauge, nil, c.report)
+		return c
+	}
+	gauges := newVec(a, metricName, dimensionNames, gaugeMetadata, newInFlightGauge)
+	c.gauges = &gauges
+	return c
+}
+
+// add changes the count of values, which must line up with dimensionNames, by delta
+func (c *inFlightCounts) add(values []string, delta int64) {
+	if c.gauges != nil {
+		c.gauges.with(values).(*inFlightGauge).add(delta)
+		return
+	}
+	var buf [128]byte
+	key := buf[:0]
+	for _, val := range values {
+		key = appendVecKey(key, val)
+	}
+	c.mu.RLock()
+	count, exists := c.counts[string(key)]
+	if exists {
+		atomic.AddInt64(&count.count, delta)
+	}
+	c.mu.RUnlock()
+	if exists {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if count, exists = c.counts[string(key)]; !exists {
+		count = &inFlightCount{
+			dimensions: make(map[string]string, len(values)),
+		}
+		for i, name := range c.dimensionNames {
+			count.dimensions[name] = values[i]
+		}
+		if c.counts == nil {
+			c.counts = make(map[string]*inFlightCount)
+		}
+		c.counts[string(key)] = count
+	}
+	atomic.AddInt64(&count.count, delta)
+}
+
+// report is the callback of the counts.  Counts that are back at zero are reported once more, then forgotten.
+func (c *inFlightCounts) report(report func(map[string]string, float64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, count := range c.counts {
+		n := atomic.LoadInt64(&count.count)
+		report(count.dimensions, float64(n))
+		if n == 0 {
+			delete(c.counts, key)
+		}
+	}
+}
+
+// inFlightGauge counts operations in progress and reports the count to a gauge every time it changes
+type inFlightGauge struct {
+	count int64
+	gauge BoundGauge
+}
+
+func newInFlightGauge(b bound) interface{} {
+	return &inFlightGauge{gauge: BoundGauge{bound: b}}
+}
+
+func (g *inFlightGauge) add(delta int64) {
+	g.gauge.Set(float64(atomic.AddInt64(&g.count, delta)))
+}
+
+// busy keeps a vector from resolving the gauge again while operations are in progress: the count would restart at zero
+func (g *inFlightGauge) busy() bool {
+	return atomic.LoadInt64(&g.count) != 0
+}
+
+// countingReadCloser counts the bytes read through it
+type countingReadCloser struct {
+	io.ReadCloser
+	count int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+// responseRecorder remembers the status and body size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	written     int64
+	hijacked    bool
+}
+
+// wrap returns a response writer for the recorder that implements http.Flusher and http.Hijacker only if the original
+// writer does
+func (r *responseRecorder) wrap() http.ResponseWriter {
+	_, isFlusher := r.ResponseWriter.(http.Flusher)
+	_, isHijacker := r.ResponseWriter.(http.Hijacker)
+	switch {
+	case isFlusher && isHijacker:
+		return flushHijackRecorder{r}
+	case isFlusher:
+		return flushRecorder{r}
+	case isHijacker:
+		return hijackRecorder{r}
+	}
+	return r
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	// Informational headers, other than switching protocols, are followed by the real status
+	if !r.wroteHeader && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.implicitHeader()
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the original response writer, for http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// implicitHeader records the 200 that net/http sends when a body is written without a status
+func (r *responseRecorder) implicitHeader() {
+	if !r.wroteHeader {
+		r.status = http.StatusOK
+		r.wroteHeader = true
+	}
+}
+
+func (r *responseRecorder) statusClass() string {
+	if !r.wroteHeader {
+		if r.hijacked {
+			return HTTPStatusHijacked
+		}
+		r.implicitHeader()
+	}
+	return httpStatusClass(r.status)
+}
+
+func (r *responseRecorder) flush() {
+	r.implicitHeader()
+	r.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (r *responseRecorder) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := r.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+type flushRecorder struct {
+	*responseRecorder
+}
+
+func (f flushRecorder) Flush() {
+	f.flush()
+}
+
+type hijackRecorder struct {
+	*responseRecorder
+}
+
+func (h hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.hijack()
+}
+
+type flushHijackRecorder struct {
+	*responseRecorder
+}
+
+func (f flushHijackRecorder) Flush() {
+	f.flush()
+}
+
+func (f flushHijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return f.hijack()
+}
@@ -0,0 +1,199 @@
+package metricsext
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func requestSeries(reg *metrics.Registry, name string, dimensions map[string]string) *metrics.TimeSeries {
+	return reg.TimeSeries(metrics.TimeSeriesIdentifier{
+		MetricName: name,
+		Dimensions: dimensions,
+	}, nil)
+}
+
+func TestHTTPHandler(t *testing.T) {
+	reg := drainingRegistry()
+	now := time.Unix(1000, 0)
+	var inFlightDuringRequest float64
+	h := InstrumentHandler(reg, "/users/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightDuringRequest = flushedSum(reg, "http.server.in_flight")
+		_, isFlusher := w.(http.Flusher)
+		require.True(t, isFlusher)
+		_, isHijacker := w.(http.Hijacker)
+		require.False(t, isHijacker)
+		now = now.Add(250 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		_, err := io.WriteString(w, "hello")
+		require.NoError(t, err)
+	}))
+	h.Now = func() time.Time {
+		return now
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/users/123", strings.NewReader("abc")))
+	require.Equal(t, http.StatusCreated, rw.Code)
+	require.Equal(t, 1.0, inFlightDuringRequest)
+
+	dimensions := map[string]string{"method": "POST", "status_class": "2xx", "route": "/users/{id}"}
+	requests := requestSeries(reg, "http.server.requests", dimensions)
+	require.Equal(t, metrics.TSTypeCounter, requests.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.Equal(t, 1.0, drain(t, reg, requests).Sum)
+	duration := requestSeries(reg, "http.server.duration", dimensions)
+	require.Equal(t, "Seconds", duration.Tsm.Value(metrics.MetaDataUnit))
+	require.Equal(t, 0.25, drain(t, reg, duration).Sum)
+	requestSize := requestSeries(reg, "http.server.request_size", dimensions)
+	require.Equal(t, "Bytes", requestSize.Tsm.Value(metrics.MetaDataUnit))
+	require.Equal(t, 3.0, drain(t, reg, requestSize).Sum)
+	require.Equal(t, 5.0, drain(t, reg, requestSeries(reg, "http.server.response_size", dimensions)).Sum)
+	inFlight := requestSeries(reg, "http.server.in_flight", map[string]string{"method": "POST", "route": "/users/{id}"})
+	require.Equal(t, metrics.TSTypeGauge, inFlight.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.Equal(t, 0.0, flushedSum(reg, "http.server.in_flight"))
+}
+
+func TestHTTPHandler_inFlightEveryFlush(t *testing.T) {
+	reg := &metrics.Registry{}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	h := &HTTPHandler{
+		Registry:   reg,
+		Dimensions: map[string]string{"service": "api"},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+		}),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+	// A request still in flight is reported by every flush, not only the one after it started
+	for i := 0; i < 2; i++ {
+		var inFlight []metrics.TimeSeriesAggregation
+		for _, agg := range reg.FlushMetrics() {
+			if agg.TS.Tsi.MetricName == "http.server.in_flight" {
+				inFlight = append(inFlight, agg)
+			}
+		}
+		require.Len(t, inFlight, 1)
+		require.Equal(t, map[string]string{"method": "GET", "service": "api"}, inFlight[0].TS.Tsi.Dimensions)
+		require.Equal(t, 1.0, inFlight[0].Aggregation.Va.Sum)
+	}
+	close(finish)
+	<-done
+	// Zero is reported once, then the series is forgotten
+	require.Equal(t, 0.0, flushedSum(reg, "http.server.in_flight"))
+	for _, agg := range reg.FlushMetrics() {
+		require.NotEqual(t, "http.server.in_flight", agg.TS.Tsi.MetricName)
+	}
+}
+
+func TestHTTPHandler_inFlightWithoutCallbacks(t *testing.T) {
+	reg := drainingRegistry()
+	var inFlightDuringRequest float64
+	h := &HTTPHandler{
+		Registry: struct{ metrics.BaseRegistry }{reg},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlightDuringRequest = drain(t, reg, requestSeries(reg, "http.server.in_flight", map[string]string{"method": "GET"})).LastValue
+		}),
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	// Registries that cannot run callbacks get the count every time it changes
+	require.Equal(t, 1.0, inFlightDuringRequest)
+	require.Equal(t, 0.0, drain(t, reg, requestSeries(reg, "http.server.in_flight", map[string]string{"method": "GET"})).LastValue)
+}
+
+func TestHTTPHandler_defaults(t *testing.T) {
+	reg := drainingRegistry()
+	h := &HTTPHandler{
+		Registry:   reg,
+		Prefix:     "api.",
+		Dimensions: map[string]string{"service": "users"},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			_, err = w.Write(b)
+			require.NoError(t, err)
+		}),
+	}
+	req := httptest.NewRequest("FOO", "/users/123", strings.NewReader("unknown length"))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Made up methods are grouped, there is no route, and a body written without a status is a 200
+	dimensions := map[string]string{"service": "users", "method": "OTHER", "status_class": "2xx"}
+	require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "api.requests", dimensions)).Sum)
+	require.Equal(t, 14.0, drain(t, reg, requestSeries(reg, "api.request_size", dimensions)).Sum)
+	require.Equal(t, 14.0, drain(t, reg, requestSeries(reg, "api.response_size", dimensions)).Sum)
+}
+
+func TestHTTPHandler_panic(t *testing.T) {
+	reg := drainingRegistry()
+	h := &HTTPHandler{
+		Registry: reg,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("oops")
+		}),
+	}
+	require.Panics(t, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+	require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "http.server.requests", map[string]string{
+		"method":       "GET",
+		"status_class": "5xx",
+	})).Sum)
+}
+
+func TestHTTPHandler_hijack(t *testing.T) {
+	reg := drainingRegistry()
+	h := &HTTPHandler{
+		Registry: reg,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, isFlusher := w.(http.Flusher)
+			require.True(t, isFlusher)
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, conn.Close())
+			}()
+			_, err = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nhi")
+			require.NoError(t, err)
+			require.NoError(t, rw.Flush())
+		}),
+	}
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		close(served)
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(bufio.NewReader(resp.Body))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "hi", string(b))
+	<-served
+	require.Equal(t, 1.0, drain(t, reg, requestSeries(reg, "http.server.requests", map[string]string{
+		"method":       "GET",
+		"status_class": HTTPStatusHijacked,
+	})).Sum)
+}
+
+func TestHTTPStatusClass(t *testing.T) {
+	require.Equal(t, "1xx", httpStatusClass(101))
+	require.Equal(t, "4xx", httpStatusClass(404))
+	require.Equal(t, "5xx", httpStatusClass(599))
+	require.Equal(t, "unknown", httpStatusClass(600))
+}
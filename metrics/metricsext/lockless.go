@@ -15,6 +15,7 @@ type LocklessValueAggregator struct {
 }
 
 var _ metrics.ValueAggregator = &LocklessValueAggregator{}
+var _ metrics.Resetter = &LocklessValueAggregator{}
 
 // Aggregate returns an aggregation of all the observed values
 func (a *LocklessValueAggregator) Aggregate() metrics.ValueAggregation {
@@ -52,3 +53,23 @@ func (a *LocklessValueAggregator) Observe(value float64) {
 		a.Bucketer.Observe(value)
 	}
 }
+
+// Reset forgets every observed value.  The Bucketer is reset too if it is a metrics.Resetter, and otherwise keeps its
+// counts.
+func (a *LocklessValueAggregator) Reset() {
+	*a = LocklessValueAggregator{
+		Bucketer: a.Bucketer,
+	}
+	if r, ok := a.Bucketer.(metrics.Resetter); ok {
+		r.Reset()
+	}
+}
+
+// canReset is false if the Bucketer cannot be reset, so Reset would leave old buckets behind
+func (a *LocklessValueAggregator) canReset() bool {
+	if a.Bucketer == nil {
+		return true
+	}
+	_, ok := a.Bucketer.(metrics.Resetter)
+	return ok
+}
@@ -0,0 +1,207 @@
+package metricsext
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// ProcessCollector is an AggregationSource that reports the CPU, memory, file descriptors and threads of a process by
+// reading the Linux proc filesystem.  It is thread safe.  Values it cannot read (for example on other operating
+// systems) are logged and left out.
+type ProcessCollector struct {
+	// TSSource creates the time series reported.  Usually a *metrics.Registry
+	TSSource metrics.TimeSeriesSource
+
+	// Optional
+	// ProcRoot is where the proc filesystem is mounted.  Default is /proc
+	ProcRoot string
+	// PID is the process to report, as named in ProcRoot.  Default is "self"
+	PID string
+	// Prefix is put in front of every metric name.  Default is "process."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// ClockTicks is the number of clock ticks per second that CPU times are measured in (USER_HZ).  Default is 100
+	ClockTicks float64
+	Logger     Logger
+	// Default is time.Now
+	Now func() time.Time
+
+	source sampledSource
+}
+
+var _ metrics.AggregationSource = &ProcessCollector{}
+
+// Metric names reported by ProcessCollector, after Prefix
+const (
+	ProcessCPUUser        = "cpu.user"
+	ProcessCPUSystem      = "cpu.system"
+	ProcessResidentMemory = "memory.resident"
+	ProcessVirtualMemory  = "memory.virtual"
+	ProcessOpenFDs        = "fds.open"
+	ProcessMaxFDs         = "fds.max"
+	ProcessThreads        = "threads"
+	ProcessStartTime      = "start_time"
+)
+
+const (
+	processDefaultPrefix   = "process."
+	processDefaultPID      = "self"
+	processDefaultProcRoot = "/proc"
+)
+
+func (p *ProcessCollector) prefix() string {
+	if p.Prefix == "" {
+		return processDefaultPrefix
+	}
+	return p.Prefix
+}
+
+func (p *ProcessCollector) pidDir() string {
+	pid := p.PID
+	if pid == "" {
+		pid = processDefaultPID
+	}
+	return filepath.Join(procRoot(p.ProcRoot, processDefaultProcRoot), pid)
+}
+
+func (p *ProcessCollector) clockTicks() float64 {
+	if p.ClockTicks <= 0 {
+		return 100
+	}
+	return p.ClockTicks
+}
+
+func (p *ProcessCollector) log(kvs ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Log(kvs...)
+	}
+}
+
+// FlushMetrics reads the process and reports its current state.  CPU seconds are counters; everything else is a gauge.
+// The start time is reported in seconds since the unix epoch.
+func (p *ProcessCollector) FlushMetrics() []metrics.TimeSeriesAggregation {
+	s := p.source.start(p.TSSource, p.prefix(), p.Dimensions, nowOrDefault(p.Now))
+	if stat, err := p.readStat(); err != nil {
+		p.log("err", err)
+	} else {
+		s.counter(ProcessCPUUser, nil, unitSeconds, stat.userTicks/p.clockTicks())
+		s.counter(ProcessCPUSystem, nil, unitSeconds, stat.systemTicks/p.clockTicks())
+		s.gauge(ProcessThreads, nil, unitCount, stat.threads)
+		s.gauge(ProcessVirtualMemory, nil, unitBytes, stat.virtualBytes)
+		if bootTime, err := p.bootTime(); err != nil {
+			p.log("err", err)
+		} else {
+			s.gauge(ProcessStartTime, nil, unitSeconds, bootTime+stat.startTicks/p.clockTicks())
+		}
+	}
+	// status reports resident memory in bytes, where stat reports pages of an unknown size
+	if status, err := readKeyValues(filepath.Join(p.pidDir(), "status")); err != nil {
+		p.log("err", err)
+	} else if rss, exists := status["VmRSS"]; exists {
+		s.gauge(ProcessResidentMemory, nil, unitBytes, rss)
+	}
+	if fds, err := ioutil.ReadDir(filepath.Join(p.pidDir(), "fd")); err != nil {
+		p.log("err", err)
+	} else {
+		s.gauge(ProcessOpenFDs, nil, unitCount, float64(len(fds)))
+	}
+	if maxFDs, err := p.maxFDs(); err != nil {
+		p.log("err", err)
+	} else if maxFDs >= 0 {
+		s.gauge(ProcessMaxFDs, nil, unitCount, maxFDs)
+	}
+	return s.finish()
+}
+
+type processStat struct {
+	userTicks    float64
+	systemTicks  float64
+	threads      float64
+	startTicks   float64
+	virtualBytes float64
+}
+
+// readStat parses /proc/[pid]/stat.  See proc(5) for the meaning of each field.
+func (p *ProcessCollector) readStat() (processStat, error) {
+	path := filepath.Join(p.pidDir(), "stat")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return processStat{}, err
+	}
+	// The command name (field 2) is in parentheses and may hold spaces, so fields are counted after its closing one
+	content := string(b)
+	idx := strings.LastIndexByte(content, ')')
+	if idx < 0 {
+		return processStat{}, fmt.Errorf("unable to find command name in %s", path)
+	}
+	fields := strings.Fields(content[idx+1:])
+	field := func(num int) (float64, error) {
+		// The first field after the command name is field 3
+		if num-3 >= len(fields) {
+			return 0, fmt.Errorf("missing field %d in %s", num, path)
+		}
+		return strconv.ParseFloat(fields[num-3], 64)
+	}
+	var ret processStat
+	for _, f := range []struct {
+		num   int
+		value *float64
+	}{
+		{num: 14, value: &ret.userTicks},
+		{num: 15, value: &ret.systemTicks},
+		{num: 20, value: &ret.threads},
+		{num: 22, value: &ret.startTicks},
+		{num: 23, value: &ret.virtualBytes},
+	} {
+		if *f.value, err = field(f.num); err != nil {
+			return processStat{}, err
+		}
+	}
+	return ret, nil
+}
+
+// bootTime is when the system booted, in seconds since the unix epoch
+func (p *ProcessCollector) bootTime() (float64, error) {
+	path := filepath.Join(procRoot(p.ProcRoot, processDefaultProcRoot), "stat")
+	lines, err := readLines(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			return strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	return 0, fmt.Errorf("unable to find btime in %s", path)
+}
+
+// maxFDs is the soft limit of open files.  Returns -1 if there is no limit.
+func (p *ProcessCollector) maxFDs() (float64, error) {
+	path := filepath.Join(p.pidDir(), "limits")
+	lines, err := readLines(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) == 0 {
+			break
+		}
+		if fields[0] == "unlimited" {
+			return -1, nil
+		}
+		return strconv.ParseFloat(fields[0], 64)
+	}
+	return 0, fmt.Errorf("unable to find max open files in %s", path)
+}
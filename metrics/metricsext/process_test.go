@@ -0,0 +1,71 @@
+package metricsext
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	logs [][]interface{}
+}
+
+func (r *recordingLogger) Log(kvs ...interface{}) {
+	r.logs = append(r.logs, kvs)
+}
+
+func TestProcessCollector(t *testing.T) {
+	p := &ProcessCollector{
+		TSSource:   &metrics.Registry{},
+		ProcRoot:   "testdata/proc",
+		Dimensions: map[string]string{"service": "api"},
+	}
+	baselineAtZero(t, p.ProcRoot, func(root string) { p.ProcRoot = root }, p.FlushMetrics)
+	flushed := flushedByName(p.FlushMetrics())
+	requireSamples(t, flushed, "process.", []expectedSample{
+		{name: ProcessCPUUser, value: 2.5, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: ProcessCPUSystem, value: 0.75, unit: "Seconds", tsType: metrics.TSTypeCounter},
+		{name: ProcessThreads, value: 12, unit: "Count", tsType: metrics.TSTypeGauge},
+		{name: ProcessVirtualMemory, value: 1 << 30, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: ProcessResidentMemory, value: 20 << 20, unit: "Bytes", tsType: metrics.TSTypeGauge},
+		{name: ProcessOpenFDs, value: 4, unit: "Count", tsType: metrics.TSTypeGauge},
+		{name: ProcessMaxFDs, value: 1024, unit: "Count", tsType: metrics.TSTypeGauge},
+		{name: ProcessStartTime, value: 1700003600, unit: "Seconds", tsType: metrics.TSTypeGauge},
+	})
+	require.Equal(t, map[string]string{"service": "api"}, flushed["process."+ProcessThreads].TS.Tsi.Dimensions)
+
+	// CPU time has not moved since the last flush
+	flushed = flushedByName(p.FlushMetrics())
+	require.Equal(t, 0.0, flushed["process."+ProcessCPUUser].Aggregation.Va.Sum)
+	require.Equal(t, 12.0, flushed["process."+ProcessThreads].Aggregation.Va.Sum)
+}
+
+func TestProcessCollector_missing(t *testing.T) {
+	var logger recordingLogger
+	p := &ProcessCollector{
+		TSSource: &metrics.Registry{},
+		ProcRoot: "testdata/proc",
+		PID:      "1234",
+		Logger:   &logger,
+		Now: func() time.Time {
+			return time.Unix(1000, 0)
+		},
+	}
+	require.Empty(t, p.FlushMetrics())
+	require.Len(t, logger.logs, 4)
+}
+
+func TestProcessCollector_self(t *testing.T) {
+	p := &ProcessCollector{
+		TSSource: &metrics.Registry{},
+	}
+	flushed := flushedByName(p.FlushMetrics())
+	if len(flushed) == 0 {
+		t.Skip("no proc filesystem")
+	}
+	require.True(t, flushed["process."+ProcessThreads].Aggregation.Va.Sum >= 1)
+	require.True(t, flushed["process."+ProcessOpenFDs].Aggregation.Va.Sum >= 3)
+	require.True(t, flushed["process."+ProcessResidentMemory].Aggregation.Va.Sum > 0)
+}
@@ -0,0 +1,80 @@
+package metricsext
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procRoot is root, or def if root is empty
+func procRoot(root string, def string) string {
+	if root == "" {
+		return def
+	}
+	return root
+}
+
+// readLines returns every line of a file, without line endings
+func readLines(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		ret = append(ret, scanner.Text())
+	}
+	return ret, scanner.Err()
+}
+
+// readKeyValues reads files of "Key: value" lines, like /proc/meminfo.  Values with a kB unit are converted to bytes.
+// Lines that are not numbers are skipped.
+func readKeyValues(path string) (map[string]float64, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]float64, len(lines))
+	for _, line := range lines {
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(line[idx+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		ret[line[:idx]] = value
+	}
+	return ret, nil
+}
+
+// readFlatKeyed reads files of "key value" lines, like cpu.stat.  Lines that are not numbers are skipped.
+func readFlatKeyed(path string) (map[string]float64, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]float64, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			ret[fields[0]] = value
+		}
+	}
+	return ret, nil
+}
@@ -1,107 +1,280 @@
-package metricsext
-
-import (
-	"sync"
-	"time"
-
-	"github.com/cep21/gometrics/metrics"
-)
-
-// RollingAggregation aggregates data into time rolling buckets
-type RollingAggregation struct {
-	// Default does not use buckets
-	AggregatorFactory func() metrics.ValueAggregator
-
-	// Default is 1 minute
-	BucketSize time.Duration
-	// Default is time.Now
-	Now func() time.Time
-
-	buckets         map[int64]metrics.ValueAggregator
-	mu              sync.Mutex
-	lastReportedIdx int64
-}
-
-func (t *RollingAggregation) bucketSize() time.Duration {
-	if t.BucketSize == 0 {
-		return time.Minute
-	}
-	return t.BucketSize
-}
-
-func (t *RollingAggregation) createValueAggregator() metrics.ValueAggregator {
-	if t.AggregatorFactory == nil {
-		return &LocklessValueAggregator{}
-	}
-	return t.AggregatorFactory()
-}
-
-func (t *RollingAggregation) now() time.Time {
-	if t.Now == nil {
-		return time.Now()
-	}
-	return t.Now()
-}
-
-// CollectMetrics returns an aggregation for data in any previous time window bucket
-func (t *RollingAggregation) CollectMetrics() []metrics.TimeWindowAggregation {
-	currentIdx := t.bucketIndex(t.now())
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
-	var ret []metrics.TimeWindowAggregation
-	for idx, agg := range t.buckets {
-		if idx < currentIdx {
-			values := agg.Aggregate()
-			ret = append(ret, metrics.TimeWindowAggregation{
-				Va: values,
-				Tw: metrics.TimeWindow{
-					Start:    time.Unix(0, idx*t.bucketSize().Nanoseconds()),
-					Duration: t.bucketSize(),
-				},
-			})
-			delete(t.buckets, idx)
-			if idx > t.lastReportedIdx {
-				t.lastReportedIdx = idx
-			}
-		}
-	}
-
-	// If I'm at index 20, and the last reported index is 19, that's fine (we're still aggregating 20)
-	// If I'm at 20, and the last reported index is 18, that means 19 was fully empty, so report an empty aggregation
-	// TODO: Really need more unit tests here
-	if t.lastReportedIdx < currentIdx-1 {
-		ret = append(ret, metrics.TimeWindowAggregation{
-			Tw: metrics.TimeWindow{
-				Start:    time.Unix(0, t.lastReportedIdx*t.bucketSize().Nanoseconds()),
-				Duration: t.bucketSize() * time.Duration(currentIdx-t.lastReportedIdx),
-			},
-			Va: t.createValueAggregator().Aggregate(),
-		})
-		t.lastReportedIdx = currentIdx
-	}
-	return ret
-}
-
-// Observe puts this value in a bucket for the current time
-func (t *RollingAggregation) Observe(value float64) {
-	aggIdx := t.bucketIndex(t.now())
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	currentBucket, exists := t.buckets[aggIdx]
-	if !exists {
-		if t.buckets == nil {
-			t.buckets = make(map[int64]metrics.ValueAggregator)
-		}
-		currentBucket = t.createValueAggregator()
-		t.buckets[aggIdx] = currentBucket
-	}
-	currentBucket.Observe(value)
-}
-
-func (t *RollingAggregation) bucketIndex(when time.Time) int64 {
-	bucketTime := when.Truncate(t.bucketSize())
-	return bucketTime.UnixNano() / t.bucketSize().Nanoseconds()
-}
-
-var _ metrics.Aggregator = &RollingAggregation{}
+package metricsext
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// RollingAggregation aggregates data into time rolling buckets.  Buckets are kept in a ring indexed by window number,
+// and aggregators that implement metrics.Resetter are reused once their window is collected, so Observe does not
+// allocate in steady state.  Values observed with exemplars (see metrics.ObserveContext) keep a sample of exemplars
+// in each window.  Time series observed from many goroutines at once can be split into Shards, so observations do not
+// wait on a single lock.
+type RollingAggregation struct {
+	// Default does not use buckets
+	AggregatorFactory func() metrics.ValueAggregator
+
+	// Default is 1 minute
+	BucketSize time.Duration
+	// Default is time.Now
+	Now func() time.Time
+	// Windows is how many uncollected buckets fit in the ring.  Buckets that do not fit, because collection fell behind
+	// or the clock jumped, are kept on the side until collected.  Default is 4
+	Windows int
+	// ExemplarReservoirSize is how many random exemplars each window keeps, on top of the smallest and largest values.
+	// Default is 2
+	ExemplarReservoirSize int
+	// Shards splits the aggregation into independently locked parts, picked by a hash of the observing goroutine, so
+	// goroutines observing at the same time rarely wait on each other.  Every shard has its own ring of aggregators,
+	// merged when collected, so only shard time series that are contended.  runtime.GOMAXPROCS(0) is a good start.
+	// Default is 1
+	Shards int
+
+	setupOnce sync.Once
+	shards    []rollingShard
+	// mu is held while collecting, and guards lastReportedIdx
+	mu              sync.Mutex
+	lastReportedIdx int64
+}
+
+// rollingShard is an independently locked ring of windows.  It is padded so shards do not falsely share cache lines.
+type rollingShard struct {
+	mu       sync.Mutex
+	ring     []rollingWindow
+	overflow map[int64]*rollingWindow
+
+	_ [64]byte
+}
+
+// rollingWindow is one slot of the ring.  agg is kept after collection, if it can be reset, for the next window.
+type rollingWindow struct {
+	idx       int64
+	agg       metrics.ValueAggregator
+	exemplars metrics.ExemplarSampler
+	used      bool
+}
+
+func (t *RollingAggregation) bucketSize() time.Duration {
+	if t.BucketSize == 0 {
+		return time.Minute
+	}
+	return t.BucketSize
+}
+
+func (t *RollingAggregation) windows() int {
+	if t.Windows <= 0 {
+		return 4
+	}
+	return t.Windows
+}
+
+func (t *RollingAggregation) setup() {
+	t.setupOnce.Do(func() {
+		numShards := t.Shards
+		if numShards <= 0 {
+			numShards = 1
+		}
+		t.shards = make([]rollingShard, numShards)
+	})
+}
+
+// shard returns the shard the calling goroutine observes into
+func (t *RollingAggregation) shard() *rollingShard {
+	t.setup()
+	if len(t.shards) == 1 {
+		return &t.shards[0]
+	}
+	return &t.shards[goroutineHash()%uint64(len(t.shards))]
+}
+
+func (t *RollingAggregation) createValueAggregator() metrics.ValueAggregator {
+	if t.AggregatorFactory == nil {
+		return &LocklessValueAggregator{}
+	}
+	return t.AggregatorFactory()
+}
+
+func (t *RollingAggregation) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+// CollectMetrics returns an aggregation for data in any previous time window bucket
+func (t *RollingAggregation) CollectMetrics() []metrics.TimeWindowAggregation {
+	currentIdx := t.bucketIndex(t.now())
+	t.setup()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ret []metrics.TimeWindowAggregation
+	for i := range t.shards {
+		ret = t.collectShard(&t.shards[i], currentIdx, ret)
+	}
+
+	// If I'm at index 20, and the last reported index is 19, that's fine (we're still aggregating 20)
+	// If I'm at 20, and the last reported index is 18, that means 19 was fully empty, so report an empty aggregation
+	// TODO: Really need more unit tests here
+	if t.lastReportedIdx < currentIdx-1 {
+		ret = append(ret, metrics.TimeWindowAggregation{
+			Tw: metrics.TimeWindow{
+				Start:    time.Unix(0, t.lastReportedIdx*t.bucketSize().Nanoseconds()),
+				Duration: t.bucketSize() * time.Duration(currentIdx-t.lastReportedIdx),
+			},
+			Va: t.createValueAggregator().Aggregate(),
+		})
+		t.lastReportedIdx = currentIdx
+	}
+	return ret
+}
+
+// DrainMetrics returns an aggregation for data in every time window bucket, including the current one
+func (t *RollingAggregation) DrainMetrics() []metrics.TimeWindowAggregation {
+	t.setup()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]metrics.TimeWindowAggregation, 0, t.windows())
+	for i := range t.shards {
+		ret = t.collectShard(&t.shards[i], math.MaxInt64, ret)
+	}
+	return ret
+}
+
+// collectShard adds to ret the windows of s before currentIdx, merging them with windows of other shards that have the
+// same index.  Must be called while holding t.mu.
+func (t *RollingAggregation) collectShard(s *rollingShard, currentIdx int64, ret []metrics.TimeWindowAggregation) []metrics.TimeWindowAggregation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.ring {
+		if w := &s.ring[i]; w.used && w.idx < currentIdx {
+			ret = mergeWindow(ret, t.collectWindow(w))
+		}
+	}
+	for idx, w := range s.overflow {
+		if idx < currentIdx {
+			delete(s.overflow, idx)
+			ret = mergeWindow(ret, t.windowAggregation(w))
+		}
+	}
+	return ret
+}
+
+// mergeWindow adds agg to ret, or unions it with the aggregation of ret for the same window
+func mergeWindow(ret []metrics.TimeWindowAggregation, agg metrics.TimeWindowAggregation) []metrics.TimeWindowAggregation {
+	for i := range ret {
+		if ret[i].Tw.Start.Equal(agg.Tw.Start) {
+			ret[i] = ret[i].Union(agg)
+			return ret
+		}
+	}
+	return append(ret, agg)
+}
+
+// collectWindow empties a ring slot, resetting its aggregator for reuse if it can.  Must be called while holding the
+// locks of the aggregation and the shard.
+func (t *RollingAggregation) collectWindow(w *rollingWindow) metrics.TimeWindowAggregation {
+	ret := t.windowAggregation(w)
+	w.used = false
+	w.exemplars.Reset()
+	if r, ok := resettable(w.agg); ok {
+		r.Reset()
+	} else {
+		w.agg = nil
+	}
+	return ret
+}
+
+// windowAggregation must be called while holding the locks of the aggregation and the shard
+func (t *RollingAggregation) windowAggregation(w *rollingWindow) metrics.TimeWindowAggregation {
+	if w.idx > t.lastReportedIdx {
+		t.lastReportedIdx = w.idx
+	}
+	return metrics.TimeWindowAggregation{
+		Va: w.agg.Aggregate(),
+		Tw: metrics.TimeWindow{
+			Start:    time.Unix(0, w.idx*t.bucketSize().Nanoseconds()),
+			Duration: t.bucketSize(),
+		},
+		Exemplars: w.exemplars.Exemplars(),
+	}
+}
+
+// Observe puts this value in a bucket for the current time
+func (t *RollingAggregation) Observe(value float64) {
+	aggIdx := t.bucketIndex(t.now())
+	s := t.shard()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.window(s, aggIdx).agg.Observe(value)
+}
+
+// ObserveExemplar puts this value in a bucket for the current time, and offers exemplar to the bucket's sample
+func (t *RollingAggregation) ObserveExemplar(value float64, exemplar metrics.Exemplar) {
+	aggIdx := t.bucketIndex(t.now())
+	s := t.shard()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := t.window(s, aggIdx)
+	w.agg.Observe(value)
+	w.exemplars.Offer(exemplar)
+}
+
+// window returns the window of s for idx, claiming its ring slot or using the overflow if the slot holds an
+// uncollected window.  Must be called while holding the shard's lock.
+func (t *RollingAggregation) window(s *rollingShard, idx int64) *rollingWindow {
+	if w, exists := s.overflow[idx]; exists {
+		return w
+	}
+	if s.ring == nil {
+		s.ring = make([]rollingWindow, t.windows())
+	}
+	slot := idx % int64(len(s.ring))
+	if slot < 0 {
+		slot += int64(len(s.ring))
+	}
+	w := &s.ring[slot]
+	if w.used && w.idx == idx {
+		return w
+	}
+	if w.used {
+		if s.overflow == nil {
+			s.overflow = make(map[int64]*rollingWindow)
+		}
+		overflow := &rollingWindow{
+			idx: idx,
+			agg: t.createValueAggregator(),
+		}
+		overflow.exemplars.ReservoirSize = t.ExemplarReservoirSize
+		s.overflow[idx] = overflow
+		return overflow
+	}
+	if w.agg == nil {
+		w.agg = t.createValueAggregator()
+	}
+	w.exemplars.ReservoirSize = t.ExemplarReservoirSize
+	w.idx = idx
+	w.used = true
+	return w
+}
+
+func (t *RollingAggregation) bucketIndex(when time.Time) int64 {
+	bucketTime := when.Truncate(t.bucketSize())
+	return bucketTime.UnixNano() / t.bucketSize().Nanoseconds()
+}
+
+// resettable returns agg as a Resetter if resetting it clears every observed value
+func resettable(agg metrics.ValueAggregator) (metrics.Resetter, bool) {
+	if l, ok := agg.(*LocklessValueAggregator); ok && !l.canReset() {
+		return nil, false
+	}
+	r, ok := agg.(metrics.Resetter)
+	return r, ok
+}
+
+var _ metrics.Aggregator = &RollingAggregation{}
+var _ metrics.ExemplarObserver = &RollingAggregation{}
+var _ metrics.DrainableCollector = &RollingAggregation{}
@@ -1,8 +1,13 @@
 package metricsext
 
 import (
+	"strconv"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
 )
 
 func BenchmarkRollingAggregation(b *testing.B) {
@@ -26,4 +31,149 @@ func BenchmarkRollingAggregation1000(b *testing.B) {
 		}()
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestRollingAggregation_DrainMetrics(t *testing.T) {
+	now := time.Now()
+	r := RollingAggregation{
+		Now: func() time.Time {
+			return now
+		},
+	}
+	r.Observe(1)
+	r.Observe(2)
+	drained := r.DrainMetrics()
+	require.Len(t, drained, 1)
+	require.EqualValues(t, 2, drained[0].Va.SampleCount)
+	require.Equal(t, now.Truncate(time.Minute).UnixNano(), drained[0].Tw.Start.UnixNano())
+	require.Empty(t, r.DrainMetrics())
+	now = now.Add(time.Minute)
+	for _, agg := range r.CollectMetrics() {
+		require.EqualValues(t, 0, agg.Va.SampleCount)
+	}
+}
+
+func TestRollingAggregation_reusesWindows(t *testing.T) {
+	now := time.Now()
+	r := RollingAggregation{
+		Now: func() time.Time {
+			return now
+		},
+		AggregatorFactory: func() metrics.ValueAggregator {
+			return &LocklessValueAggregator{Bucketer: &LinearBucketer{Width: 10}}
+		},
+	}
+	// Warm up every slot of the ring
+	for i := 0; i < 8; i++ {
+		r.Observe(1)
+		now = now.Add(time.Minute)
+		r.CollectMetrics()
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Observe(5)
+	})
+	require.Zero(t, allocs)
+	now = now.Add(time.Minute)
+	collected := r.CollectMetrics()
+	require.Len(t, collected, 1)
+	require.EqualValues(t, 101, collected[0].Va.SampleCount)
+	require.Equal(t, 5.0, collected[0].Va.Minimum)
+	require.Equal(t, []metrics.Bucket{{Start: 0, End: 10, Count: 101}}, collected[0].Va.Buckets)
+}
+
+// Compare with -cpu 1,4,16 on a machine with that many CPUs.  Unsharded, every CPU waits on the same lock.
+func BenchmarkRollingAggregation_Parallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			r := RollingAggregation{Shards: shards}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					r.Observe(1)
+				}
+			})
+		})
+	}
+}
+
+func TestRollingAggregation_Shards(t *testing.T) {
+	now := time.Now()
+	r := RollingAggregation{
+		Now: func() time.Time {
+			return now
+		},
+		Shards: 8,
+		AggregatorFactory: func() metrics.ValueAggregator {
+			return &LocklessValueAggregator{Bucketer: &LinearBucketer{Width: 10}}
+		},
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= 100; i++ {
+				r.Observe(float64(i))
+			}
+			r.ObserveExemplar(1000, metrics.Exemplar{Value: 1000})
+		}()
+	}
+	wg.Wait()
+	now = now.Add(time.Minute)
+	collected := r.CollectMetrics()
+	require.Len(t, collected, 1)
+	va := collected[0].Va
+	require.EqualValues(t, 1616, va.SampleCount)
+	require.Equal(t, 1.0, va.Minimum)
+	require.Equal(t, 1000.0, va.Maximum)
+	require.Equal(t, 16*(5050.0+1000), va.Sum)
+	total := int32(0)
+	for _, b := range va.Buckets {
+		total += b.Count
+	}
+	require.EqualValues(t, 1616, total)
+	require.NotEmpty(t, collected[0].Exemplars)
+	require.Equal(t, now.Add(-time.Minute).Truncate(time.Minute).UnixNano(), collected[0].Tw.Start.UnixNano())
+
+	r.Observe(3)
+	drained := r.DrainMetrics()
+	require.Len(t, drained, 1)
+	require.EqualValues(t, 1, drained[0].Va.SampleCount)
+}
+
+func TestRollingAggregation_overflow(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := RollingAggregation{
+		Now: func() time.Time {
+			return now
+		},
+		Windows: 2,
+	}
+	// Five windows without a collection do not fit in a ring of two
+	for i := 0; i < 5; i++ {
+		r.Observe(float64(i))
+		r.Observe(float64(i))
+		now = now.Add(time.Minute)
+	}
+	// The clock going backwards lands in an existing window
+	now = now.Add(-2 * time.Minute)
+	r.Observe(3)
+	now = now.Add(2 * time.Minute)
+	collected := r.CollectMetrics()
+	require.Len(t, collected, 5)
+	byStart := make(map[int64]metrics.ValueAggregation)
+	for _, c := range collected {
+		require.Equal(t, time.Minute, c.Tw.Duration)
+		byStart[c.Tw.Start.Unix()] = c.Va
+	}
+	for i := 0; i < 5; i++ {
+		va := byStart[int64(i*60)]
+		expected := int32(2)
+		if i == 3 {
+			expected = 3
+		}
+		require.Equal(t, expected, va.SampleCount)
+		require.Equal(t, float64(i), va.Maximum)
+	}
+	require.Empty(t, r.DrainMetrics())
+}
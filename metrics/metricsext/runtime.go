@@ -0,0 +1,137 @@
+package metricsext
+
+import (
+	"math"
+	"runtime"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// RuntimeCollector is an AggregationSource that reports the health of the Go runtime: goroutines, heap, garbage
+// collection and CGo calls, plus scheduler latency on Go 1.17 or later.  Add it to a MultiSource to flush it with the
+// rest of your metrics.  It is thread safe.
+//
+// Counters (like gc.count) report how much they grew since the last flush.  GC pauses and scheduler latencies are
+// reported as distributions with Buckets.  The first flush is only a baseline for counters and distributions: they
+// report what happened after it.
+type RuntimeCollector struct {
+	// TSSource creates the time series reported.  Usually a *metrics.Registry
+	TSSource metrics.TimeSeriesSource
+
+	// Optional
+	// Prefix is put in front of every metric name.  Default is "go."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// Default is time.Now
+	Now func() time.Time
+
+	source    sampledSource
+	lastNumGC uint32
+	// gcBaseline is set once lastNumGC holds the count of a flush
+	gcBaseline bool
+	scheduler  schedulerLatencies
+}
+
+var _ metrics.AggregationSource = &RuntimeCollector{}
+
+// Metric names reported by RuntimeCollector, after Prefix
+const (
+	RuntimeGoroutines       = "goroutines"
+	RuntimeHeapInUse        = "heap.inuse"
+	RuntimeHeapAlloc        = "heap.alloc"
+	RuntimeHeapObjects      = "heap.objects"
+	RuntimeTotalAlloc       = "heap.total_alloc"
+	RuntimeGCCount          = "gc.count"
+	RuntimeGCPause          = "gc.pause"
+	RuntimeSchedulerLatency = "sched.latency"
+	RuntimeCgoCalls         = "cgo.calls"
+)
+
+func (r *RuntimeCollector) prefix() string {
+	if r.Prefix == "" {
+		return "go."
+	}
+	return r.Prefix
+}
+
+// FlushMetrics reads the runtime and reports its current state
+func (r *RuntimeCollector) FlushMetrics() []metrics.TimeSeriesAggregation {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := r.source.start(r.TSSource, r.prefix(), r.Dimensions, nowOrDefault(r.Now))
+	s.gauge(RuntimeGoroutines, nil, unitCount, float64(runtime.NumGoroutine()))
+	s.gauge(RuntimeHeapInUse, nil, unitBytes, float64(ms.HeapInuse))
+	s.gauge(RuntimeHeapAlloc, nil, unitBytes, float64(ms.HeapAlloc))
+	s.gauge(RuntimeHeapObjects, nil, unitCount, float64(ms.HeapObjects))
+	s.counter(RuntimeTotalAlloc, nil, unitBytes, float64(ms.TotalAlloc))
+	s.counter(RuntimeGCCount, nil, unitCount, float64(ms.NumGC))
+	s.counter(RuntimeCgoCalls, nil, unitCount, float64(runtime.NumCgoCall()))
+	if pauses, ok := r.gcPauses(&ms); ok {
+		s.distribution(RuntimeGCPause, nil, unitSeconds, pauses)
+	}
+	if latencies, ok := r.scheduler.read(); ok {
+		s.distribution(RuntimeSchedulerLatency, nil, unitSeconds, latencies)
+	}
+	return s.finish()
+}
+
+// gcPauses aggregates the pauses of every GC since the last flush.  MemStats only remembers the last 256 pauses, so
+// older ones are lost if more than that happened.  The first flush is a baseline and reports nothing.  Must be called
+// while the source is locked.
+func (r *RuntimeCollector) gcPauses(ms *runtime.MemStats) (metrics.ValueAggregation, bool) {
+	newGCs := ms.NumGC - r.lastNumGC
+	r.lastNumGC = ms.NumGC
+	if !r.gcBaseline {
+		r.gcBaseline = true
+		return metrics.ValueAggregation{}, false
+	}
+	if newGCs == 0 {
+		return metrics.ValueAggregation{}, false
+	}
+	if newGCs > uint32(len(ms.PauseNs)) {
+		newGCs = uint32(len(ms.PauseNs))
+	}
+	agg := LocklessValueAggregator{
+		Bucketer: &ExponentialBucketer{},
+	}
+	for i := ms.NumGC - newGCs; i < ms.NumGC; i++ {
+		// The pause of GC number n (counting from one) is at PauseNs[(n+255)%256]
+		agg.Observe(time.Duration(ms.PauseNs[i%uint32(len(ms.PauseNs))]).Seconds())
+	}
+	return agg.Aggregate(), true
+}
+
+// bucketsAggregation turns bucket counts into an aggregation.  Values are assumed to be in the middle of their bucket.
+// Buckets with an infinite edge are clamped to their finite edge, so they hold only that value.  Buckets with no finite
+// edge are dropped.
+func bucketsAggregation(buckets []metrics.Bucket) metrics.ValueAggregation {
+	var agg metrics.ValueAggregation
+	for _, b := range buckets {
+		if b.Count <= 0 {
+			continue
+		}
+		if math.IsInf(b.Start, 0) {
+			b.Start = b.End
+		}
+		if math.IsInf(b.End, 0) {
+			b.End = b.Start
+		}
+		if math.IsInf(b.Start, 0) {
+			continue
+		}
+		value := b.Middle()
+		if agg.SampleCount == 0 {
+			agg.Minimum = value
+			agg.FirstValue = value
+		}
+		agg.Maximum = value
+		agg.LastValue = value
+		agg.SampleCount += b.Count
+		agg.Sum += value * float64(b.Count)
+		agg.SumSquare += value * value * float64(b.Count)
+		agg.Buckets = append(agg.Buckets, b)
+	}
+	return agg
+}
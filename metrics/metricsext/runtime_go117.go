@@ -0,0 +1,59 @@
+//go:build go1.17
+// +build go1.17
+
+package metricsext
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+
+	gometrics "github.com/cep21/gometrics/metrics"
+)
+
+const schedulerLatenciesName = "/sched/latencies:seconds"
+
+// schedulerLatencies reads how long goroutines waited to run, from runtime/metrics.  The runtime keeps a histogram since
+// the program started, so each read reports the difference from the previous one.  The first read is only a baseline.
+type schedulerLatencies struct {
+	mu         sync.Mutex
+	lastCounts []uint64
+}
+
+func (s *schedulerLatencies) read() (gometrics.ValueAggregation, bool) {
+	samples := []metrics.Sample{{Name: schedulerLatenciesName}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindFloat64Histogram {
+		return gometrics.ValueAggregation{}, false
+	}
+	hist := samples[0].Value.Float64Histogram()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.lastCounts
+	s.lastCounts = append(s.lastCounts[:0:0], hist.Counts...)
+	if len(last) != len(hist.Counts) {
+		return gometrics.ValueAggregation{}, false
+	}
+	var buckets []gometrics.Bucket
+	for i, count := range hist.Counts {
+		delta := count
+		if count >= last[i] {
+			delta = count - last[i]
+		}
+		if delta == 0 {
+			continue
+		}
+		if delta > math.MaxInt32 {
+			delta = math.MaxInt32
+		}
+		buckets = append(buckets, gometrics.Bucket{
+			Count: int32(delta),
+			Start: hist.Buckets[i],
+			End:   hist.Buckets[i+1],
+		})
+	}
+	if len(buckets) == 0 {
+		return gometrics.ValueAggregation{}, false
+	}
+	return bucketsAggregation(buckets), true
+}
@@ -0,0 +1,13 @@
+//go:build !go1.17
+// +build !go1.17
+
+package metricsext
+
+import "github.com/cep21/gometrics/metrics"
+
+// schedulerLatencies needs runtime/metrics from Go 1.17.  Older versions report nothing.
+type schedulerLatencies struct{}
+
+func (s *schedulerLatencies) read() (metrics.ValueAggregation, bool) {
+	return metrics.ValueAggregation{}, false
+}
@@ -0,0 +1,145 @@
+package metricsext
+
+import (
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func flushedByName(aggs []metrics.TimeSeriesAggregation) map[string]metrics.TimeSeriesAggregation {
+	ret := make(map[string]metrics.TimeSeriesAggregation, len(aggs))
+	for _, agg := range aggs {
+		ret[agg.TS.Tsi.MetricName] = agg
+	}
+	return ret
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := &RuntimeCollector{
+		TSSource:   &metrics.Registry{},
+		Prefix:     "app.runtime.",
+		Dimensions: map[string]string{"host": "a"},
+		Now: func() time.Time {
+			return now
+		},
+	}
+	var ms MultiSource
+	ms.AddSource(r)
+
+	runtime.GC()
+	first := flushedByName(ms.FlushMetrics())
+	goroutines := first["app.runtime."+RuntimeGoroutines]
+	require.NotNil(t, goroutines.TS)
+	require.Equal(t, map[string]string{"host": "a"}, goroutines.TS.Tsi.Dimensions)
+	require.Equal(t, metrics.TSTypeGauge, goroutines.TS.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.Equal(t, "Count", goroutines.TS.Tsm.Value(metrics.MetaDataUnit))
+	require.True(t, goroutines.Aggregation.Va.Sum >= 1)
+	require.Equal(t, "Bytes", first["app.runtime."+RuntimeHeapInUse].TS.Tsm.Value(metrics.MetaDataUnit))
+	require.True(t, first["app.runtime."+RuntimeHeapAlloc].Aggregation.Va.Sum > 0)
+
+	// The first flush is only a baseline for counters and distributions
+	_, exists := first["app.runtime."+RuntimeGCCount]
+	require.False(t, exists)
+	_, exists = first["app.runtime."+RuntimeGCPause]
+	require.False(t, exists)
+
+	// The next flush covers the time since the first and counts only the new GCs
+	now = now.Add(time.Minute)
+	runtime.GC()
+	runtime.GC()
+	second := flushedByName(ms.FlushMetrics())
+	gcCount := second["app.runtime."+RuntimeGCCount]
+	require.Equal(t, metrics.TSTypeCounter, gcCount.TS.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.True(t, gcCount.Aggregation.Va.Sum >= 2)
+	require.True(t, gcCount.Aggregation.Va.Sum < 200)
+	require.Equal(t, time.Unix(1000, 0), gcCount.Aggregation.Tw.Start)
+	require.Equal(t, time.Minute, gcCount.Aggregation.Tw.Duration)
+	pauses := second["app.runtime."+RuntimeGCPause]
+	require.Equal(t, "Seconds", pauses.TS.Tsm.Value(metrics.MetaDataUnit))
+	require.Equal(t, gcCount.Aggregation.Va.Sum, float64(pauses.Aggregation.Va.SampleCount))
+	require.NotEmpty(t, pauses.Aggregation.Va.Buckets)
+	require.Equal(t, first["app.runtime."+RuntimeGoroutines].TS, second["app.runtime."+RuntimeGoroutines].TS)
+
+	if latencies, exists := second["app.runtime."+RuntimeSchedulerLatency]; exists {
+		require.Equal(t, "Seconds", latencies.TS.Tsm.Value(metrics.MetaDataUnit))
+		require.NotEmpty(t, latencies.Aggregation.Va.Buckets)
+	}
+}
+
+func TestRuntimeCollector_defaultPrefix(t *testing.T) {
+	r := &RuntimeCollector{
+		TSSource: &metrics.Registry{},
+	}
+	flushed := flushedByName(r.FlushMetrics())
+	_, exists := flushed["go."+RuntimeGoroutines]
+	require.True(t, exists)
+}
+
+func TestSampledCounterReset(t *testing.T) {
+	var source sampledSource
+	reg := &metrics.Registry{}
+	flush := func(total float64) []metrics.TimeSeriesAggregation {
+		s := source.start(reg, "", nil, time.Now())
+		s.counter("requests", nil, unitCount, total)
+		return s.finish()
+	}
+	grew := func(total float64) float64 {
+		aggs := flush(total)
+		require.Len(t, aggs, 1)
+		return aggs[0].Aggregation.Va.Sum
+	}
+	// The first total is only a baseline
+	require.Empty(t, flush(10))
+	require.Equal(t, 5.0, grew(15))
+	require.Equal(t, 0.0, grew(15))
+	// Going down means the counter restarted
+	require.Equal(t, 3.0, grew(3))
+}
+
+func TestSampledCounterPruned(t *testing.T) {
+	var source sampledSource
+	reg := &metrics.Registry{MaxSeriesPerMetric: 1}
+	flush := func(totals map[string]float64) map[string]float64 {
+		s := source.start(reg, "", nil, time.Now())
+		for disk, total := range totals {
+			s.counter("bytes", map[string]string{"disk": disk}, unitBytes, total)
+		}
+		ret := make(map[string]float64)
+		for _, agg := range s.finish() {
+			ret[agg.TS.Tsi.String()] += agg.Aggregation.Va.Sum
+		}
+		return ret
+	}
+	require.Empty(t, flush(map[string]float64{"a": 10}))
+	// b and c share the overflow series, but each grows from its own total
+	flush(map[string]float64{"a": 10, "b": 100, "c": 1000})
+	require.Equal(t, map[string]float64{"bytes disk=a": 1, "bytes overflow=true": 5}, flush(map[string]float64{"a": 11, "b": 102, "c": 1003}))
+	flush(map[string]float64{"a": 12})
+	// b was not sampled in the last flush, so its total is a new baseline
+	require.Equal(t, map[string]float64{"bytes disk=a": 1}, flush(map[string]float64{"a": 13, "b": 200}))
+}
+
+func TestBucketsAggregation(t *testing.T) {
+	agg := bucketsAggregation([]metrics.Bucket{
+		{Start: math.Inf(-1), End: 0, Count: 1},
+		{Start: 1, End: 3, Count: 2},
+		{Start: 3, End: 5, Count: 0},
+		{Start: 10, End: math.Inf(1), Count: 1},
+		{Start: math.Inf(-1), End: math.Inf(1), Count: 5},
+	})
+	require.Equal(t, int32(4), agg.SampleCount)
+	require.Equal(t, 0.0, agg.Minimum)
+	require.Equal(t, 10.0, agg.Maximum)
+	require.Equal(t, 14.0, agg.Sum)
+	// Infinite edges are clamped, so every bucket has a finite middle
+	require.Equal(t, []metrics.Bucket{
+		{Start: 0, End: 0, Count: 1},
+		{Start: 1, End: 3, Count: 2},
+		{Start: 10, End: 10, Count: 1},
+	}, agg.Buckets)
+}
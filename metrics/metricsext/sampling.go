@@ -0,0 +1,124 @@
+package metricsext
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// Units of the time series reported by collectors.  They match the unit names CloudWatch understands.
+const (
+	unitSeconds = "Seconds"
+	unitBytes   = "Bytes"
+	unitCount   = "Count"
+	unitNone    = "None"
+)
+
+// sampledSource is the state shared by collectors that sample values when they are flushed, like RuntimeCollector.
+// Counters are sampled as running totals and reported as how much they grew since the last flush, the same way
+// Registry.RegisterCallback reports counters.
+type sampledSource struct {
+	mu        sync.Mutex
+	lastFlush time.Time
+	// totals are kept by the identifier a counter was sampled as.  That may not be the identifier of its time series,
+	// when a registry redirects several into an overflow series.
+	totals   metrics.CounterTotals
+	metadata map[sampledMetadataKey]metrics.MetadataConstructor
+}
+
+type sampledMetadataKey struct {
+	unit   string
+	tsType metrics.TimeSeriesType
+}
+
+// sample is a single flush of a sampledSource.  Add values to it, then return its aggregations.
+type sample struct {
+	source     *sampledSource
+	registry   metrics.TimeSeriesSource
+	prefix     string
+	dimensions map[string]string
+	tw         metrics.TimeWindow
+	ret        []metrics.TimeSeriesAggregation
+}
+
+// start begins a flush at now.  It holds the source's lock until finish is called.
+func (s *sampledSource) start(registry metrics.TimeSeriesSource, prefix string, dimensions map[string]string, now time.Time) *sample {
+	s.mu.Lock()
+	start := s.lastFlush
+	if start.IsZero() {
+		start = now
+	}
+	s.lastFlush = now
+	return &sample{
+		source:     s,
+		registry:   registry,
+		prefix:     prefix,
+		dimensions: dimensions,
+		tw: metrics.TimeWindow{
+			Start:    start,
+			Duration: now.Sub(start),
+		},
+	}
+}
+
+// finish ends the flush and returns everything sampled.  Totals of counters that were not sampled are forgotten.
+func (s *sample) finish() []metrics.TimeSeriesAggregation {
+	s.source.totals.Prune()
+	s.source.mu.Unlock()
+	return s.ret
+}
+
+func (s *sample) identifier(name string, dimensions map[string]string) metrics.TimeSeriesIdentifier {
+	return metrics.TimeSeriesIdentifier{
+		MetricName: s.prefix + name,
+		Dimensions: mergeMapsFast(s.dimensions, dimensions),
+	}
+}
+
+func (s *sample) timeSeries(tsi metrics.TimeSeriesIdentifier, unit string, tsType metrics.TimeSeriesType) *metrics.TimeSeries {
+	key := sampledMetadataKey{unit: unit, tsType: tsType}
+	md, exists := s.source.metadata[key]
+	if !exists {
+		md = func(_ metrics.TimeSeriesIdentifier, tsm metrics.TimeSeriesMetadata) metrics.TimeSeriesMetadata {
+			if tsType != 0 {
+				tsm = tsm.WithValue(metrics.MetaDataTimeSeriesType, tsType)
+			}
+			return tsm.WithValue(metrics.MetaDataUnit, unit)
+		}
+		if s.source.metadata == nil {
+			s.source.metadata = make(map[sampledMetadataKey]metrics.MetadataConstructor)
+		}
+		s.source.metadata[key] = md
+	}
+	return s.registry.TimeSeries(tsi, md)
+}
+
+// gauge reports value as it is
+func (s *sample) gauge(name string, dimensions map[string]string, unit string, value float64) {
+	s.add(s.timeSeries(s.identifier(name, dimensions), unit, metrics.TSTypeGauge), SingleValue(value).Va)
+}
+
+// counter reports how much total grew since the last flush.  The first total sampled, or the first since a flush
+// that did not sample it, is only a baseline and reports nothing.  A total that went down is reported whole.
+func (s *sample) counter(name string, dimensions map[string]string, unit string, total float64) {
+	tsi := s.identifier(name, dimensions)
+	if delta, ok := s.source.totals.Delta(&tsi, total); ok {
+		s.add(s.timeSeries(tsi, unit, metrics.TSTypeCounter), SingleValue(delta).Va)
+	}
+}
+
+// distribution reports an aggregation of many values
+func (s *sample) distribution(name string, dimensions map[string]string, unit string, va metrics.ValueAggregation) {
+	s.add(s.timeSeries(s.identifier(name, dimensions), unit, 0), va)
+}
+
+func (s *sample) add(ts *metrics.TimeSeries, va metrics.ValueAggregation) {
+	s.ret = append(s.ret, metrics.TimeSeriesAggregation{
+		TS: ts,
+		Aggregation: metrics.TimeWindowAggregation{
+			Va: va,
+			Tw: s.tw,
+		},
+	})
+}
@@ -0,0 +1,196 @@
+package metricsext
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// ShardedValueAggregator is a thread safe ValueAggregator for values observed from many goroutines at once, without a
+// lock around it.  Observations are striped across shards updated with atomics, picked by a hash of the observing
+// goroutine, so goroutines running at the same time rarely touch the same memory.  The shards are merged on Aggregate.
+//
+// Aggregate is not a point in time snapshot: a value observed during Aggregate may be only partly counted.  Since
+// shards are not ordered against each other, FirstValue and LastValue are the first and last values of some shard.
+//
+// RollingAggregation locks around its aggregators, so this does not help inside one.  Set RollingAggregation.Shards
+// for contended time series instead.
+type ShardedValueAggregator struct {
+	// Shards is how many stripes to use.  Default is 4x runtime.GOMAXPROCS, so goroutines hashed to the same shard
+	// are unlikely to be running at once
+	Shards int
+	// BucketerFactory creates a bucketer for each shard.  Bucketers are not thread safe, so each shard locks around its
+	// own.  Optional
+	BucketerFactory func() metrics.Bucketer
+
+	setupOnce sync.Once
+	shards    []aggregatorShard
+}
+
+var _ metrics.ValueAggregator = &ShardedValueAggregator{}
+var _ metrics.Resetter = &ShardedValueAggregator{}
+
+// aggregatorShard is padded to its own cache lines so shards do not falsely share memory
+type aggregatorShard struct {
+	sampleCount uint64
+	// Floats are stored as math.Float64bits
+	sum       uint64
+	sumSquare uint64
+	minimum   uint64
+	maximum   uint64
+	first     uint64
+	last      uint64
+
+	// hasBucketer is set once, before the shard is used, so it can be read without the lock
+	hasBucketer bool
+	mu          sync.Mutex
+	bucketer    metrics.Bucketer
+
+	_ [64]byte
+}
+
+func (s *ShardedValueAggregator) setup() {
+	s.setupOnce.Do(func() {
+		numShards := s.Shards
+		if numShards <= 0 {
+			numShards = runtime.GOMAXPROCS(0) * 4
+		}
+		s.shards = make([]aggregatorShard, numShards)
+		for i := range s.shards {
+			s.shards[i].hasBucketer = s.BucketerFactory != nil
+			s.shards[i].reset(s.BucketerFactory)
+		}
+	})
+}
+
+// Observe adds a value to one of the shards
+func (s *ShardedValueAggregator) Observe(value float64) {
+	s.setup()
+	s.shards[goroutineHash()%uint64(len(s.shards))].observe(value)
+}
+
+// Aggregate merges every shard into one aggregation.  SampleCount stops at math.MaxInt32.
+func (s *ShardedValueAggregator) Aggregate() metrics.ValueAggregation {
+	s.setup()
+	var ret metrics.ValueAggregation
+	var count uint64
+	for i := range s.shards {
+		ret = ret.Union(s.shards[i].aggregate())
+		count += atomic.LoadUint64(&s.shards[i].sampleCount)
+	}
+	if ret.SampleCount != 0 {
+		ret.SampleCount = saturatingInt32(count)
+	}
+	return ret
+}
+
+// Reset forgets every observed value, so the aggregator can be reused.  Bucketers that are not a metrics.Resetter are
+// replaced with new ones from BucketerFactory.  Values observed during Reset may be partly kept.
+func (s *ShardedValueAggregator) Reset() {
+	s.setup()
+	for i := range s.shards {
+		s.shards[i].reset(s.BucketerFactory)
+	}
+}
+
+func (a *aggregatorShard) reset(bucketerFactory func() metrics.Bucketer) {
+	atomic.StoreUint64(&a.sampleCount, 0)
+	atomic.StoreUint64(&a.sum, 0)
+	atomic.StoreUint64(&a.sumSquare, 0)
+	atomic.StoreUint64(&a.minimum, math.Float64bits(math.Inf(1)))
+	atomic.StoreUint64(&a.maximum, math.Float64bits(math.Inf(-1)))
+	atomic.StoreUint64(&a.first, 0)
+	atomic.StoreUint64(&a.last, 0)
+	if bucketerFactory == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r, ok := a.bucketer.(metrics.Resetter); ok {
+		r.Reset()
+	} else {
+		a.bucketer = bucketerFactory()
+	}
+}
+
+func (a *aggregatorShard) observe(value float64) {
+	count := atomic.AddUint64(&a.sampleCount, 1)
+	if count == 1 {
+		atomic.StoreUint64(&a.first, math.Float64bits(value))
+	}
+	atomic.StoreUint64(&a.last, math.Float64bits(value))
+	atomicAddFloat(&a.sum, value)
+	atomicAddFloat(&a.sumSquare, value*value)
+	atomicReplaceFloat(&a.minimum, value, true)
+	atomicReplaceFloat(&a.maximum, value, false)
+	if a.hasBucketer {
+		a.mu.Lock()
+		a.bucketer.Observe(value)
+		a.mu.Unlock()
+	}
+}
+
+func (a *aggregatorShard) aggregate() metrics.ValueAggregation {
+	count := atomic.LoadUint64(&a.sampleCount)
+	if count == 0 {
+		return metrics.ValueAggregation{}
+	}
+	ret := metrics.ValueAggregation{
+		SampleCount: saturatingInt32(count),
+		Sum:         math.Float64frombits(atomic.LoadUint64(&a.sum)),
+		SumSquare:   math.Float64frombits(atomic.LoadUint64(&a.sumSquare)),
+		Minimum:     math.Float64frombits(atomic.LoadUint64(&a.minimum)),
+		Maximum:     math.Float64frombits(atomic.LoadUint64(&a.maximum)),
+		FirstValue:  math.Float64frombits(atomic.LoadUint64(&a.first)),
+		LastValue:   math.Float64frombits(atomic.LoadUint64(&a.last)),
+	}
+	if a.hasBucketer {
+		a.mu.Lock()
+		ret.Buckets = a.bucketer.Buckets()
+		a.mu.Unlock()
+	}
+	return ret
+}
+
+// saturatingInt32 converts count to an int32, stopping at math.MaxInt32 rather than wrapping around
+func saturatingInt32(count uint64) int32 {
+	if count > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(count)
+}
+
+// goroutineHash is a cheap hash of the calling goroutine.  Every goroutine has its own stack, so the address of a stack
+// variable identifies it.  Stacks can move as they grow, which only changes the shard a goroutine uses.
+func goroutineHash() uint64 {
+	var onStack byte
+	// Stacks are at least 2KB: drop the low bits that are the same for every goroutine, then mix
+	return (uint64(uintptr(unsafe.Pointer(&onStack))) >> 11) * 0x9E3779B97F4A7C15 >> 32
+}
+
+func atomicAddFloat(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// atomicReplaceFloat stores value if it is below (or, if !below, above) the current value
+func atomicReplaceFloat(addr *uint64, value float64, below bool) {
+	for {
+		old := atomic.LoadUint64(addr)
+		current := math.Float64frombits(old)
+		if (below && value >= current) || (!below && value <= current) {
+			return
+		}
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(value)) {
+			return
+		}
+	}
+}
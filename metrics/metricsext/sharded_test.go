@@ -0,0 +1,169 @@
+package metricsext
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedValueAggregator(t *testing.T) {
+	var empty ShardedValueAggregator
+	require.EqualValues(t, 0, empty.Aggregate().SampleCount)
+
+	s := ShardedValueAggregator{
+		Shards: 4,
+		BucketerFactory: func() metrics.Bucketer {
+			return &LinearBucketer{Width: 10}
+		},
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= 100; i++ {
+				s.Observe(float64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	agg := s.Aggregate()
+	require.EqualValues(t, 1600, agg.SampleCount)
+	require.Equal(t, 16*5050.0, agg.Sum)
+	require.Equal(t, 1.0, agg.Minimum)
+	require.Equal(t, 100.0, agg.Maximum)
+	require.InDelta(t, 50.5, agg.Mean(), 0.0001)
+	total := int32(0)
+	for _, b := range agg.Buckets {
+		total += b.Count
+	}
+	require.EqualValues(t, 1600, total)
+}
+
+func TestShardedValueAggregator_negative(t *testing.T) {
+	s := ShardedValueAggregator{Shards: 1}
+	s.Observe(-5)
+	s.Observe(-1)
+	agg := s.Aggregate()
+	require.Equal(t, -5.0, agg.Minimum)
+	require.Equal(t, -1.0, agg.Maximum)
+	require.Equal(t, -5.0, agg.FirstValue)
+	require.Equal(t, -1.0, agg.LastValue)
+	require.Equal(t, 26.0, agg.SumSquare)
+}
+
+func TestShardedValueAggregator_Reset(t *testing.T) {
+	s := ShardedValueAggregator{
+		Shards: 2,
+		BucketerFactory: func() metrics.Bucketer {
+			return &LinearBucketer{Width: 10}
+		},
+	}
+	s.Observe(5)
+	s.Observe(25)
+	s.Reset()
+	require.EqualValues(t, 0, s.Aggregate().SampleCount)
+	s.Observe(-3)
+	agg := s.Aggregate()
+	require.EqualValues(t, 1, agg.SampleCount)
+	require.Equal(t, -3.0, agg.Minimum)
+	require.Equal(t, -3.0, agg.Maximum)
+	require.Equal(t, -3.0, agg.Sum)
+	require.Equal(t, []metrics.Bucket{{Start: -10, End: 0, Count: 1}}, agg.Buckets)
+}
+
+func TestShardedValueAggregator_ResetConcurrently(t *testing.T) {
+	s := ShardedValueAggregator{
+		Shards: 2,
+		BucketerFactory: func() metrics.Bucketer {
+			// Not a Resetter, so Reset replaces it
+			return struct{ metrics.Bucketer }{&LinearBucketer{Width: 10}}
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Observe(float64(j))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		s.Reset()
+		s.Aggregate()
+	}
+	wg.Wait()
+}
+
+func TestShardedValueAggregator_saturates(t *testing.T) {
+	s := ShardedValueAggregator{Shards: 2}
+	s.Observe(1)
+	s.shards[0].sampleCount = math.MaxUint32 + 5
+	s.shards[1].sampleCount = math.MaxInt32
+	require.EqualValues(t, math.MaxInt32, s.shards[0].aggregate().SampleCount)
+	require.EqualValues(t, math.MaxInt32, s.Aggregate().SampleCount)
+}
+
+func TestRollingAggregation_shardedAggregator(t *testing.T) {
+	now := time.Now()
+	r := RollingAggregation{
+		Now: func() time.Time {
+			return now
+		},
+		AggregatorFactory: func() metrics.ValueAggregator {
+			return &ShardedValueAggregator{Shards: 2}
+		},
+	}
+	for i := 0; i < 3; i++ {
+		r.Observe(1)
+		r.Observe(2)
+		now = now.Add(time.Minute)
+		collected := r.CollectMetrics()
+		require.Len(t, collected, 1)
+		require.EqualValues(t, 2, collected[0].Va.SampleCount)
+		require.Equal(t, 3.0, collected[0].Va.Sum)
+	}
+}
+
+// mutexValueAggregator is the locking path RollingAggregation uses, for comparison
+type mutexValueAggregator struct {
+	mu  sync.Mutex
+	agg LocklessValueAggregator
+}
+
+func (m *mutexValueAggregator) Observe(value float64) {
+	m.mu.Lock()
+	m.agg.Observe(value)
+	m.mu.Unlock()
+}
+
+func (m *mutexValueAggregator) Aggregate() metrics.ValueAggregation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.agg.Aggregate()
+}
+
+func benchmarkParallelObserve(b *testing.B, agg metrics.ValueAggregator) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			agg.Observe(1)
+		}
+	})
+}
+
+// Compare these with -cpu 1,4,16 on a machine with that many CPUs.  Every CPU contends on the mutex, so its time per
+// observation grows with CPUs.
+func BenchmarkMutexValueAggregator_Parallel(b *testing.B) {
+	benchmarkParallelObserve(b, &mutexValueAggregator{})
+}
+
+func BenchmarkShardedValueAggregator_Parallel(b *testing.B) {
+	benchmarkParallelObserve(b, &ShardedValueAggregator{})
+}
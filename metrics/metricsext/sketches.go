@@ -0,0 +1,66 @@
+package metricsext
+
+import "github.com/cep21/gometrics/metrics"
+
+// TDigestAggregator observes values like LocklessValueAggregator and also records them into a t-digest (see
+// metrics.TDigest).  It is not thread safe.
+type TDigestAggregator struct {
+	// Compression of the digest.  Default is 100
+	Compression float64
+
+	values LocklessValueAggregator
+	digest *metrics.TDigest
+}
+
+var _ metrics.ValueAggregator = &TDigestAggregator{}
+
+// Observe adds a value to this aggregator
+func (t *TDigestAggregator) Observe(value float64) {
+	if t.digest == nil {
+		t.digest = &metrics.TDigest{
+			Compression: t.Compression,
+		}
+	}
+	t.values.Observe(value)
+	t.digest.Observe(value)
+}
+
+// Aggregate returns an aggregation of all observed values, including a copy of the digest
+func (t *TDigestAggregator) Aggregate() metrics.ValueAggregation {
+	ret := t.values.Aggregate()
+	ret.TDigest = t.digest.Copy()
+	return ret
+}
+
+// DDSketchAggregator observes values like LocklessValueAggregator and also records them into a DDSketch (see
+// metrics.DDSketch).  It is not thread safe.
+type DDSketchAggregator struct {
+	// RelativeAccuracy of the sketch.  Default is 0.01
+	RelativeAccuracy float64
+	// MaxBins of the sketch.  Default is 2048
+	MaxBins int32
+
+	values LocklessValueAggregator
+	sketch *metrics.DDSketch
+}
+
+var _ metrics.ValueAggregator = &DDSketchAggregator{}
+
+// Observe adds a value to this aggregator
+func (d *DDSketchAggregator) Observe(value float64) {
+	if d.sketch == nil {
+		d.sketch = &metrics.DDSketch{
+			RelativeAccuracy: d.RelativeAccuracy,
+			MaxBins:          d.MaxBins,
+		}
+	}
+	d.values.Observe(value)
+	d.sketch.Observe(value)
+}
+
+// Aggregate returns an aggregation of all observed values, including a copy of the sketch
+func (d *DDSketchAggregator) Aggregate() metrics.ValueAggregation {
+	ret := d.values.Aggregate()
+	ret.DDSketch = d.sketch.Copy()
+	return ret
+}
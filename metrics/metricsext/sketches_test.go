@@ -0,0 +1,45 @@
+package metricsext
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTDigestAggregator(t *testing.T) {
+	var empty TDigestAggregator
+	require.Nil(t, empty.Aggregate().TDigest)
+
+	d := TDigestAggregator{Compression: 50}
+	for i := 1; i <= 1000; i++ {
+		d.Observe(float64(i))
+	}
+	agg := d.Aggregate()
+	require.EqualValues(t, 1000, agg.SampleCount)
+	require.EqualValues(t, 1000, agg.TDigest.Count())
+	require.InDelta(t, 500, agg.Quantile(0.5), 10)
+	require.InDelta(t, 990, agg.Quantile(0.99), 2)
+
+	// The aggregation is a copy: more observations do not change it
+	d.Observe(5000)
+	require.EqualValues(t, 1000, agg.TDigest.Count())
+}
+
+func TestDDSketchAggregator(t *testing.T) {
+	var empty DDSketchAggregator
+	require.Nil(t, empty.Aggregate().DDSketch)
+
+	d := DDSketchAggregator{RelativeAccuracy: 0.02}
+	for i := 1; i <= 1000; i++ {
+		d.Observe(float64(i))
+	}
+	agg := d.Aggregate()
+	require.EqualValues(t, 1000, agg.SampleCount)
+	require.EqualValues(t, 1000, agg.DDSketch.Count())
+	require.InEpsilon(t, 500, agg.Quantile(0.5), 0.02)
+	require.InEpsilon(t, 990, agg.Quantile(0.99), 0.02)
+	require.NotEmpty(t, agg.Distribution())
+
+	d.Observe(5000)
+	require.EqualValues(t, 1000, agg.DDSketch.Count())
+}
@@ -0,0 +1,167 @@
+package metricsext
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// SlidingWindowAggregator aggregates the values observed over the last Window, for decisions made inside the process
+// like "p99 over the last 30 seconds".  Read it with Current.  The window slides in steps of Window/Steps: Current
+// covers the Steps-1 most recent complete steps plus the step in progress.  It is thread safe.
+//
+// As an Aggregator, CollectMetrics reports each complete step once, like RollingAggregation with a BucketSize of
+// Window/Steps.
+type SlidingWindowAggregator struct {
+	// AggregatorFactory creates the aggregator of each step.  Use one that tracks a distribution, like
+	// DDSketchAggregator, to read quantiles.  Default is LocklessValueAggregator
+	AggregatorFactory func() metrics.ValueAggregator
+	// Window is how far back Current looks.  Default is 1 minute
+	Window time.Duration
+	// Steps is how many pieces Window is split into.  More steps slide more smoothly.  Default is 6
+	Steps int
+	// Default is time.Now
+	Now func() time.Time
+
+	mu   sync.Mutex
+	ring []slidingStep
+	// pending are steps that left the window before they were collected
+	pending []metrics.TimeWindowAggregation
+}
+
+type slidingStep struct {
+	idx       int64
+	agg       metrics.ValueAggregator
+	used      bool
+	collected bool
+}
+
+var _ metrics.Aggregator = &SlidingWindowAggregator{}
+
+func (s *SlidingWindowAggregator) window() time.Duration {
+	if s.Window <= 0 {
+		return time.Minute
+	}
+	return s.Window
+}
+
+func (s *SlidingWindowAggregator) steps() int {
+	if s.Steps <= 0 {
+		return 6
+	}
+	return s.Steps
+}
+
+func (s *SlidingWindowAggregator) stepSize() time.Duration {
+	ret := s.window() / time.Duration(s.steps())
+	if ret <= 0 {
+		return 1
+	}
+	return ret
+}
+
+func (s *SlidingWindowAggregator) createValueAggregator() metrics.ValueAggregator {
+	if s.AggregatorFactory == nil {
+		return &LocklessValueAggregator{}
+	}
+	return s.AggregatorFactory()
+}
+
+func (s *SlidingWindowAggregator) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func (s *SlidingWindowAggregator) stepIndex(when time.Time) int64 {
+	return when.UnixNano() / s.stepSize().Nanoseconds()
+}
+
+// Observe adds value to the current step
+func (s *SlidingWindowAggregator) Observe(value float64) {
+	idx := s.stepIndex(s.now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ring == nil {
+		s.ring = make([]slidingStep, s.steps())
+	}
+	slot := idx % int64(len(s.ring))
+	if slot < 0 {
+		slot += int64(len(s.ring))
+	}
+	step := &s.ring[slot]
+	if step.used && step.idx != idx {
+		if step.idx > idx {
+			// The clock went back further than the window.  This value is too old to keep.
+			return
+		}
+		s.recycle(step)
+	}
+	if !step.used {
+		if step.agg == nil {
+			step.agg = s.createValueAggregator()
+		}
+		step.idx = idx
+		step.used = true
+		step.collected = false
+	}
+	step.agg.Observe(value)
+}
+
+// Current returns an aggregation of the values observed in the window
+func (s *SlidingWindowAggregator) Current() metrics.ValueAggregation {
+	idx := s.stepIndex(s.now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret metrics.ValueAggregation
+	for i := range s.ring {
+		step := &s.ring[i]
+		if step.used && step.idx <= idx && step.idx > idx-int64(len(s.ring)) {
+			ret = ret.Union(step.agg.Aggregate())
+		}
+	}
+	return ret
+}
+
+// CollectMetrics returns an aggregation of each complete step not yet collected
+func (s *SlidingWindowAggregator) CollectMetrics() []metrics.TimeWindowAggregation {
+	idx := s.stepIndex(s.now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := s.pending
+	s.pending = nil
+	for i := range s.ring {
+		step := &s.ring[i]
+		if step.used && !step.collected && step.idx < idx {
+			ret = append(ret, s.stepAggregation(step))
+			step.collected = true
+		}
+	}
+	return ret
+}
+
+// recycle frees a step that left the window, saving it for CollectMetrics if it was not collected yet.  Must be
+// called while holding the lock.
+func (s *SlidingWindowAggregator) recycle(step *slidingStep) {
+	if !step.collected {
+		s.pending = append(s.pending, s.stepAggregation(step))
+	}
+	step.used = false
+	if r, ok := resettable(step.agg); ok {
+		r.Reset()
+	} else {
+		step.agg = nil
+	}
+}
+
+func (s *SlidingWindowAggregator) stepAggregation(step *slidingStep) metrics.TimeWindowAggregation {
+	return metrics.TimeWindowAggregation{
+		Va: step.agg.Aggregate(),
+		Tw: metrics.TimeWindow{
+			Start:    time.Unix(0, step.idx*s.stepSize().Nanoseconds()),
+			Duration: s.stepSize(),
+		},
+	}
+}
@@ -0,0 +1,72 @@
+package metricsext
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindowAggregator(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := SlidingWindowAggregator{
+		Window: 30 * time.Second,
+		Steps:  3,
+		AggregatorFactory: func() metrics.ValueAggregator {
+			return &DDSketchAggregator{}
+		},
+		Now: func() time.Time {
+			return now
+		},
+	}
+	require.EqualValues(t, 0, s.Current().SampleCount)
+	// One value per second: 1, 2, 3 ... 60
+	for i := 1; i <= 60; i++ {
+		s.Observe(float64(i))
+		now = now.Add(time.Second)
+	}
+	now = now.Add(-time.Second)
+	// The window holds the last 2 complete steps (31-50) and the step in progress (51-60)
+	current := s.Current()
+	require.EqualValues(t, 30, current.SampleCount)
+	require.Equal(t, 31.0, current.Minimum)
+	require.InEpsilon(t, 59.5, current.Quantile(0.99), 0.02)
+
+	// Quiet time slides old values out
+	now = now.Add(30 * time.Second)
+	require.EqualValues(t, 0, s.Current().SampleCount)
+}
+
+func TestSlidingWindowAggregator_CollectMetrics(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := SlidingWindowAggregator{
+		Window: 30 * time.Second,
+		Steps:  3,
+		Now: func() time.Time {
+			return now
+		},
+	}
+	for i := 0; i < 60; i++ {
+		s.Observe(1)
+		now = now.Add(time.Second)
+	}
+	now = now.Add(-time.Second)
+	// Steps that left the window before collection are still reported, and the current step is not
+	collected := s.CollectMetrics()
+	require.Len(t, collected, 5)
+	total := int32(0)
+	for _, c := range collected {
+		require.Equal(t, 10*time.Second, c.Tw.Duration)
+		total += c.Va.SampleCount
+	}
+	require.EqualValues(t, 50, total)
+	require.Empty(t, s.CollectMetrics())
+	// Collecting does not change the window
+	require.EqualValues(t, 30, s.Current().SampleCount)
+
+	now = now.Add(10 * time.Second)
+	collected = s.CollectMetrics()
+	require.Len(t, collected, 1)
+	require.EqualValues(t, 10, collected[0].Va.SampleCount)
+}
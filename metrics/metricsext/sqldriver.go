@@ -0,0 +1,531 @@
+package metricsext
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// Dimensions reported by SQLMetrics
+const (
+	SQLOperationDimension = "operation"
+	SQLQueryDimension     = "query"
+)
+
+// Metric names reported by SQLMetrics, after Prefix
+const (
+	SQLConnect      = "connect"
+	SQLQuery        = "query"
+	SQLTransaction  = "transaction"
+	SQLOpen         = "connections.open"
+	SQLMaxOpen      = "connections.max_open"
+	SQLInUse        = "connections.in_use"
+	SQLIdle         = "connections.idle"
+	SQLWaitCount    = "connections.wait_count"
+	SQLWaitDuration = "connections.wait_duration"
+)
+
+// SQLUnnamedQuery is the query dimension of queries SQLMetrics.QueryName has no name for
+const SQLUnnamedQuery = "unnamed"
+
+// Values of the operation dimension reported by SQLMetrics
+const (
+	SQLOperationQuery    = "query"
+	SQLOperationExec     = "exec"
+	SQLOperationPrepare  = "prepare"
+	SQLOperationBegin    = "begin"
+	SQLOperationCommit   = "commit"
+	SQLOperationRollback = "rollback"
+)
+
+// SQLMetrics wraps database/sql drivers to report how long connecting, queries and transactions take, with a "result"
+// dimension of ResultSuccess or ResultFailure.  Queries have an operation dimension (SQLOperationQuery,
+// SQLOperationExec or SQLOperationPrepare) and transactions one of SQLOperationCommit, SQLOperationRollback or, if they
+// failed to start, SQLOperationBegin.  Query durations end when the driver returns rows, not when they are read.  Use
+// RegisterDBStats to report the connection pool, including how often and how long callers waited for a connection.
+//
+//	db := sql.OpenDB(sqlMetrics.WrapConnector(connector))
+type SQLMetrics struct {
+	Registry metrics.BaseRegistry
+
+	// Optional
+	// Prefix is put in front of every metric name.  Default is "sql."
+	Prefix string
+	// Dimensions are added to every time series
+	Dimensions map[string]string
+	// QueryName names a query for the query dimension, so queries can be told apart without putting SQL text, which
+	// may hold values, into dimensions.  Queries it returns "" for are SQLUnnamedQuery.  Default is no query dimension.
+	// QueryNameFromComment reads names from comments in the SQL.
+	QueryName func(query string) string
+	// Default is time.Now
+	Now func() time.Time
+
+	once         sync.Once
+	connects     vec
+	queries      vec
+	transactions vec
+}
+
+func (s *SQLMetrics) setup() {
+	s.once.Do(func() {
+		prefix := s.prefix()
+		a := s.Registry
+		if len(s.Dimensions) != 0 {
+			a = WithDimensions(a, s.Dimensions)
+		}
+		queryDimensions := []string{SQLOperationDimension}
+		if s.QueryName != nil {
+			queryDimensions = append(queryDimensions, SQLQueryDimension)
+		}
+		s.connects = newVec(a, prefix+SQLConnect, []string{"result"}, secondsMetadata, newDurationObserver)
+		s.queries = newVec(a, prefix+SQLQuery, append(queryDimensions, "result"), secondsMetadata, newDurationObserver)
+		s.transactions = newVec(a, prefix+SQLTransaction, []string{SQLOperationDimension, "result"}, secondsMetadata, newDurationObserver)
+	})
+}
+
+func (s *SQLMetrics) prefix() string {
+	if s.Prefix == "" {
+		return "sql."
+	}
+	return s.Prefix
+}
+
+func (s *SQLMetrics) now() time.Time {
+	return nowOrDefault(s.Now)
+}
+
+// observe reports the time since start to the durations of v, with values followed by the result of err as the values
+// of its dimensions.  v is one of the vectors made by setup.
+func (s *SQLMetrics) observe(v *vec, start time.Time, err error, values ...string) {
+	s.setup()
+	var buf [3]string
+	v.with(append(append(buf[:0], values...), resultOf(err))).(*DurationObserver).Observe(s.now().Sub(start))
+}
+
+// observeQuery reports a query run with operation.  driver.ErrSkip is not reported: database/sql tries again another
+// way.
+func (s *SQLMetrics) observeQuery(operation string, query string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	if s.QueryName == nil {
+		s.observe(&s.queries, start, err, operation)
+		return
+	}
+	name := s.QueryName(query)
+	if name == "" {
+		name = SQLUnnamedQuery
+	}
+	s.observe(&s.queries, start, err, operation, name)
+}
+
+// WrapConnector returns a connector that reports connections made by c, and everything done with them.  Use it with
+// sql.OpenDB.
+func (s *SQLMetrics) WrapConnector(c driver.Connector) driver.Connector {
+	return &sqlConnector{metrics: s, connector: c}
+}
+
+// WrapDriver returns a driver that reports connections opened by d, and everything done with them.  Register it with
+// sql.Register.
+func (s *SQLMetrics) WrapDriver(d driver.Driver) driver.Driver {
+	return &sqlDriver{metrics: s, driver: d}
+}
+
+// RegisterDBStats reports the connection pool of db as callbacks of r: open, in use and idle connections and the limit
+// of open connections as gauges, and how many times and how long callers waited for a connection as counters.  Call
+// the returned function to stop.
+func (s *SQLMetrics) RegisterDBStats(r metrics.CallbackRegistry, db *sql.DB) (unregister func()) {
+	stats := []struct {
+		name     string
+		tsType   metrics.TimeSeriesType
+		metadata metrics.MetadataConstructor
+		value    func(sql.DBStats) float64
+	}{
+		{
+			name:   SQLOpen,
+			tsType: metrics.TSTypeGauge,
+			value: func(st sql.DBStats) float64 {
+				return float64(st.OpenConnections)
+			},
+		},
+		{
+			name:   SQLMaxOpen,
+			tsType: metrics.TSTypeGauge,
+			value: func(st sql.DBStats) float64 {
+				return float64(st.MaxOpenConnections)
+			},
+		},
+		{
+			name:   SQLInUse,
+			tsType: metrics.TSTypeGauge,
+			value: func(st sql.DBStats) float64 {
+				return float64(st.InUse)
+			},
+		},
+		{
+			name:   SQLIdle,
+			tsType: metrics.TSTypeGauge,
+			value: func(st sql.DBStats) float64 {
+				return float64(st.Idle)
+			},
+		},
+		{
+			name:   SQLWaitCount,
+			tsType: metrics.TSTypeCounter,
+			value: func(st sql.DBStats) float64 {
+				return float64(st.WaitCount)
+			},
+		},
+		{
+			name:     SQLWaitDuration,
+			tsType:   metrics.TSTypeCounter,
+			metadata: secondsMetadata,
+			value: func(st sql.DBStats) float64 {
+				return st.WaitDuration.Seconds()
+			},
+		},
+	}
+	unregisters := make([]func(), 0, len(stats))
+	for _, stat := range stats {
+		stat := stat
+		unregisters = append(unregisters, r.RegisterCallback(s.prefix()+stat.name, stat.tsType, stat.metadata, func(report func(map[string]string, float64)) {
+			report(s.Dimensions, stat.value(db.Stats()))
+		}))
+	}
+	return func() {
+		for _, u := range unregisters {
+			u()
+		}
+	}
+}
+
+// QueryNameFromComment names queries by a comment in their SQL, either "-- name: GetUser" (as written by sqlc) or
+// "/* name: GetUser */".  Returns "" if the query has no name.
+func QueryNameFromComment(query string) string {
+	for _, start := range []string{"-- name:", "/* name:"} {
+		idx := strings.Index(query, start)
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(query[idx+len(start):])
+		if len(fields) == 0 || fields[0] == "*/" {
+			return ""
+		}
+		return strings.TrimSuffix(fields[0], "*/")
+	}
+	return ""
+}
+
+type sqlDriver struct {
+	metrics *SQLMetrics
+	driver  driver.Driver
+}
+
+var _ driver.DriverContext = &sqlDriver{}
+
+func (d *sqlDriver) Open(name string) (driver.Conn, error) {
+	start := d.metrics.now()
+	conn, err := d.driver.Open(name)
+	d.metrics.observe(&d.metrics.connects, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{metrics: d.metrics, conn: conn}, nil
+}
+
+func (d *sqlDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.driver.(driver.DriverContext); ok {
+		c, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlConnector{metrics: d.metrics, connector: c, driver: d}, nil
+	}
+	return &sqlConnector{metrics: d.metrics, connector: dsnConnector{name: name, driver: d.driver}, driver: d}, nil
+}
+
+// dsnConnector connects with a driver that has no connector of its own
+type dsnConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type sqlConnector struct {
+	metrics   *SQLMetrics
+	connector driver.Connector
+	// driver is the wrapped driver that made this connector, if any
+	driver driver.Driver
+}
+
+func (c *sqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := c.metrics.now()
+	conn, err := c.connector.Connect(ctx)
+	c.metrics.observe(&c.metrics.connects, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{metrics: c.metrics, conn: conn}, nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	if c.driver != nil {
+		return c.driver
+	}
+	return &sqlDriver{metrics: c.metrics, driver: c.connector.Driver()}
+}
+
+// sqlConn reports what is done with conn.  It implements every optional interface of driver.Conn, falling back the way
+// database/sql would when conn does not.
+type sqlConn struct {
+	metrics *SQLMetrics
+	conn    driver.Conn
+}
+
+var _ driver.Conn = &sqlConn{}
+var _ driver.ConnBeginTx = &sqlConn{}
+var _ driver.ConnPrepareContext = &sqlConn{}
+var _ driver.ExecerContext = &sqlConn{}
+var _ driver.QueryerContext = &sqlConn{}
+var _ driver.Pinger = &sqlConn{}
+var _ driver.SessionResetter = &sqlConn{}
+var _ driver.NamedValueChecker = &sqlConn{}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := c.metrics.now()
+	var stmt driver.Stmt
+	var err error
+	if cp, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = cp.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	c.metrics.observeQuery(SQLOperationPrepare, query, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{conn: c, stmt: stmt, query: query}, nil
+}
+
+func (c *sqlConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := c.metrics.now()
+	var tx driver.Tx
+	var err error
+	if cb, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = cb.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		err = errors.New("sql: driver does not support non-default transaction options")
+	} else {
+		tx, err = c.conn.Begin()
+	}
+	if err != nil {
+		c.metrics.observe(&c.metrics.transactions, start, err, SQLOperationBegin)
+		return nil, err
+	}
+	return &sqlTx{metrics: c.metrics, tx: tx, start: start}, nil
+}
+
+func (c *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := c.metrics.now()
+	var result driver.Result
+	var err error
+	switch conn := c.conn.(type) {
+	case driver.ExecerContext:
+		result, err = conn.ExecContext(ctx, query, args)
+	case driver.Execer:
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			result, err = conn.Exec(query, values)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.metrics.observeQuery(SQLOperationExec, query, start, err)
+	return result, err
+}
+
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := c.metrics.now()
+	var rows driver.Rows
+	var err error
+	switch conn := c.conn.(type) {
+	case driver.QueryerContext:
+		rows, err = conn.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = conn.Query(query, values)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.metrics.observeQuery(SQLOperationQuery, query, start, err)
+	return rows, err
+}
+
+func (c *sqlConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator
+func (c *sqlConn) IsValid() bool {
+	if v, ok := c.conn.(interface{ IsValid() bool }); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *sqlConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type sqlStmt struct {
+	conn  *sqlConn
+	stmt  driver.Stmt
+	query string
+}
+
+var _ driver.StmtExecContext = &sqlStmt{}
+var _ driver.StmtQueryContext = &sqlStmt{}
+var _ driver.NamedValueChecker = &sqlStmt{}
+var _ driver.ColumnConverter = &sqlStmt{}
+
+func (s *sqlStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *sqlStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesToNamedValues(args))
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesToNamedValues(args))
+}
+
+func (s *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := s.conn.metrics.now()
+	var result driver.Result
+	var err error
+	if se, ok := s.stmt.(driver.StmtExecContext); ok {
+		result, err = se.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			result, err = s.stmt.Exec(values)
+		}
+	}
+	s.conn.metrics.observeQuery(SQLOperationExec, s.query, start, err)
+	return result, err
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := s.conn.metrics.now()
+	var rows driver.Rows
+	var err error
+	if sq, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = sq.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = s.stmt.Query(values)
+		}
+	}
+	s.conn.metrics.observeQuery(SQLOperationQuery, s.query, start, err)
+	return rows, err
+}
+
+func (s *sqlStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+// ColumnConverter returns the statement's converter for argument idx.  Statements without one get
+// driver.DefaultParameterConverter, which is what database/sql uses for them.
+func (s *sqlStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// sqlTx reports how long a transaction took, from when it began until it was committed or rolled back
+type sqlTx struct {
+	metrics *SQLMetrics
+	tx      driver.Tx
+	start   time.Time
+}
+
+func (t *sqlTx) Commit() error {
+	err := t.tx.Commit()
+	t.metrics.observe(&t.metrics.transactions, t.start, err, SQLOperationCommit)
+	return err
+}
+
+func (t *sqlTx) Rollback() error {
+	err := t.tx.Rollback()
+	t.metrics.observe(&t.metrics.transactions, t.start, err, SQLOperationRollback)
+	return err
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	ret := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		ret[i] = arg.Value
+	}
+	return ret, nil
+}
+
+func valuesToNamedValues(args []driver.Value) []driver.NamedValue {
+	ret := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		ret[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return ret
+}
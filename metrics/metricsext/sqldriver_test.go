@@ -0,0 +1,314 @@
+package metricsext
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver is an in memory key/value store that understands two queries: "INSERT" with a key and value and "SELECT"
+// with a key.  Legacy drivers only implement the required parts of database/sql/driver.
+type fakeDriver struct {
+	legacy bool
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	if name == "fail" {
+		return nil, errors.New("unable to connect")
+	}
+	c := &fakeConn{driver: d}
+	if d.legacy {
+		return c, nil
+	}
+	return &fakeContextConn{fakeConn: c}, nil
+}
+
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) {
+	return d.Open("")
+}
+
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+func (d *fakeDriver) run(query string, args []driver.Value) (driver.Rows, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fields := strings.Fields(query)
+	switch fields[len(fields)-1] {
+	case "INSERT":
+		if d.values == nil {
+			d.values = make(map[string]string)
+		}
+		d.values[args[0].(string)] = args[1].(string)
+		return &fakeRows{}, nil
+	case "SELECT":
+		value, exists := d.values[args[0].(string)]
+		if !exists {
+			return &fakeRows{}, nil
+		}
+		return &fakeRows{values: []string{value}}, nil
+	}
+	return nil, errors.New("unknown query")
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{driver: c.driver, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeContextConn struct {
+	*fakeConn
+}
+
+func (c *fakeContextConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.driver.run(query, values); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeContextConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.driver.run(query, values)
+}
+
+type fakeStmt struct {
+	driver *fakeDriver
+	query  string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.driver.run(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.driver.run(s.query, args)
+}
+
+// ColumnConverter stores every argument as a string, so numbers can be keys and values
+func (s *fakeStmt) ColumnConverter(int) driver.ValueConverter {
+	return stringConverter{}
+}
+
+type stringConverter struct{}
+
+func (stringConverter) ConvertValue(v interface{}) (driver.Value, error) {
+	return fmt.Sprint(v), nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+func sqlSeries(reg *metrics.Registry, name string, dimensions map[string]string) *metrics.TimeSeries {
+	return requestSeries(reg, name, mergeMapsCopy(map[string]string{"db": "users"}, dimensions))
+}
+
+func TestSQLMetrics_connector(t *testing.T) {
+	reg := drainingRegistry()
+	m := &SQLMetrics{
+		Registry:   reg,
+		Dimensions: map[string]string{"db": "users"},
+		QueryName:  QueryNameFromComment,
+	}
+	db := sql.OpenDB(m.WrapConnector(&fakeDriver{}))
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	ctx := context.Background()
+	_, err := db.ExecContext(ctx, "-- name: InsertUser\nINSERT", "jack", "admin")
+	require.NoError(t, err)
+	var value string
+	require.NoError(t, db.QueryRowContext(ctx, "/* name: GetUser */ SELECT", "jack").Scan(&value))
+	require.Equal(t, "admin", value)
+	_, err = db.ExecContext(ctx, "DELETE")
+	require.Error(t, err)
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	tx, err = db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	require.EqualValues(t, 1, drain(t, reg, sqlSeries(reg, "sql.connect", map[string]string{"result": ResultSuccess})).SampleCount)
+	insert := sqlSeries(reg, "sql.query", map[string]string{"operation": "exec", "query": "InsertUser", "result": ResultSuccess})
+	require.Equal(t, "Seconds", insert.Tsm.Value(metrics.MetaDataUnit))
+	require.EqualValues(t, 1, drain(t, reg, insert).SampleCount)
+	require.EqualValues(t, 1, drain(t, reg, sqlSeries(reg, "sql.query", map[string]string{"operation": "query", "query": "GetUser", "result": ResultSuccess})).SampleCount)
+	require.EqualValues(t, 1, drain(t, reg, sqlSeries(reg, "sql.query", map[string]string{"operation": "exec", "query": SQLUnnamedQuery, "result": ResultFailure})).SampleCount)
+	require.EqualValues(t, 1, drain(t, reg, sqlSeries(reg, "sql.transaction", map[string]string{"operation": "commit", "result": ResultSuccess})).SampleCount)
+	require.EqualValues(t, 1, drain(t, reg, sqlSeries(reg, "sql.transaction", map[string]string{"operation": "rollback", "result": ResultSuccess})).SampleCount)
+}
+
+func TestSQLMetrics_driver(t *testing.T) {
+	reg := drainingRegistry()
+	m := &SQLMetrics{
+		Registry: reg,
+	}
+	sql.Register("metricsext-legacy", m.WrapDriver(&fakeDriver{legacy: true}))
+	db, err := sql.Open("metricsext-legacy", "")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	// The driver cannot run queries directly, so database/sql prepares them first
+	_, err = db.Exec("INSERT", "jack", "admin")
+	require.NoError(t, err)
+	var value string
+	require.NoError(t, db.QueryRow("SELECT", "jack").Scan(&value))
+	require.Equal(t, "admin", value)
+	_, err = db.Exec("INSERT", sql.Named("key", "jack"), "admin")
+	require.Error(t, err)
+	// The statement's column converter turns numbers into strings
+	_, err = db.Exec("INSERT", 7, 8)
+	require.NoError(t, err)
+	require.NoError(t, db.QueryRow("SELECT", "7").Scan(&value))
+	require.Equal(t, "8", value)
+
+	require.EqualValues(t, 5, drain(t, reg, requestSeries(reg, "sql.query", map[string]string{"operation": "prepare", "result": ResultSuccess})).SampleCount)
+	require.EqualValues(t, 2, drain(t, reg, requestSeries(reg, "sql.query", map[string]string{"operation": "exec", "result": ResultSuccess})).SampleCount)
+	require.EqualValues(t, 1, drain(t, reg, requestSeries(reg, "sql.query", map[string]string{"operation": "exec", "result": ResultFailure})).SampleCount)
+	require.EqualValues(t, 2, drain(t, reg, requestSeries(reg, "sql.query", map[string]string{"operation": "query", "result": ResultSuccess})).SampleCount)
+
+	failing, err := sql.Open("metricsext-legacy", "fail")
+	require.NoError(t, err)
+	require.Error(t, failing.Ping())
+	require.NoError(t, failing.Close())
+	require.EqualValues(t, 1, drain(t, reg, requestSeries(reg, "sql.connect", map[string]string{"result": ResultFailure})).SampleCount)
+}
+
+func TestSQLMetrics_RegisterDBStats(t *testing.T) {
+	reg := &metrics.Registry{}
+	m := &SQLMetrics{
+		Registry:   reg,
+		Dimensions: map[string]string{"db": "users"},
+	}
+	db := sql.OpenDB(m.WrapConnector(&fakeDriver{}))
+	db.SetMaxOpenConns(5)
+	require.NoError(t, db.Ping())
+	unregister := m.RegisterDBStats(reg, db)
+
+	flushed := make(map[string]metrics.TimeSeriesAggregation)
+	for _, agg := range reg.FlushMetrics() {
+		flushed[agg.TS.Tsi.MetricName] = agg
+	}
+	require.Equal(t, 1.0, flushed["sql."+SQLOpen].Aggregation.Va.Sum)
+	require.Equal(t, 5.0, flushed["sql."+SQLMaxOpen].Aggregation.Va.Sum)
+	require.Equal(t, 1.0, flushed["sql."+SQLIdle].Aggregation.Va.Sum)
+	require.Equal(t, 0.0, flushed["sql."+SQLInUse].Aggregation.Va.Sum)
+	require.Equal(t, metrics.TSTypeGauge, flushed["sql."+SQLOpen].TS.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	// The first flush is the baseline of counters, which report how much they grew from the second flush on
+	require.NotContains(t, flushed, "sql."+SQLWaitDuration)
+	for _, agg := range reg.FlushMetrics() {
+		flushed[agg.TS.Tsi.MetricName] = agg
+	}
+	waited := flushed["sql."+SQLWaitDuration]
+	require.Equal(t, 0.0, waited.Aggregation.Va.Sum)
+	require.Equal(t, metrics.TSTypeCounter, waited.TS.Tsm.Value(metrics.MetaDataTimeSeriesType))
+	require.Equal(t, "Seconds", waited.TS.Tsm.Value(metrics.MetaDataUnit))
+	require.Equal(t, map[string]string{"db": "users"}, waited.TS.Tsi.Dimensions)
+
+	unregister()
+	require.NoError(t, db.Close())
+	require.Empty(t, reg.FlushMetrics())
+}
+
+func TestSQLMetrics_RegisterDBStats_wrapped(t *testing.T) {
+	reg := &metrics.Registry{}
+	m := &SQLMetrics{
+		Registry: reg,
+	}
+	db := sql.OpenDB(m.WrapConnector(&fakeDriver{}))
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	unregister := m.RegisterDBStats(WithDimensions(reg, map[string]string{"db": "users"}).(metrics.CallbackRegistry), db)
+	defer unregister()
+	reg.FlushMetrics()
+	waited := flushedByName(reg.FlushMetrics())["sql."+SQLWaitDuration]
+	require.Equal(t, map[string]string{"db": "users"}, waited.TS.Tsi.Dimensions)
+	require.Equal(t, "Seconds", waited.TS.Tsm.Value(metrics.MetaDataUnit))
+	// Wrapping a registry that cannot run callbacks does not make one that claims to
+	_, ok := WithDimensions(struct{ metrics.BaseRegistry }{reg}, map[string]string{"db": "users"}).(metrics.CallbackRegistry)
+	require.False(t, ok)
+	_, ok = WithMetadata(WithDimensions(reg, map[string]string{"db": "users"}), gaugeMetadata).(metrics.CallbackRegistry)
+	require.True(t, ok)
+}
+
+func TestQueryNameFromComment(t *testing.T) {
+	require.Equal(t, "GetUser", QueryNameFromComment("-- name: GetUser :one\nSELECT * FROM users WHERE id = $1"))
+	require.Equal(t, "GetUser", QueryNameFromComment("/* name: GetUser */ SELECT 1"))
+	require.Equal(t, "GetUser", QueryNameFromComment("/* name:GetUser*/ SELECT 1"))
+	require.Equal(t, "", QueryNameFromComment("/* name: */ SELECT 1"))
+	require.Equal(t, "", QueryNameFromComment("SELECT 'jack'"))
+}
@@ -0,0 +1,253 @@
+package metricsext
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+// DeltaToCumulativeSink turns delta aggregations, which each cover one window, into cumulative aggregations that cover
+// everything since the series started, for consumers like Prometheus that expect monotonically increasing counters.
+// The TimeWindow of each output starts when the series was first seen.  A series whose SampleCount would no longer fit
+// in an int32 starts over with the delta that would overflow it, and that delta's start time, which consumers see as a
+// counter reset.  It is thread safe.
+type DeltaToCumulativeSink struct {
+	Sink metrics.AggregationSink
+
+	// Optional
+	// ShouldConvert picks the time series to convert.  Others are passed through unchanged.  Default is counters.
+	ShouldConvert func(ts *metrics.TimeSeries) bool
+	// StaleAfter forgets series not seen for this long.  If they come back, they start over with a new start time.
+	// Default (zero) is to never forget.
+	StaleAfter time.Duration
+	// Default is time.Now
+	Now func() time.Time
+
+	mu     sync.Mutex
+	series temporalityState
+}
+
+var _ metrics.AggregationSink = &DeltaToCumulativeSink{}
+
+// Aggregate adds each delta to the running total of its series and sends the totals to Sink
+func (d *DeltaToCumulativeSink) Aggregate(ctx context.Context, aggs []metrics.TimeSeriesAggregation) error {
+	now := nowOrDefault(d.Now)
+	ret := make([]metrics.TimeSeriesAggregation, 0, len(aggs))
+	d.mu.Lock()
+	d.series.expire(now, d.StaleAfter)
+	for _, agg := range aggs {
+		if !shouldConvert(d.ShouldConvert, agg.TS) {
+			ret = append(ret, agg)
+			continue
+		}
+		entry, exists := d.series.get(agg.TS, now)
+		if exists && !sampleCountOverflows(entry.last.Va, agg.Aggregation.Va) {
+			entry.last = entry.last.Union(agg.Aggregation)
+		} else {
+			entry.last = agg.Aggregation
+		}
+		ret = append(ret, metrics.TimeSeriesAggregation{
+			TS:          agg.TS,
+			Aggregation: entry.last,
+		})
+	}
+	d.mu.Unlock()
+	return d.Sink.Aggregate(ctx, ret)
+}
+
+// sampleCountOverflows is true if the union of a and b would count more samples than an int32 holds
+func sampleCountOverflows(a metrics.ValueAggregation, b metrics.ValueAggregation) bool {
+	return int64(a.SampleCount)+int64(b.SampleCount) > math.MaxInt32
+}
+
+// CumulativeToDeltaSink turns cumulative aggregations, which each cover everything since a series started, into delta
+// aggregations that cover only the time since the previous one.  An aggregation whose start time changed, or whose
+// SampleCount went down, is treated as a reset: the delta is everything counted since the reset.  Sums can go down
+// without a reset, since values can be negative.  The first aggregation of a series is passed on whole.  It is thread
+// safe.
+//
+// Counts, sums and buckets are subtracted.  Minimum, Maximum, FirstValue and LastValue cannot be, so they are taken from
+// the latest cumulative aggregation, and sketches are dropped.
+type CumulativeToDeltaSink struct {
+	Sink metrics.AggregationSink
+
+	// Optional
+	// ShouldConvert picks the time series to convert.  Others are passed through unchanged.  Default is counters.
+	ShouldConvert func(ts *metrics.TimeSeries) bool
+	// FromLastValue reads the running total from LastValue, for sources that observe a counter's total like a gauge.
+	// Each delta is then a single observation of the difference.  Default reads each input as a cumulative aggregation.
+	FromLastValue bool
+	// StaleAfter forgets series not seen for this long.  Default (zero) is to never forget.
+	StaleAfter time.Duration
+	// Default is time.Now
+	Now func() time.Time
+
+	mu     sync.Mutex
+	series temporalityState
+}
+
+var _ metrics.AggregationSink = &CumulativeToDeltaSink{}
+
+// Aggregate subtracts the previous total of each series and sends the differences to Sink.  Aggregations that do not
+// end after the previous one of their series are dropped as duplicates.
+func (c *CumulativeToDeltaSink) Aggregate(ctx context.Context, aggs []metrics.TimeSeriesAggregation) error {
+	now := nowOrDefault(c.Now)
+	ret := make([]metrics.TimeSeriesAggregation, 0, len(aggs))
+	c.mu.Lock()
+	c.series.expire(now, c.StaleAfter)
+	for _, agg := range aggs {
+		if !shouldConvert(c.ShouldConvert, agg.TS) {
+			ret = append(ret, agg)
+			continue
+		}
+		entry, exists := c.series.get(agg.TS, now)
+		cur := agg.Aggregation
+		if !exists {
+			entry.last = cur
+			ret = append(ret, c.firstDelta(agg))
+			continue
+		}
+		prev := entry.last
+		if !cur.Tw.End().After(prev.Tw.End()) {
+			continue
+		}
+		entry.last = cur
+		delta := metrics.TimeSeriesAggregation{
+			TS: agg.TS,
+			Aggregation: metrics.TimeWindowAggregation{
+				Tw: metrics.TimeWindow{
+					Start:    prev.Tw.End(),
+					Duration: cur.Tw.End().Sub(prev.Tw.End()),
+				},
+			},
+		}
+		switch {
+		case c.FromLastValue && cur.Va.LastValue < prev.Va.LastValue:
+			delta.Aggregation.Va = SingleValue(cur.Va.LastValue).Va
+		case c.FromLastValue:
+			delta.Aggregation.Va = SingleValue(cur.Va.LastValue - prev.Va.LastValue).Va
+		case isCounterReset(prev, cur):
+			delta.Aggregation = withoutSketches(cur)
+		default:
+			delta.Aggregation.Va = subtractAggregation(cur.Va, prev.Va)
+		}
+		ret = append(ret, delta)
+	}
+	c.mu.Unlock()
+	return c.Sink.Aggregate(ctx, ret)
+}
+
+func (c *CumulativeToDeltaSink) firstDelta(agg metrics.TimeSeriesAggregation) metrics.TimeSeriesAggregation {
+	if c.FromLastValue {
+		agg.Aggregation.Va = SingleValue(agg.Aggregation.Va.LastValue).Va
+		return agg
+	}
+	agg.Aggregation = withoutSketches(agg.Aggregation)
+	return agg
+}
+
+// isCounterReset is true if a cumulative aggregation started over since prev.  Cumulative aggregations only ever gain
+// samples, but their sum goes down whenever a negative value is observed, so the sum is no sign of a reset.
+func isCounterReset(prev metrics.TimeWindowAggregation, cur metrics.TimeWindowAggregation) bool {
+	return !cur.Tw.Start.Equal(prev.Tw.Start) || cur.Va.SampleCount < prev.Va.SampleCount
+}
+
+// subtractAggregation is the part of cumulative aggregation cur that is not in prev
+func subtractAggregation(cur metrics.ValueAggregation, prev metrics.ValueAggregation) metrics.ValueAggregation {
+	ret := metrics.ValueAggregation{
+		SampleCount: cur.SampleCount - prev.SampleCount,
+		Sum:         cur.Sum - prev.Sum,
+		SumSquare:   cur.SumSquare - prev.SumSquare,
+		Minimum:     cur.Minimum,
+		Maximum:     cur.Maximum,
+		FirstValue:  cur.FirstValue,
+		LastValue:   cur.LastValue,
+	}
+	for _, b := range cur.Buckets {
+		for _, p := range prev.Buckets {
+			if p.Start == b.Start && p.End == b.End {
+				b.Count -= p.Count
+				break
+			}
+		}
+		if b.Count > 0 {
+			ret.Buckets = append(ret.Buckets, b)
+		}
+	}
+	return ret
+}
+
+func withoutSketches(agg metrics.TimeWindowAggregation) metrics.TimeWindowAggregation {
+	agg.Va.ExponentialHistogram = nil
+	agg.Va.TDigest = nil
+	agg.Va.DDSketch = nil
+	return agg
+}
+
+func shouldConvert(f func(ts *metrics.TimeSeries) bool, ts *metrics.TimeSeries) bool {
+	if f != nil {
+		return f(ts)
+	}
+	return ts.Tsm.Value(metrics.MetaDataTimeSeriesType) == metrics.TSTypeCounter
+}
+
+func nowOrDefault(now func() time.Time) time.Time {
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
+
+// temporalityState is the last aggregation of each time series, keyed by identity.  It is not thread safe.
+type temporalityState struct {
+	entries map[uint64][]*temporalityEntry
+}
+
+type temporalityEntry struct {
+	tsi      metrics.TimeSeriesIdentifier
+	last     metrics.TimeWindowAggregation
+	lastSeen time.Time
+}
+
+// get returns the entry for ts, creating an empty one if it does not exist
+func (t *temporalityState) get(ts *metrics.TimeSeries, now time.Time) (*temporalityEntry, bool) {
+	hash := ts.Tsi.Hash()
+	for _, e := range t.entries[hash] {
+		if e.tsi.Equal(&ts.Tsi) {
+			e.lastSeen = now
+			return e, true
+		}
+	}
+	if t.entries == nil {
+		t.entries = make(map[uint64][]*temporalityEntry)
+	}
+	e := &temporalityEntry{
+		tsi:      ts.Tsi,
+		lastSeen: now,
+	}
+	t.entries[hash] = append(t.entries[hash], e)
+	return e, false
+}
+
+// expire removes entries not seen within staleAfter.  Zero staleAfter keeps everything.
+func (t *temporalityState) expire(now time.Time, staleAfter time.Duration) {
+	if staleAfter <= 0 {
+		return
+	}
+	for hash, entries := range t.entries {
+		kept := entries[:0]
+		for _, e := range entries {
+			if now.Sub(e.lastSeen) < staleAfter {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.entries, hash)
+		} else {
+			t.entries[hash] = kept
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package metricsext
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+type capturingSink struct {
+	aggs []metrics.TimeSeriesAggregation
+}
+
+func (c *capturingSink) Aggregate(_ context.Context, aggs []metrics.TimeSeriesAggregation) error {
+	c.aggs = append(c.aggs, aggs...)
+	return nil
+}
+
+func counterSeries(name string) *metrics.TimeSeries {
+	return &metrics.TimeSeries{
+		Tsi: metrics.TimeSeriesIdentifier{MetricName: name},
+		Tsm: counterMetadata(metrics.TimeSeriesIdentifier{}, nil),
+	}
+}
+
+func windowOf(start int64, duration time.Duration, values ...float64) metrics.TimeWindowAggregation {
+	var agg LocklessValueAggregator
+	for _, v := range values {
+		agg.Observe(v)
+	}
+	return metrics.TimeWindowAggregation{
+		Va: agg.Aggregate(),
+		Tw: metrics.TimeWindow{
+			Start:    time.Unix(start, 0),
+			Duration: duration,
+		},
+	}
+}
+
+func TestDeltaToCumulativeSink(t *testing.T) {
+	var out capturingSink
+	now := time.Unix(0, 0)
+	d := DeltaToCumulativeSink{
+		Sink:       &out,
+		StaleAfter: time.Hour,
+		Now: func() time.Time {
+			return now
+		},
+	}
+	counter := counterSeries("requests")
+	gauge := &metrics.TimeSeries{Tsi: metrics.TimeSeriesIdentifier{MetricName: "temperature"}}
+	ctx := context.Background()
+	require.NoError(t, d.Aggregate(ctx, []metrics.TimeSeriesAggregation{
+		{TS: counter, Aggregation: windowOf(0, time.Minute, 1, 1)},
+		{TS: gauge, Aggregation: windowOf(0, time.Minute, 70)},
+	}))
+	// A different *TimeSeries with the same identity shares state
+	require.NoError(t, d.Aggregate(ctx, []metrics.TimeSeriesAggregation{
+		{TS: counterSeries("requests"), Aggregation: windowOf(60, time.Minute, 1, 1, 1)},
+		{TS: gauge, Aggregation: windowOf(60, time.Minute, 71)},
+	}))
+	require.Len(t, out.aggs, 4)
+	require.Equal(t, 5.0, out.aggs[2].Aggregation.Va.Sum)
+	require.Equal(t, time.Unix(0, 0), out.aggs[2].Aggregation.Tw.Start)
+	require.Equal(t, 2*time.Minute, out.aggs[2].Aggregation.Tw.Duration)
+	require.Equal(t, 71.0, out.aggs[3].Aggregation.Va.Sum)
+
+	// Stale series start over
+	now = now.Add(2 * time.Hour)
+	out.aggs = nil
+	require.NoError(t, d.Aggregate(ctx, []metrics.TimeSeriesAggregation{
+		{TS: counter, Aggregation: windowOf(7200, time.Minute, 1)},
+	}))
+	require.Equal(t, 1.0, out.aggs[0].Aggregation.Va.Sum)
+	require.Equal(t, time.Unix(7200, 0), out.aggs[0].Aggregation.Tw.Start)
+}
+
+func TestDeltaToCumulativeSink_sampleCountOverflow(t *testing.T) {
+	var cumulative capturingSink
+	var deltas capturingSink
+	d := DeltaToCumulativeSink{
+		Sink: &cumulative,
+	}
+	c := CumulativeToDeltaSink{
+		Sink: &deltas,
+	}
+	counter := counterSeries("requests")
+	busy := windowOf(0, time.Minute, 1)
+	busy.Va.SampleCount = math.MaxInt32 - 1
+	for i, agg := range []metrics.TimeWindowAggregation{busy, windowOf(60, time.Minute, 1, 1), windowOf(120, time.Minute, 1)} {
+		require.NoError(t, d.Aggregate(context.Background(), []metrics.TimeSeriesAggregation{{TS: counter, Aggregation: agg}}))
+		require.NoError(t, c.Aggregate(context.Background(), cumulative.aggs[i:]))
+	}
+	// The second delta would overflow the count, so the series starts over from it
+	require.EqualValues(t, 2, cumulative.aggs[1].Aggregation.Va.SampleCount)
+	require.Equal(t, time.Unix(60, 0), cumulative.aggs[1].Aggregation.Tw.Start)
+	require.EqualValues(t, 3, cumulative.aggs[2].Aggregation.Va.SampleCount)
+	require.Equal(t, time.Unix(60, 0), cumulative.aggs[2].Aggregation.Tw.Start)
+	// Converting back sees a reset, and gets every delta as it was
+	require.Len(t, deltas.aggs, 3)
+	for i, want := range []int32{math.MaxInt32 - 1, 2, 1} {
+		require.Equal(t, want, deltas.aggs[i].Aggregation.Va.SampleCount, i)
+	}
+}
+
+func TestCumulativeToDeltaSink(t *testing.T) {
+	var out capturingSink
+	c := CumulativeToDeltaSink{
+		Sink: &out,
+	}
+	counter := counterSeries("requests")
+	ctx := context.Background()
+	send := func(aggs ...metrics.TimeWindowAggregation) {
+		out.aggs = nil
+		for _, agg := range aggs {
+			require.NoError(t, c.Aggregate(ctx, []metrics.TimeSeriesAggregation{{TS: counter, Aggregation: agg}}))
+		}
+	}
+	first := windowOf(0, time.Minute, 1, 2)
+	first.Va.Buckets = []metrics.Bucket{{Start: 0, End: 10, Count: 2}}
+	second := windowOf(0, 2*time.Minute, 1, 2, 3, 4)
+	second.Va.Buckets = []metrics.Bucket{{Start: 0, End: 10, Count: 3}, {Start: 10, End: 20, Count: 1}}
+	send(first, second, second)
+	// The duplicate is dropped
+	require.Len(t, out.aggs, 2)
+	require.Equal(t, first, out.aggs[0].Aggregation)
+	delta := out.aggs[1].Aggregation
+	require.EqualValues(t, 2, delta.Va.SampleCount)
+	require.Equal(t, 7.0, delta.Va.Sum)
+	require.Equal(t, 25.0, delta.Va.SumSquare)
+	require.Equal(t, []metrics.Bucket{{Start: 0, End: 10, Count: 1}, {Start: 10, End: 20, Count: 1}}, delta.Va.Buckets)
+	require.Equal(t, time.Unix(60, 0), delta.Tw.Start)
+	require.Equal(t, time.Minute, delta.Tw.Duration)
+
+	// The source restarted: its start time moved, so the delta is everything since the restart
+	restarted := windowOf(150, 30*time.Second, 5)
+	send(restarted)
+	require.Len(t, out.aggs, 1)
+	require.Equal(t, restarted, out.aggs[0].Aggregation)
+}
+
+func TestCumulativeToDeltaSink_negativeValues(t *testing.T) {
+	var out capturingSink
+	c := CumulativeToDeltaSink{
+		Sink: &out,
+	}
+	balance := counterSeries("balance_change")
+	for _, agg := range []metrics.TimeWindowAggregation{
+		windowOf(0, time.Minute, 5),
+		windowOf(0, 2*time.Minute, 5, -8),
+	} {
+		require.NoError(t, c.Aggregate(context.Background(), []metrics.TimeSeriesAggregation{{TS: balance, Aggregation: agg}}))
+	}
+	require.Len(t, out.aggs, 2)
+	// The sum went down, but a sample was added: not a reset
+	delta := out.aggs[1].Aggregation
+	require.EqualValues(t, 1, delta.Va.SampleCount)
+	require.Equal(t, -8.0, delta.Va.Sum)
+	require.Equal(t, time.Unix(60, 0), delta.Tw.Start)
+}
+
+func TestCumulativeToDeltaSink_FromLastValue(t *testing.T) {
+	var out capturingSink
+	c := CumulativeToDeltaSink{
+		Sink:          &out,
+		FromLastValue: true,
+		ShouldConvert: func(ts *metrics.TimeSeries) bool {
+			return ts.Tsi.MetricName == "cpu_seconds"
+		},
+	}
+	ts := &metrics.TimeSeries{Tsi: metrics.TimeSeriesIdentifier{MetricName: "cpu_seconds"}}
+	for i, total := range []float64{10, 12, 12, 3} {
+		require.NoError(t, c.Aggregate(context.Background(), []metrics.TimeSeriesAggregation{
+			{TS: ts, Aggregation: windowOf(int64(i*60), time.Minute, total)},
+		}))
+	}
+	require.Len(t, out.aggs, 4)
+	for i, want := range []float64{10, 2, 0, 3} {
+		require.EqualValues(t, 1, out.aggs[i].Aggregation.Va.SampleCount)
+		require.Equal(t, want, out.aggs[i].Aggregation.Va.Sum)
+	}
+}
@@ -0,0 +1,131 @@
+package metricsext
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+)
+
+const (
+	// ResultSuccess is the result dimension value of calls that returned no error
+	ResultSuccess = "success"
+	// ResultFailure is the result dimension value of calls that returned an error
+	ResultFailure = "failure"
+)
+
+// Timer is one measurement of a DurationObserver, started by DurationObserver.Start
+type Timer struct {
+	observer *DurationObserver
+	start    time.Time
+}
+
+// Start begins a measurement.  Stop it, usually with defer, to report how long it took:
+//
+//	defer obs.Start().Stop()
+func (t *DurationObserver) Start() Timer {
+	return Timer{
+		observer: t,
+		start:    t.now(),
+	}
+}
+
+// Time runs f and reports how long it took
+func (t *DurationObserver) Time(f func()) {
+	defer t.Start().Stop()
+	f()
+}
+
+func (t *DurationObserver) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+// Stop reports the time since Start and returns it
+func (t Timer) Stop() time.Duration {
+	took := t.observer.now().Sub(t.start)
+	t.observer.Observe(took)
+	return took
+}
+
+// ResultTimer times functions that can fail, reporting their durations to a time series with a result dimension of
+// ResultSuccess or ResultFailure.  Time series are resolved on first use.
+type ResultTimer struct {
+	Registry   metrics.BaseRegistry
+	MetricName string
+	Dimensions map[string]string
+
+	// Optional
+	// ResultDimension is the name of the dimension holding the result.  Default is "result"
+	ResultDimension string
+	// Default is time.Now
+	Now func() time.Time
+
+	once    sync.Once
+	success *DurationObserver
+	failure *DurationObserver
+}
+
+func (r *ResultTimer) setup() {
+	r.once.Do(func() {
+		r.success = r.observer(ResultSuccess)
+		r.failure = r.observer(ResultFailure)
+	})
+}
+
+func (r *ResultTimer) observer(result string) *DurationObserver {
+	dimension := r.ResultDimension
+	if dimension == "" {
+		dimension = "result"
+	}
+	ret := Duration(r.Registry, r.MetricName, mergeMapsFast(r.Dimensions, map[string]string{dimension: result}))
+	ret.Now = r.Now
+	return ret
+}
+
+// Time runs f and reports how long it took, as a success if f returns nil and a failure otherwise.  If f panics, it is
+// reported as a failure before the panic continues.  Returns the error of f.
+func (r *ResultTimer) Time(f func() error) error {
+	r.setup()
+	return r.time(f, func(result string) *DurationObserver {
+		if result == ResultSuccess {
+			return r.success
+		}
+		return r.failure
+	})
+}
+
+// time runs f and reports how long it took to the observer for its result
+func (r *ResultTimer) time(f func() error, observer func(result string) *DurationObserver) error {
+	start := nowOrDefault(r.Now)
+	// Stays a failure if f panics
+	result := ResultFailure
+	defer func() {
+		observer(result).Observe(nowOrDefault(r.Now).Sub(start))
+	}()
+	err := f()
+	result = resultOf(err)
+	return err
+}
+
+// TimeFunc runs f and reports how long it took to metricName, like a ResultTimer with default options, but resolves
+// only the time series of f's result.  Returns the error of f.  Use a ResultTimer to resolve the time series once on
+// hot code paths, or to set the clock or result dimension.
+func TimeFunc(a metrics.BaseRegistry, metricName string, dimensions map[string]string, f func() error) error {
+	r := &ResultTimer{
+		Registry:   a,
+		MetricName: metricName,
+		Dimensions: dimensions,
+	}
+	return r.time(f, r.observer)
+}
+
+// resultOf is the result dimension value of a call that returned err
+func resultOf(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
@@ -0,0 +1,102 @@
+package metricsext
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cep21/gometrics/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationObserver_Start(t *testing.T) {
+	reg := drainingRegistry()
+	now := time.Unix(0, 0)
+	obs := Duration(reg, "took", nil)
+	obs.Now = func() time.Time {
+		return now
+	}
+	func() {
+		defer obs.Start().Stop()
+		now = now.Add(2 * time.Second)
+	}()
+	obs.Time(func() {
+		now = now.Add(time.Second)
+	})
+	ts := reg.TimeSeries(metrics.TimeSeriesIdentifier{MetricName: "took", Dimensions: nil}, nil)
+	va := drain(t, reg, ts)
+	require.EqualValues(t, 2, va.SampleCount)
+	require.Equal(t, 3.0, va.Sum)
+	require.Equal(t, 2.0, va.Maximum)
+}
+
+func TestResultTimer(t *testing.T) {
+	reg := drainingRegistry()
+	now := time.Unix(0, 0)
+	r := ResultTimer{
+		Registry:   reg,
+		MetricName: "call",
+		Dimensions: map[string]string{"api": "get"},
+		Now: func() time.Time {
+			return now
+		},
+	}
+	failed := errors.New("failed")
+	require.NoError(t, r.Time(func() error {
+		now = now.Add(time.Second)
+		return nil
+	}))
+	require.Equal(t, failed, r.Time(func() error {
+		now = now.Add(5 * time.Second)
+		return failed
+	}))
+	success := drain(t, reg, reg.TimeSeries(metrics.TimeSeriesIdentifier{MetricName: "call", Dimensions: map[string]string{"api": "get", "result": ResultSuccess}}, nil))
+	require.Equal(t, 1.0, success.Sum)
+	failure := drain(t, reg, reg.TimeSeries(metrics.TimeSeriesIdentifier{MetricName: "call", Dimensions: map[string]string{"api": "get", "result": ResultFailure}}, nil))
+	require.Equal(t, 5.0, failure.Sum)
+
+	require.Equal(t, failed, TimeFunc(reg, "call", nil, func() error {
+		return failed
+	}))
+	require.EqualValues(t, 1, drain(t, reg, reg.TimeSeries(metrics.TimeSeriesIdentifier{MetricName: "call", Dimensions: map[string]string{"result": ResultFailure}}, nil)).SampleCount)
+}
+
+func TestResultTimer_ResultDimension(t *testing.T) {
+	reg := drainingRegistry()
+	now := time.Unix(0, 0)
+	r := ResultTimer{
+		Registry:        reg,
+		MetricName:      "call",
+		ResultDimension: "outcome",
+		Now: func() time.Time {
+			return now
+		},
+	}
+	require.NoError(t, r.Time(func() error {
+		now = now.Add(3 * time.Second)
+		return nil
+	}))
+	va := drain(t, reg, reg.TimeSeries(metrics.TimeSeriesIdentifier{MetricName: "call", Dimensions: map[string]string{"outcome": ResultSuccess}}, nil))
+	require.Equal(t, 3.0, va.Sum)
+}
+
+func TestResultTimer_panic(t *testing.T) {
+	reg := drainingRegistry()
+	now := time.Unix(0, 0)
+	r := ResultTimer{
+		Registry:   reg,
+		MetricName: "call",
+		Now: func() time.Time {
+			return now
+		},
+	}
+	require.Panics(t, func() {
+		_ = r.Time(func() error {
+			now = now.Add(2 * time.Second)
+			panic("boom")
+		})
+	})
+	va := drain(t, reg, reg.TimeSeries(metrics.TimeSeriesIdentifier{MetricName: "call", Dimensions: map[string]string{"result": ResultFailure}}, nil))
+	require.EqualValues(t, 1, va.SampleCount)
+	require.Equal(t, 2.0, va.Sum)
+}
@@ -0,0 +1,543 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowDimension is the dimension key of the overflow series.  Time series created past a registry's cardinality
+// limits are redirected to a series with the same metric name and the single dimension OverflowDimension=true.
+const OverflowDimension = "overflow"
+
+// OverflowedMetricName is the counter a Registry flushes with how many TimeSeries calls were redirected to an overflow
+// series since the last flush, with the metric that overflowed as OverflowedMetricDimension.  It is flushed for a
+// metric at every FlushMetrics once that metric has overflowed.
+const OverflowedMetricName = "registry.overflowed"
+
+// OverflowedMetricDimension is the dimension of OverflowedMetricName holding the name of the metric that overflowed
+const OverflowedMetricDimension = "metric"
+
+// registryShardCount is how many independently locked shards a Registry splits its time series across.  Should be a
+// power of two.
+const registryShardCount = 64
+
+// Registry is the default implementation of BaseRegistry.  It deduplicates time series by their identifier and can
+// flush every collector it has created as an AggregationSource.  It is thread safe and the zero value is ready to use.
+type Registry struct {
+	// AggregationConstructor creates the aggregator returned by Observer for new time series.  The default drops
+	// every value.
+	AggregationConstructor AggregationConstructor
+
+	// Optional
+	// IdleTTL evicts time series (and their collectors) that have not been looked up with TimeSeries, observed a value
+	// or flushed any samples for this long.  Expiry is checked during FlushMetrics.  Default (zero) is to never evict.
+	// Set before using the registry.  An observer handed out before its time series was evicted puts the time series
+	// back the next time it observes a value, so nothing it observes is lost.
+	IdleTTL time.Duration
+	// OnEvict is called with each time series removed for being idle
+	OnEvict func(ts *TimeSeries)
+	// Default is time.Now
+	Now func() time.Time
+	// MaxSeriesPerMetric limits how many distinct time series can exist for a single MetricName.  New time series past
+	// this limit are redirected to the metric's overflow series (see OverflowDimension).  Default (zero) is no limit.
+	MaxSeriesPerMetric int
+	// MaxSeries limits how many distinct time series the registry will hold in total.  New time series past this limit
+	// are redirected to their metric's overflow series.  Default (zero) is no limit.
+	MaxSeries int
+
+	shards [registryShardCount]registryShard
+
+	// overflowed is the number of TimeSeries calls redirected to an overflow series (atomic)
+	overflowed int64
+
+	overflowedMu sync.Mutex
+	// overflowedMetrics counts overflows of each metric, for OverflowedMetricName
+	overflowedMetrics map[string]*overflowedMetric
+
+	limitsMu        sync.Mutex
+	seriesCount     int
+	seriesPerMetric map[string]int
+
+	callbacksMu sync.Mutex
+	callbacks   map[*registeredCallback]struct{}
+}
+
+type registryShard struct {
+	mu sync.RWMutex
+	// entries are keyed by TimeSeriesIdentifier.Hash.  Identifiers that collide share a slice.
+	entries map[uint64][]*registryEntry
+}
+
+// registryEntry is a single time series tracked by the registry and the collector, if any, that reports its values
+type registryEntry struct {
+	ts        *TimeSeries
+	hash      uint64
+	collector MetricCollector
+	// observer is collector wrapped to track activity.  Only set when the registry has an IdleTTL.
+	observer Observer
+
+	// observed is set (atomically) to 1 when the entry is looked up or a value is observed, and reset by FlushMetrics
+	observed int32
+	// evicted is set (atomically) to 1 while the entry is not in the registry because it was idle
+	evicted int32
+	// lastActive is the unix nano time of the last flush that saw activity (atomic)
+	lastActive int64
+	// limited is true if this entry counts against the registry's cardinality limits.  When the registry has limits,
+	// only the overflow series it creates itself (see overflowSeries) do not.
+	limited bool
+}
+
+// markActive keeps the entry from being evicted at the next FlushMetrics
+func (e *registryEntry) markActive() {
+	if atomic.LoadInt32(&e.observed) == 0 {
+		atomic.StoreInt32(&e.observed, 1)
+	}
+}
+
+// activityObserver marks its entry as active on every observation, and puts the entry back into the registry if it was
+// evicted
+type activityObserver struct {
+	Observer
+	registry *Registry
+	entry    *registryEntry
+}
+
+// target returns the observer values should go to
+func (a *activityObserver) target() Observer {
+	if atomic.LoadInt32(&a.entry.evicted) != 0 {
+		if replacement := a.registry.restore(a.entry); replacement != nil {
+			return replacement
+		}
+	}
+	a.entry.markActive()
+	return a.Observer
+}
+
+// Evicted returns true if the entry is not in the registry
+func (a *activityObserver) Evicted() bool {
+	return atomic.LoadInt32(&a.entry.evicted) != 0
+}
+
+func (a *activityObserver) Observe(value float64) {
+	a.target().Observe(value)
+}
+
+func (a *activityObserver) ObserveExemplar(value float64, exemplar Exemplar) {
+	target := a.target()
+	if eo, ok := target.(ExemplarObserver); ok {
+		eo.ObserveExemplar(value, exemplar)
+		return
+	}
+	target.Observe(value)
+}
+
+var _ BaseRegistry = &Registry{}
+var _ EvictableObserver = &activityObserver{}
+var _ AggregationSource = &Registry{}
+
+// TimeSeries returns the unique time series for an identifier.  metadata is only called the first time the identifier
+// is seen.  If creating the time series would exceed MaxSeriesPerMetric or MaxSeries, the metric's overflow series
+// is returned instead.
+func (r *Registry) TimeSeries(tsi TimeSeriesIdentifier, metadata MetadataConstructor) *TimeSeries {
+	h := tsi.Hash()
+	shard := r.shard(h)
+	shard.mu.RLock()
+	entry := shard.find(h, &tsi)
+	shard.mu.RUnlock()
+	if entry != nil {
+		r.lookedUp(entry)
+		return entry.ts
+	}
+
+	shard.mu.Lock()
+	if entry := shard.find(h, &tsi); entry != nil {
+		shard.mu.Unlock()
+		r.lookedUp(entry)
+		return entry.ts
+	}
+	limited := r.hasLimits()
+	if limited && !r.reserveSeries(tsi.MetricName) {
+		shard.mu.Unlock()
+		r.countOverflow(tsi.MetricName)
+		return r.overflowSeries(tsi.MetricName, metadata)
+	}
+	ts := newTimeSeries(tsi, h, metadata)
+	entry = r.newEntry(ts, h)
+	entry.limited = limited
+	shard.add(entry)
+	shard.mu.Unlock()
+	return ts
+}
+
+// overflowSeries returns the overflow series of a metric.  It does not count against the registry's limits.
+func (r *Registry) overflowSeries(metricName string, metadata MetadataConstructor) *TimeSeries {
+	tsi := overflowIdentifier(metricName)
+	h := tsi.Hash()
+	shard := r.shard(h)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry := shard.find(h, &tsi); entry != nil {
+		r.lookedUp(entry)
+		return entry.ts
+	}
+	ts := newTimeSeries(tsi, h, metadata)
+	shard.add(r.newEntry(ts, h))
+	return ts
+}
+
+// lookedUp counts looking up an entry as activity, so time series that are only used through TimeSeries (like the
+// ones collectors report during their own flush) are not evicted while in use
+func (r *Registry) lookedUp(entry *registryEntry) {
+	if r.IdleTTL > 0 {
+		entry.markActive()
+	}
+}
+
+// Overflowed returns how many TimeSeries calls have been redirected to an overflow series because of
+// MaxSeriesPerMetric or MaxSeries.  FlushMetrics also reports it, as the counter OverflowedMetricName.
+func (r *Registry) Overflowed() int64 {
+	return atomic.LoadInt64(&r.overflowed)
+}
+
+// overflowedMetric counts the TimeSeries calls of one metric redirected to its overflow series
+type overflowedMetric struct {
+	ts        *TimeSeries
+	total     int64
+	reported  int64
+	collected time.Time
+}
+
+func (r *Registry) countOverflow(metricName string) {
+	atomic.AddInt64(&r.overflowed, 1)
+	r.overflowedMu.Lock()
+	defer r.overflowedMu.Unlock()
+	om, exists := r.overflowedMetrics[metricName]
+	if !exists {
+		tsi := TimeSeriesIdentifier{
+			MetricName: OverflowedMetricName,
+			Dimensions: map[string]string{OverflowedMetricDimension: metricName},
+		}
+		om = &overflowedMetric{
+			ts: newTimeSeries(tsi, tsi.Hash(), func(_ TimeSeriesIdentifier, tsm TimeSeriesMetadata) TimeSeriesMetadata {
+				return tsm.WithValue(MetaDataTimeSeriesType, TSTypeCounter)
+			}),
+			collected: r.now(),
+		}
+		if r.overflowedMetrics == nil {
+			r.overflowedMetrics = make(map[string]*overflowedMetric)
+		}
+		r.overflowedMetrics[metricName] = om
+	}
+	om.total++
+}
+
+// collectOverflowed appends to ret how many TimeSeries calls of each metric were redirected to an overflow series since
+// the last call
+func (r *Registry) collectOverflowed(ret []TimeSeriesAggregation, now time.Time) []TimeSeriesAggregation {
+	if atomic.LoadInt64(&r.overflowed) == 0 {
+		return ret
+	}
+	r.overflowedMu.Lock()
+	defer r.overflowedMu.Unlock()
+	for _, om := range r.overflowedMetrics {
+		value := float64(om.total - om.reported)
+		start := om.collected
+		om.reported = om.total
+		om.collected = now
+		ret = append(ret, TimeSeriesAggregation{
+			TS: om.ts,
+			Aggregation: TimeWindowAggregation{
+				Va: singleValue(value),
+				Tw: TimeWindow{
+					Start:    start,
+					Duration: now.Sub(start),
+				},
+			},
+		})
+	}
+	return ret
+}
+
+// Observer returns the aggregator for a time series, creating it with AggregationConstructor if needed.  If the time
+// series already has a collector that cannot observe values, a no-op observer is returned.
+func (r *Registry) Observer(ts *TimeSeries) Observer {
+	entry := r.entryWithCollector(ts, func(ts *TimeSeries) MetricCollector {
+		return r.aggregationConstructor()(ts)
+	})
+	if entry.observer != nil {
+		return entry.observer
+	}
+	if obs, ok := entry.collector.(Observer); ok {
+		return obs
+	}
+	return &nopAggregator{}
+}
+
+// GetOrSet returns the collector of a time series.  If the time series has no collector, one is created with mc.
+func (r *Registry) GetOrSet(ts *TimeSeries, mc MetricCollectorConstructor) MetricCollector {
+	return r.entryWithCollector(ts, mc).collector
+}
+
+func (r *Registry) entryWithCollector(ts *TimeSeries, mc MetricCollectorConstructor) *registryEntry {
+	h := ts.identifierHash()
+	shard := r.shard(h)
+	shard.mu.RLock()
+	entry := shard.find(h, &ts.Tsi)
+	shard.mu.RUnlock()
+	if entry != nil && entry.collector != nil {
+		return entry
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry = shard.find(h, &ts.Tsi)
+	if entry == nil {
+		// A time series that was not created by this registry (or was evicted).  Track it anyways.
+		entry = r.newEntry(ts, h)
+		shard.add(entry)
+	}
+	if entry.collector == nil {
+		entry.collector = mc(entry.ts)
+		if obs, ok := entry.collector.(Observer); ok && r.IdleTTL > 0 {
+			entry.observer = &activityObserver{
+				Observer: obs,
+				registry: r,
+				entry:    entry,
+			}
+		}
+	}
+	return entry
+}
+
+// FlushMetrics collects metrics from every collector in the registry, after running registered callbacks (see
+// RegisterCallback).  If the registry has an IdleTTL, idle time series are evicted and any values they were still
+// aggregating are included in the result.  Once anything has overflowed the registry's limits, the result includes
+// the counter OverflowedMetricName.
+func (r *Registry) FlushMetrics() []TimeSeriesAggregation {
+	r.runCallbacks()
+	flushTime := r.now()
+	ret := r.collectOverflowed(nil, flushTime)
+	var entries []*registryEntry
+	now := flushTime.UnixNano()
+	for i := range r.shards {
+		shard := &r.shards[i]
+		entries = shard.snapshot(entries[:0])
+		// Collect outside the shard lock so observers on this shard are not blocked by slow collectors
+		for _, entry := range entries {
+			if entry.collector == nil {
+				continue
+			}
+			hadSamples := false
+			for _, agg := range entry.collector.CollectMetrics() {
+				hadSamples = hadSamples || agg.Va.SampleCount > 0
+				ret = append(ret, TimeSeriesAggregation{
+					TS:          entry.ts,
+					Aggregation: agg,
+				})
+			}
+			if hadSamples {
+				atomic.StoreInt64(&entry.lastActive, now)
+			}
+		}
+		if r.IdleTTL > 0 {
+			ret = r.evictIdle(shard, entries, now, ret)
+		}
+	}
+	return ret
+}
+
+// evictIdle removes idle entries from shard, appending whatever they were still aggregating to ret
+func (r *Registry) evictIdle(shard *registryShard, entries []*registryEntry, now int64, ret []TimeSeriesAggregation) []TimeSeriesAggregation {
+	var evicted []*registryEntry
+	shard.mu.Lock()
+	for _, entry := range entries {
+		if atomic.SwapInt32(&entry.observed, 0) == 1 {
+			atomic.StoreInt64(&entry.lastActive, now)
+			continue
+		}
+		if time.Duration(now-atomic.LoadInt64(&entry.lastActive)) < r.IdleTTL {
+			continue
+		}
+		if shard.remove(entry) {
+			atomic.StoreInt32(&entry.evicted, 1)
+			evicted = append(evicted, entry)
+		}
+	}
+	shard.mu.Unlock()
+
+	for _, entry := range evicted {
+		if dc, ok := entry.collector.(DrainableCollector); ok {
+			for _, agg := range dc.DrainMetrics() {
+				ret = append(ret, TimeSeriesAggregation{
+					TS:          entry.ts,
+					Aggregation: agg,
+				})
+			}
+		}
+		if entry.limited {
+			r.releaseSeries(entry.ts.Tsi.MetricName)
+		}
+		if r.OnEvict != nil {
+			r.OnEvict(entry.ts)
+		}
+	}
+	return ret
+}
+
+// restore puts an evicted entry back into the registry.  If its time series was created again since it was evicted,
+// the entry stays out and the observer of the new time series is returned instead.
+func (r *Registry) restore(entry *registryEntry) Observer {
+	shard := r.shard(entry.hash)
+	shard.mu.Lock()
+	if atomic.LoadInt32(&entry.evicted) == 0 {
+		shard.mu.Unlock()
+		return nil
+	}
+	if existing := shard.find(entry.hash, &entry.ts.Tsi); existing != nil {
+		shard.mu.Unlock()
+		return r.Observer(existing.ts)
+	}
+	atomic.StoreInt64(&entry.lastActive, r.now().UnixNano())
+	atomic.StoreInt32(&entry.evicted, 0)
+	if entry.limited {
+		// The entry was counted before it was evicted, so it is counted again even past the limits
+		r.limitsMu.Lock()
+		r.countSeries(entry.ts.Tsi.MetricName)
+		r.limitsMu.Unlock()
+	}
+	shard.add(entry)
+	shard.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) hasLimits() bool {
+	return r.MaxSeries > 0 || r.MaxSeriesPerMetric > 0
+}
+
+// reserveSeries counts a new time series against the registry's limits, returning false if there is no room for it
+func (r *Registry) reserveSeries(metricName string) bool {
+	r.limitsMu.Lock()
+	defer r.limitsMu.Unlock()
+	if r.MaxSeries > 0 && r.seriesCount >= r.MaxSeries {
+		return false
+	}
+	if r.MaxSeriesPerMetric > 0 && r.seriesPerMetric[metricName] >= r.MaxSeriesPerMetric {
+		return false
+	}
+	r.countSeries(metricName)
+	return true
+}
+
+// countSeries must be called while holding limitsMu
+func (r *Registry) countSeries(metricName string) {
+	if r.seriesPerMetric == nil {
+		r.seriesPerMetric = make(map[string]int)
+	}
+	r.seriesCount++
+	r.seriesPerMetric[metricName]++
+}
+
+// releaseSeries undoes reserveSeries for an evicted time series
+func (r *Registry) releaseSeries(metricName string) {
+	r.limitsMu.Lock()
+	defer r.limitsMu.Unlock()
+	r.seriesCount--
+	r.seriesPerMetric[metricName]--
+	if r.seriesPerMetric[metricName] <= 0 {
+		delete(r.seriesPerMetric, metricName)
+	}
+}
+
+func overflowIdentifier(metricName string) TimeSeriesIdentifier {
+	return TimeSeriesIdentifier{
+		MetricName: metricName,
+		Dimensions: map[string]string{
+			OverflowDimension: "true",
+		},
+	}
+}
+
+func (r *Registry) newEntry(ts *TimeSeries, h uint64) *registryEntry {
+	return &registryEntry{
+		ts:         ts,
+		hash:       h,
+		lastActive: r.now().UnixNano(),
+	}
+}
+
+func (r *Registry) aggregationConstructor() AggregationConstructor {
+	if r.AggregationConstructor == nil {
+		return func(_ *TimeSeries) Aggregator {
+			return &nopAggregator{}
+		}
+	}
+	return r.AggregationConstructor
+}
+
+func (r *Registry) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+func (r *Registry) shard(h uint64) *registryShard {
+	return &r.shards[h&(registryShardCount-1)]
+}
+
+// find returns the entry for an identifier, or nil.  Must be called while holding the lock.
+func (s *registryShard) find(h uint64, tsi *TimeSeriesIdentifier) *registryEntry {
+	for _, entry := range s.entries[h] {
+		if entry.ts.Tsi.Equal(tsi) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// add must be called while holding the write lock
+func (s *registryShard) add(entry *registryEntry) {
+	if s.entries == nil {
+		s.entries = make(map[uint64][]*registryEntry)
+	}
+	s.entries[entry.hash] = append(s.entries[entry.hash], entry)
+}
+
+// remove returns false if entry is not in the shard.  Must be called while holding the write lock.
+func (s *registryShard) remove(entry *registryEntry) bool {
+	existing := s.entries[entry.hash]
+	for i, e := range existing {
+		if e != entry {
+			continue
+		}
+		if len(existing) == 1 {
+			delete(s.entries, entry.hash)
+			return true
+		}
+		s.entries[entry.hash] = append(existing[:i:i], existing[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// snapshot appends to into every entry of the shard
+func (s *registryShard) snapshot(into []*registryEntry) []*registryEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, entries := range s.entries {
+		into = append(into, entries...)
+	}
+	return into
+}
+
+func newTimeSeries(tsi TimeSeriesIdentifier, h uint64, metadata MetadataConstructor) *TimeSeries {
+	ret := &TimeSeries{
+		Tsi:  uniqueCopy(tsi),
+		hash: h,
+	}
+	if metadata != nil {
+		ret.Tsm = metadata(ret.Tsi, ret.Tsm)
+	}
+	return ret
+}
@@ -0,0 +1,471 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingAggregator struct {
+	mu    sync.Mutex
+	count int32
+}
+
+func (c *countingAggregator) CollectMetrics() []TimeWindowAggregation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := []TimeWindowAggregation{{Va: ValueAggregation{SampleCount: c.count}}}
+	c.count = 0
+	return ret
+}
+
+func (c *countingAggregator) Observe(value float64) {
+	c.mu.Lock()
+	c.count++
+	c.mu.Unlock()
+}
+
+func countingRegistry() *Registry {
+	return &Registry{
+		AggregationConstructor: func(ts *TimeSeries) Aggregator {
+			return &countingAggregator{}
+		},
+	}
+}
+
+func TestRegistry_TimeSeries(t *testing.T) {
+	r := &Registry{}
+	calls := 0
+	md := func(_ TimeSeriesIdentifier, tsm TimeSeriesMetadata) TimeSeriesMetadata {
+		calls++
+		return tsm.WithValue(MetaDataUnit, "Seconds")
+	}
+	dims := map[string]string{"name": "jack"}
+	ts1 := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi", Dimensions: dims}, md)
+	ts2 := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"name": "jack"}}, md)
+	if ts1 != ts2 {
+		t.Errorf("Registry.TimeSeries() returned different time series for the same identifier")
+	}
+	if calls != 1 {
+		t.Errorf("Registry.TimeSeries() called metadata %d times, want 1", calls)
+	}
+	if got := ts1.Tsm.Value(MetaDataUnit); got != "Seconds" {
+		t.Errorf("Registry.TimeSeries() unit = %v, want Seconds", got)
+	}
+	dims["name"] = "john"
+	if got := ts1.Tsi.Dimensions["name"]; got != "jack" {
+		t.Errorf("Registry.TimeSeries() did not copy dimensions: got %v", got)
+	}
+	if ts3 := r.TimeSeries(TimeSeriesIdentifier{MetricName: "bye", Dimensions: dims}, nil); ts3 == ts1 {
+		t.Errorf("Registry.TimeSeries() returned the same time series for different identifiers")
+	}
+}
+
+func TestRegistry_Observer(t *testing.T) {
+	r := countingRegistry()
+	ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi"}, nil)
+	r.Observer(ts).Observe(1)
+	r.Observer(ts).Observe(1)
+	aggs := r.FlushMetrics()
+	if len(aggs) != 1 {
+		t.Fatalf("Registry.FlushMetrics() len = %d, want 1", len(aggs))
+	}
+	if aggs[0].TS != ts {
+		t.Errorf("Registry.FlushMetrics() time series = %v, want %v", aggs[0].TS, ts)
+	}
+	if got := aggs[0].Aggregation.Va.SampleCount; got != 2 {
+		t.Errorf("Registry.FlushMetrics() sample count = %d, want 2", got)
+	}
+}
+
+func TestRegistry_Observer_default(t *testing.T) {
+	r := &Registry{}
+	ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi"}, nil)
+	r.Observer(ts).Observe(1)
+	if aggs := r.FlushMetrics(); len(aggs) != 0 {
+		t.Errorf("Registry.FlushMetrics() = %v, want nothing", aggs)
+	}
+}
+
+func TestRegistry_GetOrSet(t *testing.T) {
+	r := countingRegistry()
+	ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi"}, nil)
+	first := &countingAggregator{}
+	got := r.GetOrSet(ts, func(ts *TimeSeries) MetricCollector {
+		return first
+	})
+	if got != first {
+		t.Errorf("Registry.GetOrSet() = %v, want %v", got, first)
+	}
+	got = r.GetOrSet(ts, func(ts *TimeSeries) MetricCollector {
+		return &countingAggregator{}
+	})
+	if got != first {
+		t.Errorf("Registry.GetOrSet() = %v, want existing %v", got, first)
+	}
+	if obs := r.Observer(ts); obs != first {
+		t.Errorf("Registry.Observer() = %v, want existing %v", obs, first)
+	}
+}
+
+func TestRegistry_concurrent(t *testing.T) {
+	r := countingRegistry()
+	const goroutines = 50
+	const perGoroutine = 100
+	wg := sync.WaitGroup{}
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				ts := r.TimeSeries(TimeSeriesIdentifier{
+					MetricName: "hi",
+					Dimensions: map[string]string{"j": strconv.Itoa(j % 10)},
+				}, nil)
+				r.Observer(ts).Observe(1)
+			}
+		}()
+	}
+	wg.Wait()
+	aggs := r.FlushMetrics()
+	if len(aggs) != 10 {
+		t.Errorf("Registry.FlushMetrics() len = %d, want 10", len(aggs))
+	}
+	total := int32(0)
+	for _, agg := range aggs {
+		total += agg.Aggregation.Va.SampleCount
+	}
+	if total != goroutines*perGoroutine {
+		t.Errorf("Registry.FlushMetrics() total = %d, want %d", total, goroutines*perGoroutine)
+	}
+}
+
+func BenchmarkRegistry_Parallel(b *testing.B) {
+	r := &Registry{}
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = "metric_" + strconv.Itoa(i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: names[i%len(names)]}, nil)
+			r.Observer(ts).Observe(1)
+			i++
+		}
+	})
+}
+
+type drainingAggregator struct {
+	countingAggregator
+	drained bool
+}
+
+func (d *drainingAggregator) CollectMetrics() []TimeWindowAggregation {
+	// Pretend every value is still in the current window
+	return nil
+}
+
+func (d *drainingAggregator) DrainMetrics() []TimeWindowAggregation {
+	d.drained = true
+	return d.countingAggregator.CollectMetrics()
+}
+
+func TestRegistry_IdleTTL(t *testing.T) {
+	now := time.Now()
+	var evicted []*TimeSeries
+	aggs := make(map[*TimeSeries]*drainingAggregator)
+	r := &Registry{
+		AggregationConstructor: func(ts *TimeSeries) Aggregator {
+			aggs[ts] = &drainingAggregator{}
+			return aggs[ts]
+		},
+		IdleTTL: time.Minute,
+		OnEvict: func(ts *TimeSeries) {
+			evicted = append(evicted, ts)
+		},
+		Now: func() time.Time {
+			return now
+		},
+	}
+	idle := r.TimeSeries(TimeSeriesIdentifier{MetricName: "idle"}, nil)
+	busy := r.TimeSeries(TimeSeriesIdentifier{MetricName: "busy"}, nil)
+	r.Observer(idle).Observe(1)
+	r.Observer(busy).Observe(1)
+
+	now = now.Add(time.Minute * 2)
+	r.Observer(busy).Observe(1)
+	// Both observed since the last flush, so neither should be evicted
+	if flushed := r.FlushMetrics(); len(flushed) != 0 || len(evicted) != 0 {
+		t.Fatalf("Registry.FlushMetrics() = %v evicted = %v, want nothing", flushed, evicted)
+	}
+
+	now = now.Add(time.Second * 30)
+	r.Observer(busy).Observe(1)
+	flushed := r.FlushMetrics()
+	if len(evicted) != 0 {
+		t.Fatalf("Registry.FlushMetrics() evicted = %v, want nothing", evicted)
+	}
+	if len(flushed) != 0 {
+		t.Fatalf("Registry.FlushMetrics() = %v, want nothing", flushed)
+	}
+
+	now = now.Add(time.Minute * 2)
+	r.Observer(busy).Observe(1)
+	flushed = r.FlushMetrics()
+	if len(evicted) != 1 || evicted[0] != idle {
+		t.Fatalf("Registry.FlushMetrics() evicted = %v, want %v", evicted, idle)
+	}
+	if !aggs[idle].drained || aggs[busy].drained {
+		t.Errorf("Registry.FlushMetrics() should drain only evicted aggregators")
+	}
+	if len(flushed) != 1 || flushed[0].TS != idle || flushed[0].Aggregation.Va.SampleCount != 1 {
+		t.Errorf("Registry.FlushMetrics() = %v, want drained value of %v", flushed, idle)
+	}
+	if ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "idle"}, nil); ts == idle {
+		t.Errorf("Registry.TimeSeries() returned an evicted time series")
+	}
+}
+
+func TestRegistry_IdleTTL_lookups(t *testing.T) {
+	now := time.Now()
+	r := &Registry{
+		IdleTTL: time.Minute,
+		Now: func() time.Time {
+			return now
+		},
+	}
+	tsi := TimeSeriesIdentifier{MetricName: "sampled"}
+	ts := r.TimeSeries(tsi, nil)
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Minute * 2)
+		if got := r.TimeSeries(tsi, nil); got != ts {
+			t.Fatalf("Registry.TimeSeries() evicted a time series that is looked up every flush")
+		}
+		r.FlushMetrics()
+	}
+	now = now.Add(time.Minute * 2)
+	r.FlushMetrics()
+	if got := r.TimeSeries(tsi, nil); got == ts {
+		t.Errorf("Registry.TimeSeries() should evict a time series that is no longer looked up")
+	}
+}
+
+func TestRegistry_IdleTTL_restore(t *testing.T) {
+	now := time.Now()
+	r := countingRegistry()
+	r.IdleTTL = time.Minute
+	r.MaxSeries = 1
+	r.Now = func() time.Time {
+		return now
+	}
+	ts := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi"}, nil)
+	obs := r.Observer(ts)
+	now = now.Add(time.Minute * 2)
+	r.FlushMetrics()
+	if got := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi"}, nil); got == ts {
+		t.Fatalf("Registry.FlushMetrics() should evict an idle time series")
+	}
+	// Looking the series up again created a new one.  Evict that too.
+	now = now.Add(time.Minute * 2)
+	r.FlushMetrics()
+
+	obs.Observe(1)
+	obs.Observe(1)
+	flushed := r.FlushMetrics()
+	if len(flushed) != 1 || flushed[0].TS != ts || flushed[0].Aggregation.Va.SampleCount != 2 {
+		t.Fatalf("Registry.FlushMetrics() = %v, want the values observed after eviction", flushed)
+	}
+	if got := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi"}, nil); got != ts {
+		t.Errorf("Registry.TimeSeries() = %v, want the restored time series", got)
+	}
+	if other := r.TimeSeries(TimeSeriesIdentifier{MetricName: "bye"}, nil); other.Tsi.Dimensions[OverflowDimension] != "true" {
+		t.Errorf("Registry.TimeSeries() restored time series should count against MaxSeries")
+	}
+}
+
+func TestRegistry_IdleTTL_restoreRecreated(t *testing.T) {
+	now := time.Now()
+	r := countingRegistry()
+	r.IdleTTL = time.Minute
+	r.Now = func() time.Time {
+		return now
+	}
+	tsi := TimeSeriesIdentifier{MetricName: "hi"}
+	old := r.Observer(r.TimeSeries(tsi, nil))
+	now = now.Add(time.Minute * 2)
+	r.FlushMetrics()
+	recreated := r.TimeSeries(tsi, nil)
+	r.Observer(recreated).Observe(1)
+
+	old.Observe(1)
+	flushed := r.FlushMetrics()
+	if len(flushed) != 1 || flushed[0].TS != recreated || flushed[0].Aggregation.Va.SampleCount != 2 {
+		t.Errorf("Registry.FlushMetrics() = %v, want values of the old observer in the recreated time series", flushed)
+	}
+}
+
+func TestRegistry_MaxSeriesPerMetric(t *testing.T) {
+	r := countingRegistry()
+	r.MaxSeriesPerMetric = 2
+	tsFor := func(metricName string, user string) *TimeSeries {
+		return r.TimeSeries(TimeSeriesIdentifier{
+			MetricName: metricName,
+			Dimensions: map[string]string{"user": user},
+		}, func(_ TimeSeriesIdentifier, tsm TimeSeriesMetadata) TimeSeriesMetadata {
+			return tsm.WithValue(MetaDataUnit, "Seconds")
+		})
+	}
+	a := tsFor("hi", "a")
+	b := tsFor("hi", "b")
+	c := tsFor("hi", "c")
+	d := tsFor("hi", "d")
+	if a == b || a == c || b == c {
+		t.Fatalf("Registry.TimeSeries() should not overflow before the limit")
+	}
+	if c != d {
+		t.Errorf("Registry.TimeSeries() should share a single overflow series")
+	}
+	if got := c.Tsi.Dimensions[OverflowDimension]; got != "true" || len(c.Tsi.Dimensions) != 1 || c.Tsi.MetricName != "hi" {
+		t.Errorf("Registry.TimeSeries() overflow identifier = %v", c.Tsi.String())
+	}
+	if got := c.Tsm.Value(MetaDataUnit); got != "Seconds" {
+		t.Errorf("Registry.TimeSeries() overflow unit = %v, want Seconds", got)
+	}
+	if tsFor("hi", "a") != a {
+		t.Errorf("Registry.TimeSeries() existing time series should not overflow")
+	}
+	if other := tsFor("bye", "c"); other.Tsi.Dimensions["user"] != "c" {
+		t.Errorf("Registry.TimeSeries() limit should be per metric name")
+	}
+	if got := r.Overflowed(); got != 2 {
+		t.Errorf("Registry.Overflowed() = %d, want 2", got)
+	}
+}
+
+func TestRegistry_MaxSeriesPerMetric_overflowDimension(t *testing.T) {
+	r := countingRegistry()
+	r.MaxSeriesPerMetric = 1
+	overflowDims := map[string]string{OverflowDimension: "true"}
+	user := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi", Dimensions: overflowDims}, nil)
+	other := r.TimeSeries(TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"user": "a"}}, nil)
+	if other.Tsi.Dimensions["user"] != "" {
+		t.Errorf("Registry.TimeSeries() = %v, a series that looks like the overflow series should count against the limit", other.Tsi.String())
+	}
+	if other != user {
+		t.Errorf("Registry.TimeSeries() should overflow into the series with the same identifier")
+	}
+}
+
+func TestRegistry_FlushMetrics_overflowed(t *testing.T) {
+	r := countingRegistry()
+	r.MaxSeries = 1
+	r.TimeSeries(TimeSeriesIdentifier{MetricName: "a"}, nil)
+	if flushed := r.FlushMetrics(); len(flushed) != 0 {
+		t.Fatalf("Registry.FlushMetrics() = %v, want nothing before anything overflowed", flushed)
+	}
+	overflowed := func() map[string]TimeSeriesAggregation {
+		ret := make(map[string]TimeSeriesAggregation)
+		for _, agg := range r.FlushMetrics() {
+			if agg.TS.Tsi.MetricName == OverflowedMetricName {
+				ret[agg.TS.Tsi.Dimensions[OverflowedMetricDimension]] = agg
+			}
+		}
+		return ret
+	}
+	r.TimeSeries(TimeSeriesIdentifier{MetricName: "b"}, nil)
+	r.TimeSeries(TimeSeriesIdentifier{MetricName: "b", Dimensions: map[string]string{"user": "x"}}, nil)
+	r.TimeSeries(TimeSeriesIdentifier{MetricName: "c"}, nil)
+	aggs := overflowed()
+	if len(aggs) != 2 || aggs["b"].Aggregation.Va.Sum != 2 || aggs["c"].Aggregation.Va.Sum != 1 {
+		t.Fatalf("Registry.FlushMetrics() overflowed = %v, want 2 for b and 1 for c", aggs)
+	}
+	if got := aggs["b"].TS.Tsm.Value(MetaDataTimeSeriesType); got != TSTypeCounter {
+		t.Errorf("Registry.FlushMetrics() overflowed type = %v, want a counter", got)
+	}
+	r.TimeSeries(TimeSeriesIdentifier{MetricName: "c", Dimensions: map[string]string{"user": "y"}}, nil)
+	if aggs := overflowed(); aggs["b"].Aggregation.Va.Sum != 0 || aggs["c"].Aggregation.Va.Sum != 1 {
+		t.Errorf("Registry.FlushMetrics() overflowed = %v, want 1 for c since the last flush", aggs)
+	}
+}
+
+func TestRegistry_MaxSeries(t *testing.T) {
+	now := time.Now()
+	r := &Registry{
+		MaxSeries: 1,
+		IdleTTL:   time.Minute,
+		Now: func() time.Time {
+			return now
+		},
+	}
+	a := r.TimeSeries(TimeSeriesIdentifier{MetricName: "a"}, nil)
+	b := r.TimeSeries(TimeSeriesIdentifier{MetricName: "b"}, nil)
+	if b.Tsi.MetricName != "b" || b.Tsi.Dimensions[OverflowDimension] != "true" {
+		t.Errorf("Registry.TimeSeries() = %v, want overflow of b", b.Tsi.String())
+	}
+	if a.Tsi.Dimensions[OverflowDimension] != "" {
+		t.Errorf("Registry.TimeSeries() = %v, should not overflow", a.Tsi.String())
+	}
+	// Evicting a frees room for b
+	now = now.Add(time.Hour)
+	r.FlushMetrics()
+	b = r.TimeSeries(TimeSeriesIdentifier{MetricName: "b"}, nil)
+	if b.Tsi.Dimensions[OverflowDimension] != "" {
+		t.Errorf("Registry.TimeSeries() = %v, should not overflow after eviction", b.Tsi.String())
+	}
+}
+
+func TestRegistry_TimeSeries_allocs(t *testing.T) {
+	r := countingRegistry()
+	tsi := TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "1", "b": "2"}}
+	r.Observer(r.TimeSeries(tsi, nil))
+	if allocs := testing.AllocsPerRun(100, func() {
+		r.Observer(r.TimeSeries(tsi, nil)).Observe(1)
+	}); allocs != 0 {
+		t.Errorf("Registry.TimeSeries() of an existing series allocs = %v, want 0", allocs)
+	}
+}
+
+func TestRegistry_hashCollision(t *testing.T) {
+	r := countingRegistry()
+	a := newTimeSeries(TimeSeriesIdentifier{MetricName: "a"}, 1, nil)
+	b := newTimeSeries(TimeSeriesIdentifier{MetricName: "b"}, 1, nil)
+	aAgg := r.Observer(a)
+	bAgg := r.Observer(b)
+	if aAgg == bAgg {
+		t.Fatalf("Registry.Observer() should not share aggregators for colliding hashes")
+	}
+	if r.Observer(a) != aAgg || r.Observer(b) != bAgg {
+		t.Errorf("Registry.Observer() should find colliding time series")
+	}
+	if flushed := r.FlushMetrics(); len(flushed) != 2 {
+		t.Errorf("Registry.FlushMetrics() len = %d, want 2", len(flushed))
+	}
+}
+
+// BenchmarkRegistry_TimeSeries looks up an existing time series by hash
+func BenchmarkRegistry_TimeSeries(b *testing.B) {
+	r := &Registry{}
+	r.TimeSeries(benchmarkIdentifier, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.TimeSeries(benchmarkIdentifier, nil)
+	}
+}
+
+// BenchmarkRegistry_TimeSeriesByUID is the lookup Registry would do if keyed by UID strings, for comparison
+func BenchmarkRegistry_TimeSeriesByUID(b *testing.B) {
+	var mu sync.RWMutex
+	byUID := map[string]*TimeSeries{
+		benchmarkIdentifier.UID(): {Tsi: benchmarkIdentifier},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mu.RLock()
+		_ = byUID[benchmarkIdentifier.UID()]
+		mu.RUnlock()
+	}
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+const defaultTDigestCompression = 100
+
+// TDigest is a merging t-digest (https://github.com/tdunning/t-digest).  It summarizes values as weighted centroids
+// that are small near the tails, so extreme quantiles like p99.9 stay accurate.  Digests can be merged with Union.
+type TDigest struct {
+	// Compression bounds how many centroids are kept (at most about Compression).  Higher is more accurate.
+	// Default is 100
+	Compression float64
+	// Centroids are ordered by Mean after Compress.  Observe appends new values at the end.
+	Centroids []Centroid
+	Min       float64
+	Max       float64
+
+	// unmerged is how many centroids at the end of Centroids have not been compressed yet
+	unmerged int
+}
+
+// Centroid is the mean of Count values
+type Centroid struct {
+	Mean  float64
+	Count int64
+}
+
+// Observe adds value to the digest.  NaN and infinite values are ignored, like DDSketch does, because a single one would
+// make the mean of its centroid, and every quantile near it, meaningless.
+func (t *TDigest) Observe(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if len(t.Centroids) == 0 || value < t.Min {
+		t.Min = value
+	}
+	if len(t.Centroids) == 0 || value > t.Max {
+		t.Max = value
+	}
+	t.Centroids = append(t.Centroids, Centroid{Mean: value, Count: 1})
+	t.unmerged++
+	// Buffer values before compressing, so compression cost is spread out
+	if t.unmerged > int(t.compression())*5 {
+		t.Compress()
+	}
+}
+
+// Count is the number of values in the digest
+func (t *TDigest) Count() int64 {
+	if t == nil {
+		return 0
+	}
+	ret := int64(0)
+	for _, c := range t.Centroids {
+		ret += c.Count
+	}
+	return ret
+}
+
+// Compress merges centroids until the digest is as small as Compression allows
+func (t *TDigest) Compress() {
+	t.unmerged = 0
+	if len(t.Centroids) <= 1 {
+		return
+	}
+	sort.Slice(t.Centroids, func(i, j int) bool {
+		return t.Centroids[i].Mean < t.Centroids[j].Mean
+	})
+	total := float64(t.Count())
+	compressed := t.Centroids[:1]
+	soFar := 0.0
+	for _, next := range t.Centroids[1:] {
+		cur := &compressed[len(compressed)-1]
+		merged := float64(cur.Count + next.Count)
+		// Centroids may span one unit of the k2 scale function, so they hold more values in the middle of the
+		// distribution than near the tails
+		if t.scale((soFar+merged)/total, total)-t.scale(soFar/total, total) <= 1 {
+			cur.Mean += (next.Mean - cur.Mean) * float64(next.Count) / merged
+			cur.Count += next.Count
+			continue
+		}
+		soFar += float64(cur.Count)
+		compressed = append(compressed, next)
+	}
+	t.Centroids = compressed
+}
+
+// Quantile estimates the value at quantile q (0 <= q <= 1).  Returns NaN for an empty digest.
+func (t *TDigest) Quantile(q float64) float64 {
+	if t == nil || len(t.Centroids) == 0 || math.IsNaN(q) || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	t = t.compressed()
+	total := float64(t.Count())
+	rank := q * total
+	if len(t.Centroids) == 1 || rank <= 0 {
+		return t.interpolateTails(rank, total)
+	}
+	first := t.Centroids[0]
+	if rank < float64(first.Count)/2 {
+		return t.interpolateTails(rank, total)
+	}
+	// Each centroid's mean is treated as the value at the middle of its rank range.  Interpolate between neighbors.
+	soFar := float64(first.Count) / 2
+	for i := 1; i < len(t.Centroids); i++ {
+		prev, cur := t.Centroids[i-1], t.Centroids[i]
+		step := float64(prev.Count+cur.Count) / 2
+		if soFar+step >= rank {
+			return prev.Mean + (cur.Mean-prev.Mean)*(rank-soFar)/step
+		}
+		soFar += step
+	}
+	return t.interpolateTails(rank, total)
+}
+
+// interpolateTails estimates ranks before the first centroid's middle or after the last centroid's middle using Min and
+// Max
+func (t *TDigest) interpolateTails(rank float64, total float64) float64 {
+	first, last := t.Centroids[0], t.Centroids[len(t.Centroids)-1]
+	if rank < float64(first.Count)/2 {
+		return t.Min + (first.Mean-t.Min)*rank/(float64(first.Count)/2)
+	}
+	remaining := total - rank
+	if remaining < float64(last.Count)/2 {
+		return t.Max - (t.Max-last.Mean)*remaining/(float64(last.Count)/2)
+	}
+	return last.Mean
+}
+
+// Copy returns a compressed copy of this digest
+func (t *TDigest) Copy() *TDigest {
+	if t == nil {
+		return nil
+	}
+	ret := *t
+	ret.Centroids = append([]Centroid(nil), t.Centroids...)
+	ret.Compress()
+	return &ret
+}
+
+// Union returns a new digest holding the values of both.  Neither digest is modified.  A nil digest is the identity.
+func (t *TDigest) Union(other *TDigest) *TDigest {
+	if t == nil || len(t.Centroids) == 0 {
+		return other
+	}
+	if other == nil || len(other.Centroids) == 0 {
+		return t
+	}
+	ret := &TDigest{
+		Compression: math.Max(t.compression(), other.compression()),
+		Centroids:   make([]Centroid, 0, len(t.Centroids)+len(other.Centroids)),
+		Min:         math.Min(t.Min, other.Min),
+		Max:         math.Max(t.Max, other.Max),
+	}
+	ret.Centroids = append(ret.Centroids, t.Centroids...)
+	ret.Centroids = append(ret.Centroids, other.Centroids...)
+	ret.Compress()
+	return ret
+}
+
+// Buckets renders each centroid as a bucket that starts and ends at its mean, ordered by mean
+func (t *TDigest) Buckets() []Bucket {
+	if t == nil || len(t.Centroids) == 0 {
+		return nil
+	}
+	t = t.compressed()
+	ret := make([]Bucket, 0, len(t.Centroids))
+	for _, c := range t.Centroids {
+		ret = append(ret, Bucket{
+			Count: int32(c.Count),
+			Start: c.Mean,
+			End:   c.Mean,
+		})
+	}
+	return ret
+}
+
+// compressed returns t if it is already compressed, or a compressed copy.  Lets read only methods avoid modifying
+// digests that may be shared.
+func (t *TDigest) compressed() *TDigest {
+	if t.unmerged == 0 {
+		return t
+	}
+	return t.Copy()
+}
+
+// scale is the k2 scale function, delta/(4*log(n/delta)+24) * log(q/(1-q))
+func (t *TDigest) scale(q float64, total float64) float64 {
+	delta := t.compression()
+	return delta / (4*math.Log(math.Max(total/delta, 1)) + 24) * math.Log(q/(1-q))
+}
+
+func (t *TDigest) compression() float64 {
+	if t.Compression <= 0 {
+		return defaultTDigestCompression
+	}
+	return t.Compression
+}
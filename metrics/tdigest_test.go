@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func sortedValues(seed int64, n int) []float64 {
+	r := rand.New(rand.NewSource(seed))
+	ret := make([]float64, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, r.ExpFloat64()*100)
+	}
+	sort.Float64s(ret)
+	return ret
+}
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestTDigest_Quantile(t *testing.T) {
+	values := sortedValues(1, 100000)
+	d := &TDigest{}
+	for _, i := range rand.New(rand.NewSource(2)).Perm(len(values)) {
+		d.Observe(values[i])
+	}
+	d.Observe(math.NaN())
+	d.Observe(math.Inf(1))
+	d.Observe(math.Inf(-1))
+	if d.Count() != int64(len(values)) {
+		t.Errorf("TDigest.Count() = %d, want %d", d.Count(), len(values))
+	}
+	tests := []struct {
+		q         float64
+		rankError float64
+	}{
+		{q: 0, rankError: 0},
+		{q: 0.01, rankError: 0.002},
+		{q: 0.5, rankError: 0.01},
+		{q: 0.9, rankError: 0.005},
+		{q: 0.99, rankError: 0.001},
+		{q: 0.999, rankError: 0.0002},
+		{q: 1, rankError: 0},
+	}
+	for _, tt := range tests {
+		got := d.Quantile(tt.q)
+		// Check the error by rank, which is what the t-digest bounds
+		rank := float64(sort.SearchFloat64s(values, got)) / float64(len(values)-1)
+		if math.Abs(rank-tt.q) > tt.rankError {
+			t.Errorf("TDigest.Quantile(%v) = %v (rank %v), want %v", tt.q, got, rank, exactQuantile(values, tt.q))
+		}
+	}
+	if d.Min != values[0] || d.Max != values[len(values)-1] {
+		t.Errorf("TDigest min and max = %v, %v, want %v, %v", d.Min, d.Max, values[0], values[len(values)-1])
+	}
+	if len(d.compressed().Centroids) > 2*defaultTDigestCompression {
+		t.Errorf("TDigest has %d centroids, more than compression allows", len(d.Centroids))
+	}
+	var empty *TDigest
+	if !math.IsNaN(empty.Quantile(0.5)) || !math.IsNaN(d.Quantile(2)) {
+		t.Errorf("TDigest.Quantile() should be NaN for empty digests or bad quantiles")
+	}
+}
+
+func TestTDigest_Union(t *testing.T) {
+	values := sortedValues(3, 20000)
+	a, b := &TDigest{}, &TDigest{Compression: 200}
+	for i, v := range values {
+		if i%3 == 0 {
+			a.Observe(v)
+		} else {
+			b.Observe(v)
+		}
+	}
+	aCount := a.Count()
+	merged := a.Union(b)
+	if merged.Count() != int64(len(values)) {
+		t.Errorf("TDigest.Union() count = %d, want %d", merged.Count(), len(values))
+	}
+	if merged.Min != values[0] || merged.Max != values[len(values)-1] {
+		t.Errorf("TDigest.Union() range = [%v, %v]", merged.Min, merged.Max)
+	}
+	if a.Count() != aCount {
+		t.Errorf("TDigest.Union() modified its receiver")
+	}
+	for _, q := range []float64{0.5, 0.99, 0.999} {
+		got, want := merged.Quantile(q), exactQuantile(values, q)
+		if math.Abs(got-want)/want > 0.02 {
+			t.Errorf("TDigest.Union().Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+	var empty *TDigest
+	if empty.Union(a) != a || a.Union(nil) != a {
+		t.Errorf("TDigest.Union() nil should be the identity")
+	}
+}
+
+func TestValueAggregation_Union_tDigest(t *testing.T) {
+	a := ValueAggregation{TDigest: &TDigest{}}
+	b := ValueAggregation{TDigest: &TDigest{}}
+	for i := 1; i <= 100; i++ {
+		a.TDigest.Observe(float64(i))
+		b.TDigest.Observe(float64(i + 100))
+	}
+	a.SampleCount, a.Sum, a.Minimum, a.Maximum = 100, 5050, 1, 100
+	b.SampleCount, b.Sum, b.Minimum, b.Maximum = 100, 15050, 101, 200
+	merged := a.Union(b)
+	if merged.TDigest.Count() != 200 {
+		t.Errorf("ValueAggregation.Union() digest count = %d, want 200", merged.TDigest.Count())
+	}
+	if q := merged.Quantile(0.75); math.Abs(q-150) > 2 {
+		t.Errorf("ValueAggregation.Quantile() = %v, want about 150", q)
+	}
+	if len(merged.Distribution()) == 0 {
+		t.Errorf("ValueAggregation.Distribution() should use the digest")
+	}
+}
@@ -45,4 +45,14 @@ func (t TimeSeriesMetadata) WithValue(key interface{}, value interface{}) TimeSe
 type TimeSeries struct {
 	Tsi TimeSeriesIdentifier
 	Tsm TimeSeriesMetadata
+
+	// hash caches Tsi.Hash() for time series created by a Registry.  Zero if unknown.
+	hash uint64
+}
+
+func (t *TimeSeries) identifierHash() uint64 {
+	if t.hash != 0 {
+		return t.hash
+	}
+	return t.Tsi.Hash()
 }
@@ -32,7 +32,7 @@ func (t *TimeSeriesIdentifier) UID() string {
 	//defer sb.Put(ret)
 	mustWrite(ret.WriteString(t.MetricName))
 	if len(t.Dimensions) > 0 {
-		toSort := make([]kvPairs, len(t.Dimensions))
+		toSort := make([]kvPairs, 0, len(t.Dimensions))
 		for k, v := range t.Dimensions {
 			toSort = append(toSort, kvPairs{
 				key: k,
@@ -52,11 +52,38 @@ func (t *TimeSeriesIdentifier) UID() string {
 	return ret.String()
 }
 
+// Hash returns a stable 64 bit hash of this identifier without allocating.  Equal identifiers have the same hash, but
+// different identifiers can collide: use Equal to be sure two identifiers match.
+func (t *TimeSeriesIdentifier) Hash() uint64 {
+	h := fnvByte(fnvString(fnvOffset64, t.MetricName), 0)
+	// Each dimension pair is hashed alone and the results summed.  This does not depend on map iteration order, so
+	// there is no need to sort the dimensions first.
+	var dims uint64
+	for k, v := range t.Dimensions {
+		dims += mix64(fnvString(fnvByte(fnvString(fnvOffset64, k), 0), v))
+	}
+	return mix64(h ^ mix64(dims+uint64(len(t.Dimensions))))
+}
+
+// Equal returns true if both identifiers have the same metric name and dimensions.  A nil and empty Dimensions map are
+// equal.
+func (t *TimeSeriesIdentifier) Equal(o *TimeSeriesIdentifier) bool {
+	if t.MetricName != o.MetricName || len(t.Dimensions) != len(o.Dimensions) {
+		return false
+	}
+	for k, v := range t.Dimensions {
+		if ov, exists := o.Dimensions[k]; !exists || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *TimeSeriesIdentifier) String() string {
 	var ret strings.Builder
 	mustWrite(ret.WriteString(t.MetricName))
 	if len(t.Dimensions) > 0 {
-		toSort := make([]kvPairs, len(t.Dimensions))
+		toSort := make([]kvPairs, 0, len(t.Dimensions))
 		for k, v := range t.Dimensions {
 			toSort = append(toSort, kvPairs{
 				key: k,
@@ -73,6 +100,36 @@ func (t *TimeSeriesIdentifier) String() string {
 	return ret.String()
 }
 
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnvString is an inlined FNV-1a.  Used instead of hash/fnv so hashing a string does not allocate.
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func fnvByte(h uint64, b byte) uint64 {
+	h ^= uint64(b)
+	h *= fnvPrime64
+	return h
+}
+
+// mix64 is the splitmix64 finalizer.  It spreads FNV output so sums of hashes do not cancel out.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
 func mustWrite(_ int, err error) {
 	if err != nil {
 		panic(err)
@@ -119,3 +119,107 @@ func Test_uniqueCopy(t *testing.T) {
 		})
 	}
 }
+
+func TestTimeSeriesIdentifier_Hash(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     TimeSeriesIdentifier
+		b     TimeSeriesIdentifier
+		equal bool
+	}{
+		{
+			name:  "empty",
+			equal: true,
+		},
+		{
+			name:  "nil and empty dimensions",
+			a:     TimeSeriesIdentifier{MetricName: "hi"},
+			b:     TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{}},
+			equal: true,
+		},
+		{
+			name: "same dimensions",
+			a: TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{
+				"a": "1", "b": "2", "c": "3", "d": "4",
+			}},
+			b: TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{
+				"d": "4", "c": "3", "b": "2", "a": "1",
+			}},
+			equal: true,
+		},
+		{
+			name: "different metric name",
+			a:    TimeSeriesIdentifier{MetricName: "hi"},
+			b:    TimeSeriesIdentifier{MetricName: "bye"},
+		},
+		{
+			name: "swapped key and value",
+			a:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "b"}},
+			b:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"b": "a"}},
+		},
+		{
+			name: "shifted separator",
+			a:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"ab": "c"}},
+			b:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "bc"}},
+		},
+		{
+			name: "values swapped between keys",
+			a:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "1", "b": "2"}},
+			b:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "2", "b": "1"}},
+		},
+		{
+			name: "extra dimension",
+			a:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "1"}},
+			b:    TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "1", "": ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(&tt.b); got != tt.equal {
+				t.Errorf("TimeSeriesIdentifier.Equal() = %v, want %v", got, tt.equal)
+			}
+			if got := tt.b.Equal(&tt.a); got != tt.equal {
+				t.Errorf("TimeSeriesIdentifier.Equal() reversed = %v, want %v", got, tt.equal)
+			}
+			if got := tt.a.Hash() == tt.b.Hash(); got != tt.equal {
+				t.Errorf("TimeSeriesIdentifier.Hash() equal = %v, want %v", got, tt.equal)
+			}
+			if got := tt.a.UID() == tt.b.UID(); got != tt.equal {
+				t.Errorf("TimeSeriesIdentifier.UID() equal = %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestTimeSeriesIdentifier_Hash_allocs(t *testing.T) {
+	tsi := TimeSeriesIdentifier{MetricName: "hi", Dimensions: map[string]string{"a": "1", "b": "2"}}
+	if allocs := testing.AllocsPerRun(100, func() {
+		tsi.Hash()
+	}); allocs != 0 {
+		t.Errorf("TimeSeriesIdentifier.Hash() allocs = %v, want 0", allocs)
+	}
+}
+
+var benchmarkIdentifier = TimeSeriesIdentifier{
+	MetricName: "request_latency",
+	Dimensions: map[string]string{
+		"service":   "frontend",
+		"operation": "GetUser",
+		"stage":     "production",
+		"region":    "us-west-2",
+	},
+}
+
+func BenchmarkTimeSeriesIdentifier_UID(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkIdentifier.UID()
+	}
+}
+
+func BenchmarkTimeSeriesIdentifier_Hash(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkIdentifier.Hash()
+	}
+}
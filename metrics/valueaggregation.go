@@ -1,5 +1,10 @@
 package metrics
 
+import (
+	"math"
+	"sort"
+)
+
 // ValueAggregation is an aggregation of distinct values.  The values themselves are timeless.
 type ValueAggregation struct {
 	SampleCount int32
@@ -10,10 +15,24 @@ type ValueAggregation struct {
 	FirstValue  float64
 	LastValue   float64
 	Buckets     []Bucket
+	// ExponentialHistogram is set by aggregators that track one.  Nil otherwise.
+	ExponentialHistogram *ExponentialHistogram
+	// TDigest is set by aggregators that track one.  Nil otherwise.
+	TDigest *TDigest
+	// DDSketch is set by aggregators that track one.  Nil otherwise.
+	DDSketch *DDSketch
 }
 
-// Union merges and returns this aggregation with another
+// Union merges and returns this aggregation with another.  An aggregation with no samples is the identity: it does not
+// change the other aggregation's Minimum or Maximum.  FirstValue is taken from a and LastValue from other, since values
+// are timeless.  Use TimeWindowAggregation.Union to order them by time.
 func (a ValueAggregation) Union(other ValueAggregation) ValueAggregation {
+	if other.isEmpty() {
+		return a
+	}
+	if a.isEmpty() {
+		return other
+	}
 	return ValueAggregation{
 		FirstValue:  a.FirstValue,
 		LastValue:   other.LastValue,
@@ -23,7 +42,120 @@ func (a ValueAggregation) Union(other ValueAggregation) ValueAggregation {
 		Sum:         a.Sum + other.Sum,
 		SumSquare:   a.SumSquare + other.SumSquare,
 		Buckets:     bucketMerge(a.Buckets, other.Buckets),
+
+		ExponentialHistogram: a.ExponentialHistogram.Union(other.ExponentialHistogram),
+		TDigest:              a.TDigest.Union(other.TDigest),
+		DDSketch:             a.DDSketch.Union(other.DDSketch),
+	}
+}
+
+func (a ValueAggregation) isEmpty() bool {
+	return a.SampleCount == 0 && len(a.Buckets) == 0 && a.ExponentialHistogram.Count() == 0 && a.TDigest.Count() == 0 &&
+		a.DDSketch.Count() == 0
+}
+
+// Distribution is the shape of the observed values as buckets.  It is Buckets if there are any, otherwise the buckets of
+// whichever sketch (TDigest, DDSketch or ExponentialHistogram) this aggregation has.
+func (a ValueAggregation) Distribution() []Bucket {
+	switch {
+	case len(a.Buckets) > 0:
+		return a.Buckets
+	case a.TDigest.Count() > 0:
+		return a.TDigest.Buckets()
+	case a.DDSketch.Count() > 0:
+		return a.DDSketch.Buckets()
+	default:
+		return a.ExponentialHistogram.Buckets()
+	}
+}
+
+// Statistics below are NaN when SampleCount is zero
+
+// Mean is the average of every observed value
+func (a ValueAggregation) Mean() float64 {
+	if a.SampleCount == 0 {
+		return math.NaN()
+	}
+	return a.Sum / float64(a.SampleCount)
+}
+
+// Variance is the population variance of every observed value
+func (a ValueAggregation) Variance() float64 {
+	if a.SampleCount == 0 {
+		return math.NaN()
 	}
+	mean := a.Mean()
+	// Rounding error can make this slightly negative when every value is the same
+	return math.Max(0, a.SumSquare/float64(a.SampleCount)-mean*mean)
+}
+
+// StandardDeviation is the population standard deviation of every observed value
+func (a ValueAggregation) StandardDeviation() float64 {
+	return math.Sqrt(a.Variance())
+}
+
+// Quantile estimates the value at quantile q (0 <= q <= 1) of the observed values.  With Buckets, the estimate is
+// linearly interpolated inside the bucket that holds q.  Without Buckets, a TDigest or DDSketch estimates q itself and
+// the ExponentialHistogram's buckets are used if there is one.  Otherwise, it assumes the values are normally
+// distributed around Mean.  Estimates are always inside [Minimum, Maximum].  Returns NaN if q is out of range.
+func (a ValueAggregation) Quantile(q float64) float64 {
+	if a.SampleCount == 0 || math.IsNaN(q) || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	if q == 0 || a.Minimum == a.Maximum {
+		return a.Minimum
+	}
+	if q == 1 {
+		return a.Maximum
+	}
+	if len(a.Buckets) == 0 {
+		if a.TDigest.Count() > 0 {
+			return clampFloat(a.TDigest.Quantile(q), a.Minimum, a.Maximum)
+		}
+		if a.DDSketch.Count() > 0 {
+			return clampFloat(a.DDSketch.Quantile(q), a.Minimum, a.Maximum)
+		}
+	}
+	buckets := a.Buckets
+	if len(buckets) == 0 {
+		buckets = a.ExponentialHistogram.Buckets()
+	}
+	if estimate, ok := bucketQuantile(buckets, q); ok {
+		return clampFloat(estimate, a.Minimum, a.Maximum)
+	}
+	estimate := a.Mean() + a.StandardDeviation()*math.Sqrt2*math.Erfinv(2*q-1)
+	return clampFloat(estimate, a.Minimum, a.Maximum)
+}
+
+func bucketQuantile(buckets []Bucket, q float64) (float64, bool) {
+	total := int64(0)
+	for _, b := range buckets {
+		total += int64(b.Count)
+	}
+	if total == 0 {
+		return 0, false
+	}
+	sorted := make([]Bucket, len(buckets))
+	copy(sorted, buckets)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	rank := q * float64(total)
+	seen := 0.0
+	for _, b := range sorted {
+		if b.Count <= 0 {
+			continue
+		}
+		if seen+float64(b.Count) >= rank {
+			return b.Start + (b.End-b.Start)*(rank-seen)/float64(b.Count), true
+		}
+		seen += float64(b.Count)
+	}
+	return sorted[len(sorted)-1].End, true
+}
+
+func clampFloat(v, min, max float64) float64 {
+	return maxFloat(min, minFloat(max, v))
 }
 
 func maxFloat(a, b float64) float64 {
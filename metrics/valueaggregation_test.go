@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func aggregationOf(values ...float64) ValueAggregation {
+	ret := ValueAggregation{}
+	for i, v := range values {
+		if i == 0 || v < ret.Minimum {
+			ret.Minimum = v
+		}
+		if i == 0 || v > ret.Maximum {
+			ret.Maximum = v
+		}
+		ret.SampleCount++
+		ret.Sum += v
+		ret.SumSquare += v * v
+	}
+	return ret
+}
+
+func floatEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestValueAggregation_statistics(t *testing.T) {
+	tests := []struct {
+		name     string
+		va       ValueAggregation
+		mean     float64
+		variance float64
+		stddev   float64
+	}{
+		{
+			name:     "no samples",
+			mean:     math.NaN(),
+			variance: math.NaN(),
+			stddev:   math.NaN(),
+		},
+		{
+			name:     "one sample",
+			va:       aggregationOf(3),
+			mean:     3,
+			variance: 0,
+			stddev:   0,
+		},
+		{
+			name:     "many samples",
+			va:       aggregationOf(2, 4, 4, 4, 5, 5, 7, 9),
+			mean:     5,
+			variance: 4,
+			stddev:   2,
+		},
+		{
+			name:     "same value",
+			va:       aggregationOf(0.1, 0.1, 0.1),
+			mean:     0.1,
+			variance: 0,
+			stddev:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.va.Mean(); !floatEqual(got, tt.mean) {
+				t.Errorf("ValueAggregation.Mean() = %v, want %v", got, tt.mean)
+			}
+			if got := tt.va.Variance(); !floatEqual(got, tt.variance) {
+				t.Errorf("ValueAggregation.Variance() = %v, want %v", got, tt.variance)
+			}
+			if got := tt.va.StandardDeviation(); !floatEqual(got, tt.stddev) {
+				t.Errorf("ValueAggregation.StandardDeviation() = %v, want %v", got, tt.stddev)
+			}
+		})
+	}
+}
+
+func TestValueAggregation_Quantile(t *testing.T) {
+	withBuckets := aggregationOf(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	withBuckets.Buckets = []Bucket{
+		{Count: 5, Start: 5, End: 10},
+		{Count: 5, Start: 0, End: 5},
+	}
+	tests := []struct {
+		name string
+		va   ValueAggregation
+		q    float64
+		want float64
+	}{
+		{
+			name: "no samples",
+			q:    0.5,
+			want: math.NaN(),
+		},
+		{
+			name: "negative q",
+			va:   aggregationOf(1, 2),
+			q:    -0.5,
+			want: math.NaN(),
+		},
+		{
+			name: "q too large",
+			va:   aggregationOf(1, 2),
+			q:    1.5,
+			want: math.NaN(),
+		},
+		{
+			name: "min",
+			va:   withBuckets,
+			q:    0,
+			want: 1,
+		},
+		{
+			name: "max",
+			va:   withBuckets,
+			q:    1,
+			want: 10,
+		},
+		{
+			name: "single value",
+			va:   aggregationOf(3),
+			q:    0.99,
+			want: 3,
+		},
+		{
+			name: "interpolated median",
+			va:   withBuckets,
+			q:    0.5,
+			want: 5,
+		},
+		{
+			name: "interpolated p90",
+			va:   withBuckets,
+			q:    0.9,
+			want: 9,
+		},
+		{
+			name: "interpolated clamped to minimum",
+			va:   withBuckets,
+			q:    0.1,
+			want: 1,
+		},
+		{
+			name: "normal median without buckets",
+			va:   aggregationOf(1, 2, 3),
+			q:    0.5,
+			want: 2,
+		},
+		{
+			name: "normal estimate clamped without buckets",
+			va:   aggregationOf(1, 2, 3),
+			q:    0.999999,
+			want: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.va.Quantile(tt.q); !floatEqual(got, tt.want) {
+				t.Errorf("ValueAggregation.Quantile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// randomAggregation is an aggregation of a random number of small integers, so sums are exact and float addition order
+// does not matter
+type randomAggregation struct {
+	va ValueAggregation
+}
+
+func (randomAggregation) Generate(r *rand.Rand, size int) reflect.Value {
+	values := make([]float64, r.Intn(size+1))
+	for i := range values {
+		values[i] = float64(r.Intn(2001) - 1000)
+	}
+	return reflect.ValueOf(randomAggregation{va: aggregationOf(values...)})
+}
+
+func sameStatistics(a, b ValueAggregation) bool {
+	return a.SampleCount == b.SampleCount && a.Sum == b.Sum && a.SumSquare == b.SumSquare && a.Minimum == b.Minimum &&
+		a.Maximum == b.Maximum
+}
+
+func TestValueAggregation_Union_commutative(t *testing.T) {
+	f := func(a, b randomAggregation) bool {
+		return sameStatistics(a.va.Union(b.va), b.va.Union(a.va))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValueAggregation_Union_associative(t *testing.T) {
+	f := func(a, b, c randomAggregation) bool {
+		return sameStatistics(a.va.Union(b.va).Union(c.va), a.va.Union(b.va.Union(c.va)))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValueAggregation_Union_identity(t *testing.T) {
+	f := func(a randomAggregation) bool {
+		return reflect.DeepEqual(a.va.Union(ValueAggregation{}), a.va) &&
+			reflect.DeepEqual(ValueAggregation{}.Union(a.va), a.va)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValueAggregation_Union_matchesTogether(t *testing.T) {
+	f := func(a, b []int16) bool {
+		together := make([]float64, 0, len(a)+len(b))
+		va := make([]float64, 0, len(a))
+		for _, v := range a {
+			va = append(va, float64(v))
+			together = append(together, float64(v))
+		}
+		vb := make([]float64, 0, len(b))
+		for _, v := range b {
+			vb = append(vb, float64(v))
+			together = append(together, float64(v))
+		}
+		return sameStatistics(aggregationOf(va...).Union(aggregationOf(vb...)), aggregationOf(together...))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValueAggregation_Union(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     ValueAggregation
+		other ValueAggregation
+		want  ValueAggregation
+	}{
+		{
+			name:  "empty with positive",
+			a:     ValueAggregation{},
+			other: ValueAggregation{SampleCount: 1, Minimum: 5, Maximum: 5, Sum: 5, SumSquare: 25, FirstValue: 5, LastValue: 5},
+			want:  ValueAggregation{SampleCount: 1, Minimum: 5, Maximum: 5, Sum: 5, SumSquare: 25, FirstValue: 5, LastValue: 5},
+		},
+		{
+			name:  "negative with empty",
+			a:     ValueAggregation{SampleCount: 1, Minimum: -5, Maximum: -5, Sum: -5, SumSquare: 25, FirstValue: -5, LastValue: -5},
+			other: ValueAggregation{},
+			want:  ValueAggregation{SampleCount: 1, Minimum: -5, Maximum: -5, Sum: -5, SumSquare: 25, FirstValue: -5, LastValue: -5},
+		},
+		{
+			name:  "first from a and last from other",
+			a:     ValueAggregation{SampleCount: 1, Minimum: 1, Maximum: 1, Sum: 1, SumSquare: 1, FirstValue: 1, LastValue: 1},
+			other: ValueAggregation{SampleCount: 1, Minimum: 2, Maximum: 2, Sum: 2, SumSquare: 4, FirstValue: 2, LastValue: 2},
+			want:  ValueAggregation{SampleCount: 2, Minimum: 1, Maximum: 2, Sum: 3, SumSquare: 5, FirstValue: 1, LastValue: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Union(tt.other); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValueAggregation.Union() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}